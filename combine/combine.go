@@ -1,37 +1,68 @@
 package combine
 
 import (
+	"context"
 	"github.com/stipo42/stringaling/internal/util"
+	"github.com/stipo42/stringaling/logging"
+	"github.com/stipo42/stringaling/progress"
 	"io"
+	"time"
 )
 
 type StreamCombiner struct {
 	Streams []io.Reader
 	Output  io.Writer
 	Buffer  int64
+	// Called with the progress of Combine about once every ProgressInterval (progress.DefaultInterval when zero)
+	// and once more when it is done, InputSize is the bytes expected across all the streams, zero or less when unknown.
+	OnProgress       func(p progress.Progress)
+	ProgressInterval time.Duration
+	InputSize        int64
+	Logger           logging.Logger // Where messages go, nothing is logged when nil
 }
 
 func (c StreamCombiner) Combine() (err error) {
+	return c.CombineContext(context.Background())
+}
+
+// CombineContext is Combine stopping before the next chunk once ctx is done, in which case ctx.Err() is returned
+func (c StreamCombiner) CombineContext(ctx context.Context) (err error) {
+	size := c.InputSize
+	if size < 0 {
+		size = 0
+	}
+	tracker := progress.NewTracker(1, size, c.ProgressInterval, c.OnProgress)
+	defer tracker.Finish()
+	log := util.NewLog(c.Logger)
 	for _, o := range c.Streams {
 		chunk := make([]byte, c.Buffer)
 		var rerr error
 		for ; rerr == nil; {
+			if err = ctx.Err(); err != nil {
+				return
+			}
 			var read int
 			read, rerr = o.Read(chunk)
 			if rerr != nil {
 				if rerr != io.EOF {
-					util.Error("error reading bytes: %s", rerr)
+					log.Error("error reading bytes: %s", rerr)
 					err = rerr
 					break
 				}
 			}
-			c.write(chunk, read)
+			if c.write(log, chunk, read) < read {
+				return io.ErrShortWrite
+			}
+			tracker.Add(0, int64(read))
+		}
+		if err != nil {
+			return
 		}
 	}
 	return
 }
 
-func (c StreamCombiner) write(ibytes []byte, writenum ...int) (wroteBytes int) {
+func (c StreamCombiner) write(log *util.Log, ibytes []byte, writenum ...int) (wroteBytes int) {
 	var wn int
 	if len(writenum) > 0 {
 		wn = writenum[0]
@@ -43,9 +74,9 @@ func (c StreamCombiner) write(ibytes []byte, writenum ...int) (wroteBytes int) {
 		var werr error
 		wroteBytes, werr = c.Output.Write(ibytes[0:wn])
 		if werr != nil {
-			util.Error("couldn't write bytes: %s", werr)
+			log.Error("couldn't write bytes: %s", werr)
 		} else {
-			util.Debug("wrote %d bytes: '%s'", wroteBytes, string(ibytes[0:wn]))
+			log.Debug("wrote %d bytes: '%s'", wroteBytes, string(ibytes[0:wn]))
 		}
 	}
 	return
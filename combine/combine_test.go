@@ -2,17 +2,15 @@ package combine
 
 import (
 	"bytes"
-	"github.com/stipo42/stringaling/internal/util"
+	"context"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
-func TestMain(m *testing.M) {
-	util.DEBUG = true
-	os.Exit(m.Run())
-}
-
 func TestStringalinger_CombineShort(t *testing.T) {
 	var streams []io.Reader
 	streams = append(streams, bytes.NewReader([]byte("ONE")))
@@ -41,3 +39,84 @@ func TestStringalinger_CombineShort(t *testing.T) {
 	}
 
 }
+
+func TestStringalinger_CombineContextCancelled(t *testing.T) {
+	var streams []io.Reader
+	streams = append(streams, bytes.NewReader([]byte("ONE")))
+	streams = append(streams, bytes.NewReader([]byte("TWO")))
+	sw := bytes.NewBufferString("")
+
+	strcmb := StreamCombiner{
+		Streams: streams,
+		Output:  sw,
+		Buffer:  2,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := strcmb.CombineContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("expected %s but got %v", context.Canceled, err)
+	}
+	if sw.Len() > 0 {
+		t.Errorf("expected nothing to be written but got '%s'", sw.String())
+	}
+}
+
+func TestCombineWith_Output(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stringaling_combine_")
+	if err != nil {
+		t.Fatalf("could not create temp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	one := filepath.Join(dir, "one")
+	two := filepath.Join(dir, "two")
+	outputFileName := filepath.Join(dir, "output")
+	for name, content := range map[string]string{one: "ONE", two: "TWO", outputFileName: "OLD"} {
+		err = ioutil.WriteFile(name, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("could not write %s: %s", name, err)
+		}
+	}
+
+	err = CombineWith([]string{one, filepath.Join(dir, "missing")}, outputFileName, Options{})
+	if err == nil {
+		t.Errorf("expected an error combining a missing file")
+	}
+	assertContent(t, outputFileName, "OLD")
+
+	err = CombineWith([]string{one, two}, outputFileName, Options{NoClobber: true})
+	if err == nil {
+		t.Errorf("expected an error combining into an existing file")
+	}
+	assertContent(t, outputFileName, "OLD")
+
+	err = CombineWith([]string{one, two}, outputFileName, Options{Mode: 0600})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertContent(t, outputFileName, "ONETWO")
+	stats, err := os.Stat(outputFileName)
+	if err != nil {
+		t.Fatalf("could not stat %s: %s", outputFileName, err)
+	}
+	if runtime.GOOS != "windows" && stats.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 but got %o", stats.Mode().Perm())
+	}
+	left, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("could not read %s: %s", dir, err)
+	}
+	if len(left) != 3 {
+		t.Errorf("expected only the inputs and the output to be left but found %d files", len(left))
+	}
+}
+
+func assertContent(t *testing.T, fileName string, expected string) {
+	actual, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Errorf("could not read %s: %s", fileName, err)
+	} else if string(actual) != expected {
+		t.Errorf("expected %s to hold '%s' but got '%s'", fileName, expected, actual)
+	}
+}
@@ -1,49 +1,125 @@
 package combine
 
 import (
+	"context"
+	"fmt"
 	"github.com/stipo42/stringaling/internal/util"
+	"github.com/stipo42/stringaling/logging"
+	"github.com/stipo42/stringaling/progress"
 	"os"
+	"time"
 )
 
-func Combine(files []string, outputFileName string, deleteFiles bool) (err error){
-	var outputFile *os.File
-	outputFile, err = util.GetCleanFile(outputFileName)
-	if err == nil {
-		cmbr := StreamCombiner{
-			Output: outputFile,
-			Buffer: 1024,
+// Options are the settings of a Combine run
+type Options struct {
+	DeleteFiles bool // Delete the input files once they are combined
+	// The permissions of the output file, when zero it is readable and writable by all less the umask
+	Mode os.FileMode
+	// An output file that already exists is an error instead of being replaced, even one that only appears
+	// while the combination is being written
+	NoClobber bool
+	// Called with the progress of the combination about once every ProgressInterval (progress.DefaultInterval when zero)
+	OnProgress       func(p progress.Progress)
+	ProgressInterval time.Duration
+	Logger           logging.Logger // Where messages go, nothing is logged when nil
+}
+
+// Combine writes the files one after the other to the output file,
+// any of the file names may be "-" for stdin or stdout.
+func Combine(files []string, outputFileName string, deleteFiles bool) (err error) {
+	return CombineContext(context.Background(), files, outputFileName, deleteFiles)
+}
+
+// CombineContext is Combine stopping as soon as ctx is done.
+// The output file is then left as it was, the input files are kept and ctx.Err() is returned.
+func CombineContext(ctx context.Context, files []string, outputFileName string, deleteFiles bool) (err error) {
+	return CombineWithContext(ctx, files, outputFileName, Options{DeleteFiles: deleteFiles})
+}
+
+// CombineWith is Combine with more settings
+func CombineWith(files []string, outputFileName string, opts Options) (err error) {
+	return CombineWithContext(context.Background(), files, outputFileName, opts)
+}
+
+// CombineWithContext is CombineWith stopping as soon as ctx is done, see CombineContext.
+// The output is written to a temp file next to the output file and only renamed to it once complete,
+// so a failed run leaves an existing output file as it was.
+func CombineWithContext(ctx context.Context, files []string, outputFileName string, opts Options) (err error) {
+	var output *util.OutputFile
+	log := util.NewLog(opts.Logger)
+	cmbr := StreamCombiner{
+		Logger:           opts.Logger,
+		Output:           os.Stdout,
+		Buffer:           1024,
+		OnProgress:       opts.OnProgress,
+		ProgressInterval: opts.ProgressInterval,
+	}
+	if !util.IsStdStream(outputFileName) {
+		if _, serr := os.Stat(outputFileName); serr == nil && opts.NoClobber {
+			// Checked again as the output is committed, this only saves a combination that could not be
+			err = fmt.Errorf("%s already exists", outputFileName)
+			log.Error("%s", err)
+			return
+		}
+		output, err = util.CreateOutput(outputFileName, opts.Mode)
+		if err != nil {
+			log.Error("cannot open output file (%s): %s", outputFileName, err)
+			return
 		}
+		output.NoClobber = opts.NoClobber
+		cmbr.Output = output
+	}
 
-		for i := 0; i < len(files); i++ {
-			var inputFile *os.File
-			inputFile, err = os.Open(files[i])
-			defer inputFile.Close()
-			if err != nil {
-				util.Error("cannot open input file( %s): %s", files[i], err)
-				break
-			}
-			cmbr.Streams = append(cmbr.Streams, inputFile)
+	for i := 0; i < len(files) && err == nil; i++ {
+		if util.IsStdStream(files[i]) {
+			cmbr.Streams = append(cmbr.Streams, os.Stdin)
+			cmbr.InputSize = -1
+			continue
+		}
+		if stats, serr := os.Stat(files[i]); serr == nil && cmbr.InputSize >= 0 {
+			cmbr.InputSize += stats.Size()
+		}
+		var inputFile *os.File
+		inputFile, err = os.Open(files[i])
+		if err != nil {
+			log.Error("cannot open input file( %s): %s", files[i], err)
+			break
 		}
+		defer inputFile.Close()
+		cmbr.Streams = append(cmbr.Streams, inputFile)
+	}
 
-		err = cmbr.Combine()
+	if err == nil {
+		err = cmbr.CombineContext(ctx)
+	}
 
-		oerr := outputFile.Close()
-		if oerr != nil {
-			util.Error("error closing output file (%s): %s", outputFileName, oerr)
+	if output != nil {
+		if err == nil {
+			err = output.Commit()
+			if err != nil {
+				log.Error("error writing output file (%s): %s", outputFileName, err)
+			}
+		} else {
+			log.Debug("combine failed, leaving %s as it was", outputFileName)
+			output.Abort()
 		}
-	} else {
-		util.Error("cannot open output file (%s): %s", outputFileName, err)
+	}
+	if err != nil {
+		return
 	}
 
 	// Cleanup
-	if deleteFiles {
-		util.Debug("delete flag supplied, deleting input files")
+	if opts.DeleteFiles {
+		log.Debug("delete flag supplied, deleting input files")
 		for i := 0; i < len(files); i++ {
+			if util.IsStdStream(files[i]) {
+				continue
+			}
 			err = os.Remove(files[i])
 			if err != nil {
-				util.Error("error deleting file (%s): %s", files[i], err)
+				log.Error("error deleting file (%s): %s", files[i], err)
 			}
 		}
 	}
 	return
-}
\ No newline at end of file
+}
@@ -1,3 +1,11 @@
 module github.com/stipo42/stringaling
 
-go 1.12
+go 1.18
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.16.7
+	golang.org/x/text v0.3.8
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,92 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CreateFile creates a new file to write to, failing if fileName already exists so nothing is ever overwritten.
+// When mode is zero the file is readable and writable by all, less the umask, otherwise it gets exactly mode.
+func CreateFile(fileName string, mode os.FileMode) (file *os.File, err error) {
+	perm := mode
+	if perm == 0 {
+		perm = 0666
+	}
+	file, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return
+	}
+	if mode != 0 {
+		// The umask only applies when the file is created
+		err = file.Chmod(mode)
+		if err != nil {
+			file.Close()
+			os.Remove(fileName)
+			file = nil
+		}
+	}
+	return
+}
+
+// OutputFile is written under a temp name in the directory of its file name, and only renamed to it
+// once committed. Until then, whatever was at the file name is left as it was.
+type OutputFile struct {
+	*os.File
+	name      string
+	NoClobber bool // Commit fails instead of replacing a file that already exists at the file name
+}
+
+// CreateOutput creates an OutputFile, see CreateFile for mode
+func CreateOutput(fileName string, mode os.FileMode) (out *OutputFile, err error) {
+	dir, base := filepath.Split(fileName)
+	for attempt := 0; attempt < 100; attempt++ {
+		tempFileName := filepath.Join(dir, fmt.Sprintf(".%s.%d%d.tmp", base, time.Now().UnixNano(), attempt))
+		var file *os.File
+		file, err = CreateFile(tempFileName, mode)
+		if err == nil {
+			out = &OutputFile{File: file, name: fileName}
+			return
+		}
+		if !os.IsExist(err) {
+			return
+		}
+	}
+	return
+}
+
+// Commit syncs and closes the temp file and renames it to the file name
+func (o *OutputFile) Commit() (err error) {
+	err = o.Sync()
+	cerr := o.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil && o.NoClobber {
+		err = RenameNew(o.Name(), o.name)
+	} else if err == nil {
+		err = os.Rename(o.Name(), o.name)
+	}
+	if err != nil {
+		os.Remove(o.Name())
+	}
+	return
+}
+
+// Abort closes and removes the temp file, leaving the file name as it was
+func (o *OutputFile) Abort() {
+	o.Close()
+	os.Remove(o.Name())
+}
+
+// RenameNew renames oldName to newName, failing if newName already exists instead of replacing it.
+// The file is linked to its new name, which cannot take the place of another file, and then unlinked from its old one,
+// so a file created at newName after it was checked for is still never replaced.
+func RenameNew(oldName string, newName string) (err error) {
+	err = os.Link(oldName, newName)
+	if err == nil {
+		err = os.Remove(oldName)
+	}
+	return
+}
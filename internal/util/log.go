@@ -0,0 +1,76 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/stipo42/stringaling/logging"
+)
+
+// Log formats messages for a logging.Logger, adding its fields to every message.
+// A nil Log drops every message, so nothing is logged unless a Logger was given.
+type Log struct {
+	logger logging.Logger
+	fields []interface{}
+	debug  bool
+}
+
+// NewLog returns a Log for logger, nil when logger is nil
+func NewLog(logger logging.Logger) *Log {
+	if logger == nil {
+		return nil
+	}
+	l := &Log{logger: logger, debug: true}
+	if leveler, ok := logger.(logging.Leveler); ok {
+		l.debug = leveler.Enabled(logging.LevelDebug)
+	}
+	return l
+}
+
+// With returns a Log adding more fields to every message, alternating keys and values
+func (l *Log) With(fields ...interface{}) *Log {
+	if l == nil {
+		return nil
+	}
+	with := *l
+	with.fields = append(append([]interface{}(nil), l.fields...), fields...)
+	return &with
+}
+
+// Logger returns the logger messages go to, nil when they are dropped
+func (l *Log) Logger() logging.Logger {
+	if l == nil {
+		return nil
+	}
+	return l.logger
+}
+
+func (l *Log) Debug(format string, args ...interface{}) {
+	if l != nil && l.debug {
+		l.logger.Debug(sprintf(format, args), l.fields...)
+	}
+}
+
+func (l *Log) Info(format string, args ...interface{}) {
+	if l != nil {
+		l.logger.Info(sprintf(format, args), l.fields...)
+	}
+}
+
+func (l *Log) Warn(format string, args ...interface{}) {
+	if l != nil {
+		l.logger.Warn(sprintf(format, args), l.fields...)
+	}
+}
+
+func (l *Log) Error(format string, args ...interface{}) {
+	if l != nil {
+		l.logger.Error(sprintf(format, args), l.fields...)
+	}
+}
+
+func sprintf(format string, args []interface{}) string {
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -3,31 +3,17 @@ package util
 import (
 	"errors"
 	"fmt"
-	"os"
-	"runtime"
+	"math"
+	"strconv"
 	"strings"
 )
 
-var DEBUG = false
+// StdStream is the file name that stands for stdin when reading and stdout when writing
+const StdStream = "-"
 
-func Debug(s string, args ...interface{}) {
-	if DEBUG {
-		Log("DEBUG", s, args...)
-	}
-}
-func Info(s string, args ...interface{}) {
-	Log("INFO ", s, args...)
-}
-func Error(s string, args ...interface{}) {
-	Log("ERROR", s, args...)
-}
-
-func Log(level string, msg string, args ...interface{}) {
-	o := msg
-	if len(args) > 0 {
-		o = fmt.Sprintf(msg, args...)
-	}
-	fmt.Println(fmt.Sprintf("*%s* %s", level, o))
+// IsStdStream reports whether fileName stands for stdin or stdout
+func IsStdStream(fileName string) bool {
+	return fileName == StdStream
 }
 
 func HumanReadable(ns int64) string {
@@ -80,27 +66,31 @@ func unitFormatter(v int64, unit string) string {
 	return s
 }
 
-// GetCleanFile gets a file by fileName, deleting it first if it already exists.
-func GetCleanFile(fileName string) (file *os.File, err error) {
-	_, err = os.Stat(fileName)
-	if err == nil {
-		Debug("%s exists, deleting it", fileName)
-		rerr := os.Remove(fileName)
-		if rerr != nil {
-			Debug("cannot remove %s: %s", fileName, rerr)
-		} else {
-			err = errors.New("ok")
-		}
+// ParseSize parses a byte count, optionally suffixed with k, m or g (powers of 1024)
+func ParseSize(s string) (size int64, err error) {
+	if s == "" {
+		err = errors.New("size cannot be empty")
+		return
 	}
-	if err != nil {
-		file, err = os.Create(fileName)
-		if err != nil {
-			Debug("error creating file %s: %s", fileName, err)
-		} else {
-			if runtime.GOOS != "windows" {
-				err = file.Chmod(0777)
-			}
-		}
+	multiplier := int64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	size, err = strconv.ParseInt(s, 10, 64)
+	if err == nil && size < 0 {
+		err = errors.New("size cannot be negative")
+	}
+	if err == nil && size > math.MaxInt64/multiplier {
+		err = errors.New("size is too large")
 	}
+	size *= multiplier
 	return
 }
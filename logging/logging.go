@@ -0,0 +1,99 @@
+// Package logging is how stringaling reports what it is doing. Everything that logs takes a Logger,
+// and logs nothing without one.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Logger receives the messages of a run, args are alternating keys and values such as "worker", 2.
+// The methods have the same signatures as those of *slog.Logger, so one can be given as is.
+// A Logger may be called from any number of goroutines at once.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Leveler is implemented by a Logger that drops the messages below a level,
+// messages at those levels are then never formatted.
+type Leveler interface {
+	Enabled(level Level) bool
+}
+
+// Level is the severity of a message, the values are those of log/slog
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// Discard is a Logger that drops every message
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debug(msg string, args ...interface{}) {}
+func (discard) Info(msg string, args ...interface{})  {}
+func (discard) Warn(msg string, args ...interface{})  {}
+func (discard) Error(msg string, args ...interface{}) {}
+func (discard) Enabled(level Level) bool              { return false }
+
+// NewText returns a Logger writing every message at level or above to w as a line of text,
+// the level first, then the message and its keys and values: *INFO * message worker=2
+func NewText(w io.Writer, level Level) Logger {
+	return &text{w: w, level: level}
+}
+
+type text struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+func (t *text) Debug(msg string, args ...interface{}) { t.log(LevelDebug, msg, args) }
+func (t *text) Info(msg string, args ...interface{})  { t.log(LevelInfo, msg, args) }
+func (t *text) Warn(msg string, args ...interface{})  { t.log(LevelWarn, msg, args) }
+func (t *text) Error(msg string, args ...interface{}) { t.log(LevelError, msg, args) }
+
+func (t *text) Enabled(level Level) bool {
+	return level >= t.level
+}
+
+func (t *text) log(level Level, msg string, args []interface{}) {
+	if !t.Enabled(level) {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("*%-5s* %s", level, msg))
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			sb.WriteString(fmt.Sprintf(" %v=%v", args[i], args[i+1]))
+		} else {
+			sb.WriteString(fmt.Sprintf(" !BADKEY=%v", args[i]))
+		}
+	}
+	sb.WriteString("\n")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.w, sb.String())
+}
@@ -0,0 +1,24 @@
+package logging
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewText(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewText(&out, LevelInfo)
+	logger.Debug("dropped")
+	logger.Info("started", "worker", 2)
+	logger.Warn("odd", "worker")
+	logger.Error("failed", "worker", 0, "bytes", 12)
+	expected := "*INFO * started worker=2\n" +
+		"*WARN * odd !BADKEY=worker\n" +
+		"*ERROR* failed worker=0 bytes=12\n"
+	if out.String() != expected {
+		t.Errorf("unexpected output: %q != %q", out.String(), expected)
+	}
+	if logger.(Leveler).Enabled(LevelDebug) || !logger.(Leveler).Enabled(LevelError) {
+		t.Errorf("unexpected levels enabled")
+	}
+}
@@ -0,0 +1,137 @@
+package progress
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultInterval is how often progress is reported when no interval is set
+const DefaultInterval = time.Second
+
+// Progress is how far a run has got
+type Progress struct {
+	Workers []int64 `json:"workers"` // The input bytes processed by each worker
+	Bytes   int64   `json:"bytes"`   // The input bytes processed by all the workers
+	Total   int64   `json:"total"`   // The input bytes to process, zero when unknown
+	// Rate is the bytes processed per second since the start
+	Rate    float64       `json:"rate"`
+	Elapsed time.Duration `json:"elapsedNs"`
+	// ETA is the estimated time left at the current rate, zero when the total is unknown
+	ETA  time.Duration `json:"etaNs"`
+	Done bool          `json:"done"` // Set on the last report of a run, whether it succeeded or not
+}
+
+// Percent returns how much of the total has been processed, or -1 when the total is unknown
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+	return float64(p.Bytes) * 100 / float64(p.Total)
+}
+
+// Tracker counts the bytes processed by a set of workers and hands the progress to a callback
+// at most once per interval. Add can be called from any number of goroutines.
+type Tracker struct {
+	workers  []int64
+	total    int64
+	interval time.Duration
+	report   func(p Progress)
+	start    time.Time
+	last     int64 // The nanoseconds since start of the previous report
+	mu       sync.Mutex
+	finished bool
+}
+
+// NewTracker returns a Tracker for a number of workers, total is the input size or zero when unknown.
+// A nil report returns a nil Tracker, which counts nothing.
+func NewTracker(workers int, total int64, interval time.Duration, report func(p Progress)) *Tracker {
+	if report == nil {
+		return nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Tracker{
+		workers:  make([]int64, workers),
+		total:    total,
+		interval: interval,
+		report:   report,
+		start:    time.Now(),
+	}
+}
+
+// Add counts n more bytes processed by a worker, reporting the progress when the interval has passed
+func (t *Tracker) Add(worker int, n int64) {
+	if t == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&t.workers[worker], n)
+	now := int64(time.Since(t.start))
+	last := atomic.LoadInt64(&t.last)
+	if now-last < int64(t.interval) || !atomic.CompareAndSwapInt64(&t.last, last, now) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.finished {
+		t.report(t.progress(false))
+	}
+}
+
+// Finish reports the progress one last time with Done set, later calls to Add are not reported
+func (t *Tracker) Finish() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.finished = true
+	t.report(t.progress(true))
+}
+
+// Reader returns a reader counting the bytes read through r as processed by a worker
+func (t *Tracker) Reader(worker int, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &reader{r: r, tracker: t, worker: worker}
+}
+
+// progress takes a snapshot of the counts
+func (t *Tracker) progress(done bool) (p Progress) {
+	p.Workers = make([]int64, len(t.workers))
+	for i := range t.workers {
+		p.Workers[i] = atomic.LoadInt64(&t.workers[i])
+		p.Bytes += p.Workers[i]
+	}
+	p.Total = t.total
+	p.Elapsed = time.Since(t.start)
+	p.Done = done
+	if p.Elapsed > 0 {
+		p.Rate = float64(p.Bytes) / p.Elapsed.Seconds()
+	}
+	if p.Total > p.Bytes && p.Rate > 0 && !done {
+		p.ETA = time.Duration(float64(p.Total-p.Bytes) / p.Rate * float64(time.Second))
+	}
+	return
+}
+
+type reader struct {
+	r       io.Reader
+	tracker *Tracker
+	worker  int
+}
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.tracker.Add(r.worker, int64(n))
+	return
+}
@@ -0,0 +1,44 @@
+package progress
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	var reports []Progress
+	tracker := NewTracker(2, 100, time.Hour, func(p Progress) {
+		reports = append(reports, p)
+	})
+	_, err := ioutil.ReadAll(tracker.Reader(0, strings.NewReader(strings.Repeat("a", 30))))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tracker.Add(1, 20)
+	if len(reports) != 0 {
+		t.Errorf("expected no report before the interval but got %d", len(reports))
+	}
+	tracker.Finish()
+	tracker.Finish()
+	if len(reports) != 1 {
+		t.Fatalf("expected a single report but got %d", len(reports))
+	}
+	p := reports[0]
+	if !p.Done || p.Bytes != 50 || p.Total != 100 || p.Workers[0] != 30 || p.Workers[1] != 20 {
+		t.Errorf("unexpected progress: %+v", p)
+	}
+	if p.Percent() != 50 {
+		t.Errorf("expected 50%% but got %f", p.Percent())
+	}
+}
+
+func TestTracker_Nil(t *testing.T) {
+	tracker := NewTracker(1, 0, 0, nil)
+	if tracker != nil {
+		t.Fatalf("expected a nil tracker without a callback")
+	}
+	tracker.Add(0, 10)
+	tracker.Finish()
+}
@@ -0,0 +1,180 @@
+package replaceall
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// maxStates is how many more states than the patterns have nodes an automaton can be made of.
+// Exact tokens never need more, but a regular expression can need exponentially many, such as one with a bounded
+// repeat of a class that can also start it.
+const maxStates = 1 << 14
+
+// automaton is an Aho-Corasick automaton over a small set of tokens.
+// Each state stands for the partial tokens that the bytes seen so far end with,
+// so a token that misses falls back to whatever of it could still be the start
+// of another match instead of starting over. The states are built from the patterns
+// of the tokens, so a token can match any of several byte strings, of different lengths.
+// A state does not tell how many bytes a partial token is made of when that could vary,
+// only the most it can be, the scanner narrows that down as it goes.
+type automaton struct {
+	patterns []*pattern
+	trans    [][256]int32 // The state reached from each state on each byte
+	depth    []int        // The most bytes a partial token each state stands for can be made of
+	matches  [][]int      // The patterns ending in each state, in order
+	limit    int          // The most bytes any match is made of
+	firsts   []byte       // The distinct bytes that leave the root state
+	leaves   [256]bool
+}
+
+// cursor is how far a pattern has got, the node it is on
+type cursor struct {
+	pattern int32
+	node    int32
+}
+
+// newAutomaton builds an automaton matching the given patterns,
+// patterns that match nothing but the empty string never match.
+// An automaton that would need more than maxStates states on top of the nodes of the patterns is an error.
+func newAutomaton(patterns ...*pattern) (*automaton, error) {
+	a := &automaton{patterns: patterns}
+	var roots []cursor
+	most := maxStates
+	for p, pattern := range patterns {
+		if pattern.limit > a.limit {
+			a.limit = pattern.limit
+		}
+		if pattern.last != 0 {
+			roots = append(roots, cursor{pattern: int32(p)})
+		}
+		most += len(pattern.edges)
+	}
+
+	// Every state is the set of partial tokens it stands for, built breadth first from the root, the empty set
+	ids := make(map[string]int32)
+	var sets [][]cursor
+	state := func(set []cursor) int32 {
+		key := cursorKey(set)
+		if id, ok := ids[key]; ok {
+			return id
+		}
+		id := a.addState(set)
+		ids[key] = id
+		sets = append(sets, set)
+		return id
+	}
+	state(nil)
+	var next [256][]cursor
+	for s := 0; s < len(sets); s++ {
+		if len(sets) > most {
+			return nil, fmt.Errorf("too complex to match, it needs more than %d automaton states", most)
+		}
+		// Any token can also start on the next byte
+		for _, cur := range append(roots, sets[s]...) {
+			for _, e := range patterns[cur.pattern].edges[cur.node] {
+				next[e.c] = append(next[e.c], cursor{pattern: cur.pattern, node: e.to})
+			}
+		}
+		for c := range next {
+			if len(next[c]) > 0 {
+				a.trans[s][c] = state(dedupe(next[c]))
+				next[c] = nil
+			}
+		}
+	}
+
+	for c := 0; c < 256; c++ {
+		if a.trans[0][c] != 0 {
+			a.leaves[c] = true
+			a.firsts = append(a.firsts, byte(c))
+		}
+	}
+	return a, nil
+}
+
+func (a *automaton) addState(set []cursor) int32 {
+	depth := 0
+	var matches []int
+	for _, cur := range set {
+		p := a.patterns[cur.pattern]
+		if p.longest[cur.node] > depth {
+			depth = p.longest[cur.node]
+		}
+		if cur.node == p.last {
+			matches = append(matches, int(cur.pattern))
+		}
+	}
+	a.trans = append(a.trans, [256]int32{})
+	a.depth = append(a.depth, depth)
+	a.matches = append(a.matches, matches)
+	return int32(len(a.trans) - 1)
+}
+
+// longest returns the longest of the patterns ending in state s that b ends with and its length,
+// the pattern first in order when two are as long
+func (a *automaton) longest(s int32, b []byte) (match int, length int) {
+	match = -1
+	for _, p := range a.matches[s] {
+		if n := a.patterns[p].matchLength(b); n > length {
+			match, length = p, n
+		}
+	}
+	return
+}
+
+// dedupe sorts the set and removes what is in it twice
+func dedupe(set []cursor) []cursor {
+	sort.Slice(set, func(i, j int) bool {
+		if set[i].pattern != set[j].pattern {
+			return set[i].pattern < set[j].pattern
+		}
+		return set[i].node < set[j].node
+	})
+	out := set[:0]
+	for i, cur := range set {
+		if i == 0 || cur != set[i-1] {
+			out = append(out, cur)
+		}
+	}
+	return append([]cursor(nil), out...)
+}
+
+// cursorKey identifies a sorted set
+func cursorKey(set []cursor) string {
+	key := make([]byte, 8*len(set))
+	for i, cur := range set {
+		binary.LittleEndian.PutUint32(key[8*i:], uint32(cur.pattern))
+		binary.LittleEndian.PutUint32(key[8*i+4:], uint32(cur.node))
+	}
+	return string(key)
+}
+
+// walk returns the state reached by feeding p from the root state
+func (a *automaton) walk(p []byte) (s int32) {
+	for _, c := range p {
+		s = a.trans[s][c]
+	}
+	return
+}
+
+// skip returns the number of leading bytes of p that cannot start a token,
+// so they can be passed through in a single run.
+func (a *automaton) skip(p []byte) int {
+	n := len(p)
+	if len(a.firsts) <= 4 {
+		for _, f := range a.firsts {
+			if i := bytes.IndexByte(p[:n], f); i >= 0 {
+				n = i
+			}
+		}
+		return n
+	}
+	for i, c := range p {
+		if a.leaves[c] {
+			return i
+		}
+	}
+	return n
+}
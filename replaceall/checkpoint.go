@@ -0,0 +1,334 @@
+package replaceall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+// checkpointVersion is the version of the checkpoint files this release reads and writes
+const checkpointVersion = 1
+
+// DefaultCheckpointInterval is how often each thread saves a checkpoint when no interval is set
+const DefaultCheckpointInterval = 30 * time.Second
+
+// checkpointFile is what is saved to a checkpoint file, it is only valid for the input, rules and ranges it was made for
+type checkpointFile struct {
+	Version      int                `json:"version"`
+	Input        string             `json:"input"`
+	Size         int64              `json:"size"`
+	ModTime      int64              `json:"modTime"`
+	Rules        string             `json:"rules"` // A hash of the rules and substitutions
+	Compression  Compression        `json:"compression"`
+	Encoding     Encoding           `json:"encoding,omitempty"`
+	SyncInterval int64              `json:"syncInterval"`
+	Ranges       []checkpointRange  `json:"ranges"`
+	Workers      []workerCheckpoint `json:"workers"`
+}
+
+type checkpointRange struct {
+	Start   int64 `json:"start"`
+	Length  int64 `json:"length"`
+	Decoded bool  `json:"decoded,omitempty"`
+}
+
+// workerCheckpoint is how far the first scan of a range got, its partial file holds exactly Tally.Written bytes
+type workerCheckpoint struct {
+	Done   bool              `json:"done"`
+	Tally  checkpointTally   `json:"tally"`
+	SyncAt int64             `json:"syncAt"`
+	Sync   []checkpointTally `json:"sync,omitempty"`
+	State  checkpointState   `json:"state"`
+}
+
+type checkpointTally struct {
+	Read          int64 `json:"read"`
+	Written       int64 `json:"written"`
+	Replacements  int64 `json:"replacements"`
+	Substitutions int64 `json:"substitutions"`
+	Removed       int64 `json:"removed"`
+	MaxDepth      int   `json:"maxDepth"`
+	RecentDepth   int   `json:"recentDepth"`
+}
+
+// checkpointState is a matchState, its spool file is given by name and holds exactly SpillSize bytes
+type checkpointState struct {
+	Depth     int    `json:"depth"`
+	Rule      int    `json:"rule"`
+	OpenedAt  int64  `json:"openedAt"`
+	Region    int64  `json:"region"`
+	Partial   int    `json:"partial"`
+	Pending   []byte `json:"pending,omitempty"`
+	Spill     string `json:"spill,omitempty"`
+	SpillSize int64  `json:"spillSize,omitempty"`
+}
+
+// checkpointer saves how far each worker of a run has got, so a run that dies can be picked up where it left off.
+// The partial files and spool files it refers to are kept in dir until the run succeeds.
+type checkpointer struct {
+	fileName string
+	dir      string
+	interval time.Duration
+	log      *util.Log
+	mu       sync.Mutex
+	saved    []time.Time
+	file     checkpointFile
+}
+
+// checkpointDir returns the directory the temp files of a checkpointed run are kept in, next to the checkpoint file.
+// Unless the run is resumed, the checkpoint file must not exist and anything left in the directory is removed.
+func checkpointDir(opts Options) (dir string, err error) {
+	log := util.NewLog(opts.Logger)
+	dir = opts.Checkpoint + ".parts"
+	if !opts.Resume {
+		if _, serr := os.Stat(opts.Checkpoint); serr == nil {
+			err = fmt.Errorf("checkpoint %s already exists, resume from it or remove it", opts.Checkpoint)
+			log.Error("%s", err)
+			return
+		}
+		err = os.RemoveAll(dir)
+	}
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		log.Error("cannot create checkpoint directory %s: %s", dir, err)
+	}
+	return
+}
+
+// openCheckpoint loads the checkpoint of a resumed run, or starts a new one when there is none yet.
+// A checkpoint made for another input, other rules or other ranges is an error.
+func openCheckpoint(opts Options, inputFileName string, ranges []inputRange) (cp *checkpointer, err error) {
+	cp = &checkpointer{
+		fileName: opts.Checkpoint,
+		dir:      opts.TempDir,
+		interval: opts.CheckpointInterval,
+		log:      util.NewLog(opts.Logger),
+		saved:    make([]time.Time, len(ranges)),
+	}
+	if cp.interval <= 0 {
+		cp.interval = DefaultCheckpointInterval
+	}
+	for i := range cp.saved {
+		cp.saved[i] = time.Now()
+	}
+	stats, err := os.Stat(inputFileName)
+	if err != nil {
+		return
+	}
+	rules, err := json.Marshal(struct {
+		Rules         []Rule
+		Substitutions []Substitution
+	}{opts.Rules, opts.Substitutions})
+	if err != nil {
+		return
+	}
+	hash := sha256.Sum256(rules)
+	cp.file = checkpointFile{
+		Version:      checkpointVersion,
+		Input:        inputFileName,
+		Size:         stats.Size(),
+		ModTime:      stats.ModTime().UnixNano(),
+		Rules:        hex.EncodeToString(hash[:]),
+		Compression:  opts.InputCompression,
+		Encoding:     opts.InputEncoding,
+		SyncInterval: syncInterval,
+		Workers:      make([]workerCheckpoint, len(ranges)),
+	}
+	for _, rng := range ranges {
+		cp.file.Ranges = append(cp.file.Ranges, checkpointRange{Start: rng.start, Length: rng.length, Decoded: rng.decoded})
+	}
+	if !opts.Resume {
+		return
+	}
+	log := cp.log
+	content, err := ioutil.ReadFile(opts.Checkpoint)
+	if os.IsNotExist(err) {
+		log.Info("no checkpoint at %s, starting from the beginning", opts.Checkpoint)
+		return cp, nil
+	}
+	if err != nil {
+		log.Error("cannot read checkpoint %s: %s", opts.Checkpoint, err)
+		return
+	}
+	var saved checkpointFile
+	err = json.Unmarshal(content, &saved)
+	if err != nil {
+		err = fmt.Errorf("cannot read checkpoint %s: %s", opts.Checkpoint, err)
+		log.Error("%s", err)
+		return
+	}
+	workers := saved.Workers
+	saved.Workers = cp.file.Workers
+	if !reflect.DeepEqual(saved, cp.file) || len(workers) != len(ranges) {
+		err = fmt.Errorf("checkpoint %s was made for another input file, other rules or another number of threads", opts.Checkpoint)
+		log.Error("%s", err)
+		return
+	}
+	cp.file.Workers = workers
+	log.Info("resuming from checkpoint %s", opts.Checkpoint)
+	return
+}
+
+// done reports whether the first scan of a range was finished before the run died,
+// a range it had read all of is finished even if the run died before it was saved as such
+func (cp *checkpointer) done(i int) bool {
+	w, rng := cp.file.Workers[i], cp.file.Ranges[i]
+	return w.Done || !rng.Decoded && w.Tally.Read >= rng.Length
+}
+
+// start returns where the first scan of a range picks up from
+func (cp *checkpointer) start(i int) (in matchState, from tally, recorder *syncRecorder, err error) {
+	w := cp.file.Workers[i]
+	in, err = cp.state(w.State)
+	from = w.Tally.tally()
+	recorder = &syncRecorder{at: w.SyncAt}
+	for _, t := range w.Sync {
+		recorder.points = append(recorder.points, t.tally())
+	}
+	return
+}
+
+// result returns what the first scan of a finished range reported
+func (cp *checkpointer) result(i int) (r chunkResult) {
+	var recorder *syncRecorder
+	r.id = i
+	r.end, r.tally, recorder, r.err = cp.start(i)
+	r.sync = recorder.points
+	return
+}
+
+// due reports whether a worker should save a checkpoint
+func (cp *checkpointer) due(i int) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return time.Since(cp.saved[i]) >= cp.interval
+}
+
+// save records how far a worker has got once its output and spool file are synced to disk
+func (cp *checkpointer) save(i int, t tally, st matchState, recorder *syncRecorder, done bool, syncOutput func() error) (err error) {
+	err = syncOutput()
+	if err == nil && st.spill != nil {
+		err = st.spill.file.Sync()
+	}
+	if err != nil {
+		cp.log.With("worker", i).Error("couldn't sync to disk for a checkpoint: %s", err)
+		return
+	}
+	w := workerCheckpoint{
+		Done:  done,
+		Tally: checkpointTallyOf(t),
+		State: checkpointState{
+			Depth:    st.depth,
+			Rule:     st.rule,
+			OpenedAt: st.openedAt,
+			Region:   st.region,
+			Partial:  st.partial,
+			Pending:  append([]byte(nil), st.pending...),
+		},
+	}
+	if st.spill != nil {
+		w.State.Spill = filepath.Base(st.spill.file.Name())
+		w.State.SpillSize = st.spill.size
+	}
+	if recorder != nil {
+		w.SyncAt = recorder.at
+		for _, p := range recorder.points {
+			w.Sync = append(w.Sync, checkpointTallyOf(p))
+		}
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.file.Workers[i] = w
+	cp.saved[i] = time.Now()
+	var content []byte
+	content, err = json.Marshal(cp.file)
+	if err != nil {
+		return
+	}
+	var out *util.OutputFile
+	out, err = util.CreateOutput(cp.fileName, 0600)
+	if err == nil {
+		_, err = out.Write(content)
+		if err == nil {
+			err = out.Commit()
+		} else {
+			out.Abort()
+		}
+	}
+	if err != nil {
+		cp.log.Error("couldn't write checkpoint %s: %s", cp.fileName, err)
+	} else {
+		cp.log.With("worker", i).Debug("checkpoint at %d bytes", t.read)
+	}
+	return
+}
+
+// state rebuilds a saved matchState, reopening its spool file
+func (cp *checkpointer) state(s checkpointState) (st matchState, err error) {
+	st = matchState{
+		depth:    s.Depth,
+		rule:     s.Rule,
+		openedAt: s.OpenedAt,
+		region:   s.Region,
+		partial:  s.Partial,
+		pending:  s.Pending,
+	}
+	if s.Spill != "" {
+		st.spill, err = openSpool(filepath.Join(cp.dir, s.Spill), s.SpillSize, cp.log)
+	}
+	return
+}
+
+// openPartial opens the partial file of a checkpointed range, dropping anything written to it after the checkpoint
+func openPartial(fileName string, written int64) (file *os.File, err error) {
+	file, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	err = file.Truncate(written)
+	if err == nil {
+		_, err = file.Seek(written, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		file = nil
+	}
+	return
+}
+
+func checkpointTallyOf(t tally) checkpointTally {
+	return checkpointTally{
+		Read:          t.read,
+		Written:       t.written,
+		Replacements:  t.replacements,
+		Substitutions: t.substitutions,
+		Removed:       t.removed,
+		MaxDepth:      t.maxDepth,
+		RecentDepth:   t.recentDepth,
+	}
+}
+
+func (c checkpointTally) tally() tally {
+	return tally{
+		read:          c.Read,
+		written:       c.Written,
+		replacements:  c.Replacements,
+		substitutions: c.Substitutions,
+		removed:       c.Removed,
+		maxDepth:      c.MaxDepth,
+		recentDepth:   c.RecentDepth,
+	}
+}
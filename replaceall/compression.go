@@ -0,0 +1,279 @@
+package replaceall
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dbzip2 "github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is a format the input can be decompressed from and the output compressed with
+type Compression string
+
+const (
+	NoCompression Compression = "none"
+	Gzip          Compression = "gzip"
+	Zstd          Compression = "zstd"
+	Bzip2         Compression = "bzip2"
+)
+
+// magicSize is the number of leading bytes needed to recognize any supported compression
+const magicSize = 4
+
+var extensions = map[string]Compression{
+	".gz":   Gzip,
+	".gzip": Gzip,
+	".zst":  Zstd,
+	".zstd": Zstd,
+	".bz2":  Bzip2,
+}
+
+// ParseCompression parses the name of a compression, as given on the command line
+func ParseCompression(name string) (c Compression, err error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		c = NoCompression
+	case "gzip", "gz":
+		c = Gzip
+	case "zstd", "zst":
+		c = Zstd
+	case "bzip2", "bz2":
+		c = Bzip2
+	default:
+		err = fmt.Errorf("unknown compression '%s', expected none, gzip, zstd or bzip2", name)
+	}
+	return
+}
+
+// DetectCompression returns the compression of a file from its magic bytes,
+// falling back to its extension when they are not recognized.
+func DetectCompression(fileName string) (c Compression, err error) {
+	var file *os.File
+	file, err = os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	head := make([]byte, magicSize)
+	n, rerr := io.ReadFull(file, head)
+	if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+		err = rerr
+		return
+	}
+	c = detectCompression(head[:n], fileName)
+	return
+}
+
+// detectCompression returns the compression of an input that starts with head
+func detectCompression(head []byte, fileName string) Compression {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b, 0x08}):
+		return Gzip
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return Zstd
+	case len(head) >= 4 && bytes.HasPrefix(head, []byte("BZh")) && head[3] >= '1' && head[3] <= '9':
+		return Bzip2
+	}
+	if c, ok := extensions[strings.ToLower(filepath.Ext(fileName))]; ok {
+		return c
+	}
+	return NoCompression
+}
+
+// compressed reports whether c is an actual compression, the zero value is none
+func (c Compression) compressed() bool {
+	return c != "" && c != NoCompression
+}
+
+// newReader returns a reader decompressing r
+func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case "", NoCompression:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", c)
+}
+
+// newWriter returns a writer compressing to w, it must be closed to finish the compressed stream
+func (c Compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case "", NoCompression:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Bzip2:
+		return dbzip2.NewWriter(w, nil)
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", c)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// members returns the offsets of the parts of a compressed file that can be decompressed on their own,
+// so they can be split across threads. Formats that cannot be split return a single member.
+func (c Compression) members(ctx context.Context, file *os.File, size int64) (offsets []int64, err error) {
+	switch c {
+	case Gzip:
+		return gzipMembers(ctx, file, size)
+	case Zstd:
+		return zstdFrames(file, size)
+	}
+	return []int64{0}, nil
+}
+
+// contextReader fails every read once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (n int, err error) {
+	if err = cr.ctx.Err(); err != nil {
+		return
+	}
+	return cr.r.Read(p)
+}
+
+// countingReader counts the bytes read through it, the gzip reader reads byte by byte from an io.ByteReader
+// so the count is exactly where a member ends.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
+func (cr *countingReader) ReadByte() (b byte, err error) {
+	b, err = cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return
+}
+
+// gzipMembers finds where each member of a gzip file starts, the size of a member is only known
+// once it has been decompressed, so this reads through the whole file once.
+func gzipMembers(ctx context.Context, file *os.File, size int64) (offsets []int64, err error) {
+	cr := &countingReader{r: bufio.NewReaderSize(contextReader{ctx: ctx, r: io.NewSectionReader(file, 0, size)}, DefaultBufferSize)}
+	var zr *gzip.Reader
+	zr, err = gzip.NewReader(cr)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	var start int64
+	for {
+		offsets = append(offsets, start)
+		zr.Multistream(false)
+		_, err = io.Copy(ioutil.Discard, zr)
+		if err != nil {
+			return
+		}
+		start = cr.n
+		err = zr.Reset(cr)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// zstdFrames finds where each frame of a zstd file starts by walking the frame and block headers,
+// nothing needs to be decompressed.
+func zstdFrames(file *os.File, size int64) (offsets []int64, err error) {
+	var pos int64
+	header := make([]byte, 8)
+	for pos < size {
+		offsets = append(offsets, pos)
+		if _, err = file.ReadAt(header[:8], pos); err != nil {
+			return nil, fmt.Errorf("couldn't read zstd frame header at %d: %s", pos, err)
+		}
+		magic := binary.LittleEndian.Uint32(header)
+		if magic&0xfffffff0 == 0x184d2a50 {
+			// Skippable frame
+			pos += 8 + int64(binary.LittleEndian.Uint32(header[4:]))
+			continue
+		}
+		if magic != 0xfd2fb528 {
+			return nil, fmt.Errorf("no zstd frame at %d", pos)
+		}
+		descriptor := header[4]
+		singleSegment := descriptor&0x20 != 0
+		headerSize := int64(5)
+		if !singleSegment {
+			headerSize++
+		}
+		headerSize += []int64{0, 1, 2, 4}[descriptor&3]
+		switch descriptor >> 6 {
+		case 0:
+			if singleSegment {
+				headerSize++
+			}
+		case 1:
+			headerSize += 2
+		case 2:
+			headerSize += 4
+		case 3:
+			headerSize += 8
+		}
+		pos += headerSize
+		for last := false; !last; {
+			if _, err = file.ReadAt(header[:3], pos); err != nil {
+				return nil, fmt.Errorf("couldn't read zstd block header at %d: %s", pos, err)
+			}
+			block := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+			last = block&1 != 0
+			blockSize := int64(block >> 3)
+			switch (block >> 1) & 3 {
+			case 1:
+				// RLE block, a single byte repeated blockSize times
+				blockSize = 1
+			case 3:
+				return nil, fmt.Errorf("reserved zstd block type at %d", pos)
+			}
+			pos += 3 + blockSize
+		}
+		if descriptor&0x04 != 0 {
+			// Content checksum
+			pos += 4
+		}
+	}
+	return
+}
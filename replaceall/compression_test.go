@@ -0,0 +1,129 @@
+package replaceall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDetectCompression(t *testing.T) {
+	cases := []struct {
+		head     []byte
+		fileName string
+		expected Compression
+	}{
+		{[]byte{0x1f, 0x8b, 0x08, 0x00}, "dump.xml", Gzip},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "dump", Zstd},
+		{[]byte("BZh9"), "dump.xml", Bzip2},
+		{[]byte("BZhx"), "dump.xml", NoCompression},
+		{[]byte("<xml"), "dump.xml", NoCompression},
+		{[]byte("<xml"), "dump.XML.GZ", Gzip},
+		{nil, "dump.zst", Zstd},
+		{nil, "-", NoCompression},
+	}
+	for _, c := range cases {
+		if actual := detectCompression(c.head, c.fileName); actual != c.expected {
+			t.Errorf("%q (%s): expected %s but got %s", c.head, c.fileName, c.expected, actual)
+		}
+	}
+}
+
+func TestReplaceAllWith_Compressed(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	expectedFileName := "testdata/TestReplaceAll-expected.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	input, err := ioutil.ReadFile(inputFileName)
+	if err != nil {
+		t.Fatalf("could not read input file (%s): %s", inputFileName, err)
+	}
+	expected, err := quickRead(expectedFileName)
+	if err != nil {
+		t.Fatalf("could not read expected file (%s): %s", expectedFileName, err)
+	}
+	for _, c := range []Compression{Gzip, Zstd, Bzip2} {
+		// Every 100 bytes are compressed on their own, so gzip and zstd input can be split
+		compressedFileName := fmt.Sprintf("testdata/results/compressed-input.%s", c)
+		var compressed bytes.Buffer
+		for p := 0; p < len(input); p += 100 {
+			end := p + 100
+			if end > len(input) {
+				end = len(input)
+			}
+			err = compress(&compressed, c, input[p:end])
+			if err != nil {
+				t.Fatalf("%s: could not compress input: %s", c, err)
+			}
+		}
+		err = ioutil.WriteFile(compressedFileName, compressed.Bytes(), 0644)
+		if err != nil {
+			t.Fatalf("%s: could not write compressed input (%s): %s", c, compressedFileName, err)
+		}
+		if c != Bzip2 {
+			var file *os.File
+			file, err = os.Open(compressedFileName)
+			if err != nil {
+				t.Fatalf("%s: could not open compressed input (%s): %s", c, compressedFileName, err)
+			}
+			var offsets []int64
+			offsets, err = c.members(context.Background(), file, int64(compressed.Len()))
+			file.Close()
+			if members := (len(input) + 99) / 100; err != nil || len(offsets) != members {
+				t.Errorf("%s: expected %d members but got %d: %v", c, members, len(offsets), err)
+			}
+		}
+
+		for _, threads := range []int{1, 4} {
+			outputFileName := fmt.Sprintf("testdata/results/compressed-%d.%s", threads, c)
+			_, err = ReplaceAllWith(compressedFileName, outputFileName, Options{
+				Rules:             []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted></redacted>"}},
+				Threads:           threads,
+				OutputCompression: c,
+			})
+			if err != nil {
+				t.Errorf("%s, %d threads: error during execution: %s", c, threads, err)
+				continue
+			}
+			var actual []byte
+			actual, err = decompress(outputFileName, c)
+			if err != nil {
+				t.Errorf("%s, %d threads: could not decompress output file (%s): %s", c, threads, outputFileName, err)
+			} else if string(actual) != expected {
+				t.Errorf("%s, %d threads: actual did not equal expected: %s != %s", c, threads, actual, expected)
+			}
+		}
+	}
+}
+
+func compress(w io.Writer, c Compression, p []byte) error {
+	cw, err := c.newWriter(w)
+	if err != nil {
+		return err
+	}
+	_, err = cw.Write(p)
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+func decompress(fileName string, c Compression) ([]byte, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r, err := c.newReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,221 @@
+package replaceall
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Encoding is a character encoding the input is decoded from and the output encoded to,
+// tokens are always given in UTF-8 and matched on the decoded text.
+type Encoding string
+
+const (
+	UTF8        Encoding = "utf-8"
+	UTF16       Encoding = "utf-16" // Little or big endian as the byte order mark says, little endian without one
+	UTF16LE     Encoding = "utf-16le"
+	UTF16BE     Encoding = "utf-16be"
+	Windows1252 Encoding = "windows-1252"
+)
+
+// utf8BOM is the byte order mark as it is decoded, a byte order mark in the input is decoded like any other
+// character, so it is written back in the output encoding unless that has none
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// ParseEncoding parses the name of an encoding, as given on the command line
+func ParseEncoding(name string) (e Encoding, err error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		e = UTF8
+	case "utf-16", "utf16":
+		e = UTF16
+	case "utf-16le", "utf16le":
+		e = UTF16LE
+	case "utf-16be", "utf16be":
+		e = UTF16BE
+	case "windows-1252", "cp1252":
+		e = Windows1252
+	default:
+		err = fmt.Errorf("unknown encoding '%s', expected utf-8, utf-16, utf-16le, utf-16be or windows-1252", name)
+	}
+	return
+}
+
+// DetectByteOrder returns the encoding of a file that is e, working out the byte order of UTF-16
+// from the byte order mark the file starts with once decompressed from c. Any other encoding is returned as is.
+func DetectByteOrder(fileName string, e Encoding, c Compression) (Encoding, error) {
+	if e != UTF16 {
+		return e, nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return e, err
+	}
+	defer file.Close()
+	r, err := c.newReader(file)
+	if err != nil {
+		return e, err
+	}
+	defer r.Close()
+	head := make([]byte, 2)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return e, err
+	}
+	return byteOrder(head[:n]), nil
+}
+
+// byteOrder returns the UTF-16 encoding of an input that starts with head
+func byteOrder(head []byte) Encoding {
+	if bytes.HasPrefix(head, []byte{0xfe, 0xff}) {
+		return UTF16BE
+	}
+	return UTF16LE
+}
+
+// decoded reports whether e is an encoding other than UTF-8, the zero value is UTF-8
+func (e Encoding) decoded() bool {
+	return e != "" && e != UTF8
+}
+
+// encoding returns the x/text encoding of e, nil for UTF-8
+func (e Encoding) encoding() (encoding.Encoding, error) {
+	switch e {
+	case "", UTF8:
+		return nil, nil
+	case UTF16, UTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), nil
+	case UTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), nil
+	case Windows1252:
+		return charmap.Windows1252, nil
+	}
+	return nil, fmt.Errorf("unknown encoding '%s'", e)
+}
+
+// newReader returns a reader decoding r to UTF-8, and the encoding it decodes,
+// the byte order of UTF-16 is worked out from the byte order mark r starts with.
+func (e Encoding) newReader(r io.Reader) (io.Reader, Encoding, error) {
+	if e == UTF16 {
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(2)
+		r, e = br, byteOrder(head)
+	}
+	enc, err := e.encoding()
+	if err != nil || enc == nil {
+		return r, e, err
+	}
+	return transform.NewReader(r, enc.NewDecoder()), e, nil
+}
+
+// newWriter returns a writer encoding the UTF-8 written to it to w, it must be closed to write out the last character.
+// A byte order mark is dropped for an encoding that has none.
+func (e Encoding) newWriter(w io.Writer) (io.WriteCloser, error) {
+	enc, err := e.encoding()
+	if err != nil || enc == nil {
+		return nopWriteCloser{w}, err
+	}
+	var t transform.Transformer = enc.NewEncoder()
+	if e == Windows1252 {
+		t = transform.Chain(&dropBOM{}, t)
+	}
+	return transform.NewWriter(w, t), nil
+}
+
+// dropBOM removes a byte order mark from the start of UTF-8 text
+type dropBOM struct {
+	started bool
+}
+
+func (d *dropBOM) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !d.started {
+		if len(src) < len(utf8BOM) && bytes.HasPrefix(utf8BOM, src) && !atEOF {
+			return 0, 0, transform.ErrShortSrc
+		}
+		d.started = true
+		if bytes.HasPrefix(src, utf8BOM) {
+			nSrc = len(utf8BOM)
+		}
+	}
+	nDst = copy(dst, src[nSrc:])
+	nSrc += nDst
+	if nSrc < len(src) {
+		err = transform.ErrShortDst
+	}
+	return
+}
+
+func (d *dropBOM) Reset() {
+	d.started = false
+}
+
+// boundary returns the first offset at or after offset that a range of a file in e can start at,
+// UTF-16 is split between code units, never inside a surrogate pair.
+func (e Encoding) boundary(file *os.File, offset int64) (int64, error) {
+	if e != UTF16LE && e != UTF16BE {
+		return offset, nil
+	}
+	offset += offset % 2
+	if offset < 2 {
+		return offset, nil
+	}
+	unit := make([]byte, 2)
+	_, err := file.ReadAt(unit, offset-2)
+	if err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return offset, err
+	}
+	hi := unit[0]
+	if e == UTF16LE {
+		hi = unit[1]
+	}
+	if hi >= 0xd8 && hi <= 0xdb {
+		// The unit before is the first of a surrogate pair
+		offset += 2
+	}
+	return offset, nil
+}
+
+// lineStart returns the first offset at or after offset that a line of a file in e starts at,
+// or the end of the file when no line does
+func (e Encoding) lineStart(file *os.File, offset int64) (int64, error) {
+	newline := []byte{'\n'}
+	switch e {
+	case UTF16LE:
+		newline = []byte{'\n', 0}
+	case UTF16BE:
+		newline = []byte{0, '\n'}
+	}
+	unit := int64(len(newline))
+	offset += offset % unit
+	if offset < unit {
+		return offset, nil
+	}
+	// A line starts after the newline ending the one before
+	br := bufio.NewReader(io.NewSectionReader(file, offset-unit, math.MaxInt64-offset))
+	read := make([]byte, unit)
+	for {
+		_, err := io.ReadFull(br, read)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		if bytes.Equal(read, newline) {
+			return offset, nil
+		}
+		offset += unit
+	}
+}
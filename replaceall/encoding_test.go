@@ -0,0 +1,159 @@
+package replaceall
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReplaceAllWith_Encoding(t *testing.T) {
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	rules := []Rule{
+		{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted/>"},
+		{StartToken: "<caf\u00e9>", EndToken: "</caf\u00e9>", Token: "\u00e9"},
+	}
+	// A character outside the basic multilingual plane is a surrogate pair in UTF-16, which ranges must not split
+	line := "\U0001f600 <phi>John \U0001f600 Smith</phi> <caf\u00e9>x</caf\u00e9> na\u00efve\n"
+	input := "\ufeff" + strings.Repeat(line, 200)
+	expected := "\ufeff" + strings.Repeat("\U0001f600 <redacted/> \u00e9 na\u00efve\n", 200)
+	for _, c := range []struct {
+		input  Encoding
+		output Encoding
+		file   Encoding // The encoding the input file is in
+		result Encoding // The encoding the output is expected in
+	}{
+		{UTF16, "", UTF16LE, UTF16LE},
+		{UTF16LE, UTF8, UTF16LE, UTF8},
+		{UTF16BE, UTF16BE, UTF16BE, UTF16BE},
+	} {
+		inputFileName := fmt.Sprintf("testdata/results/encoded-input.%s", c.input)
+		err = ioutil.WriteFile(inputFileName, encode(t, input, c.file), 0644)
+		if err != nil {
+			t.Fatalf("could not write input file (%s): %s", inputFileName, err)
+		}
+		for _, threads := range []int{1, 4, 7} {
+			outputFileName := fmt.Sprintf("testdata/results/encoded-%d.%s", threads, c.input)
+			var result Result
+			result, err = ReplaceAllWith(inputFileName, outputFileName, Options{
+				Rules:          rules,
+				Threads:        threads,
+				InputEncoding:  c.input,
+				OutputEncoding: c.output,
+			})
+			if err != nil {
+				t.Errorf("%s, %d threads: error during execution: %s", c.input, threads, err)
+				continue
+			}
+			var actual []byte
+			actual, err = ioutil.ReadFile(outputFileName)
+			if err != nil {
+				t.Errorf("%s, %d threads: could not read output file (%s): %s", c.input, threads, outputFileName, err)
+			} else if !bytes.Equal(actual, encode(t, expected, c.result)) {
+				t.Errorf("%s, %d threads: unexpected output: %q", c.input, threads, actual[:40])
+			}
+			if result.Replacements != 400 || !result.Confident {
+				t.Errorf("%s, %d threads: unexpected result: %+v", c.input, threads, result)
+			}
+		}
+	}
+}
+
+func TestReplaceAllStream_Encoding(t *testing.T) {
+	rules := []Rule{{StartToken: "<caf\u00e9>", EndToken: "</caf\u00e9>", Token: "<x/>"}}
+	for _, c := range []struct {
+		input    string
+		in       Encoding
+		out      Encoding
+		expected string
+		result   Encoding // The encoding the output is expected in
+	}{
+		// The byte order is taken from the byte order mark
+		{"\ufeff<caf\u00e9>1</caf\u00e9> \u00e0", UTF16, "", "\ufeff<x/> \u00e0", UTF16BE},
+		{"<caf\u00e9>1</caf\u00e9> \u00e0\u20ac", Windows1252, "", "<x/> \u00e0\u20ac", Windows1252},
+		{"<caf\u00e9>1</caf\u00e9> \u00e0\u20ac", Windows1252, UTF16LE, "<x/> \u00e0\u20ac", UTF16LE},
+		// Windows-1252 has no byte order mark
+		{"\ufeff<caf\u00e9>1</caf\u00e9> \u00e0", UTF16LE, Windows1252, "<x/> \u00e0", Windows1252},
+		{"\ufeff<caf\u00e9>1</caf\u00e9> \u00e0", UTF8, UTF16LE, "\ufeff<x/> \u00e0", UTF16LE},
+	} {
+		encoding := c.in
+		if encoding == UTF16 {
+			encoding = c.result
+		}
+		var out bytes.Buffer
+		result, err := ReplaceAllStream(bytes.NewReader(encode(t, c.input, encoding)), &out, Options{
+			Rules:          rules,
+			InputEncoding:  c.in,
+			OutputEncoding: c.out,
+		})
+		if err != nil {
+			t.Errorf("%s to %s: unexpected error: %s", c.in, c.out, err)
+		} else if !bytes.Equal(out.Bytes(), encode(t, c.expected, c.result)) {
+			t.Errorf("%s to %s: unexpected output: %q", c.in, c.out, out.Bytes())
+		} else if result.Replacements != 1 {
+			t.Errorf("%s to %s: unexpected result: %+v", c.in, c.out, result)
+		}
+	}
+
+	// A character the output encoding does not have is an error rather than being lost
+	_, err := ReplaceAllStream(bytes.NewReader(encode(t, "\U0001f600", UTF16LE)), ioutil.Discard, Options{
+		Rules:          rules,
+		InputEncoding:  UTF16LE,
+		OutputEncoding: Windows1252,
+	})
+	if err == nil {
+		t.Errorf("expected an error encoding a character windows-1252 does not have")
+	}
+}
+
+func TestEncodingBoundary(t *testing.T) {
+	fileName := "testdata/results/boundary.utf-16le"
+	// a, then a surrogate pair, then b
+	err := ioutil.WriteFile(fileName, encode(t, "a\U0001f600b", UTF16LE), 0644)
+	if err != nil {
+		t.Fatalf("could not write %s: %s", fileName, err)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("could not open %s: %s", fileName, err)
+	}
+	defer file.Close()
+	for offset, expected := range []int64{0, 2, 2, 6, 6, 6, 6, 8} {
+		actual, err := UTF16LE.boundary(file, int64(offset))
+		if err != nil || actual != expected {
+			t.Errorf("offset %d: expected %d but got %d %v", offset, expected, actual, err)
+		}
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	for name, expected := range map[string]Encoding{"": UTF8, "UTF-8": UTF8, "utf16": UTF16, "UTF-16LE": UTF16LE, "utf-16be": UTF16BE, "cp1252": Windows1252} {
+		if e, err := ParseEncoding(name); err != nil || e != expected {
+			t.Errorf("%s: %s %v", name, e, err)
+		}
+	}
+	if _, err := ParseEncoding("ebcdic"); err == nil {
+		t.Errorf("ebcdic should not be accepted")
+	}
+}
+
+// encode returns s in the encoding e
+func encode(t *testing.T, s string, e Encoding) []byte {
+	var b bytes.Buffer
+	w, err := e.newWriter(&b)
+	if err == nil {
+		_, err = w.Write([]byte(s))
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatalf("could not encode %q to %s: %s", s, e, err)
+	}
+	return b.Bytes()
+}
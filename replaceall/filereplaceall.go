@@ -1,239 +1,1007 @@
 package replaceall
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/stipo42/stringaling/combine"
 	"github.com/stipo42/stringaling/internal/util"
+	"github.com/stipo42/stringaling/logging"
+	"github.com/stipo42/stringaling/progress"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
-func ReplaceAll(inputFileName string, outputFileName string, startToken string, endToken string, token string, threads int) (err error) {
-	confident := false
-	useThreads := threads
-	useInputFileName := inputFileName
-	var ct int
-	for ct = 0; ct <= 100; ct++ {
-		useInputFileName, confident, err = replaceAllPass(
-			ct,
-			useInputFileName,
-			outputFileName,
-			startToken,
-			endToken,
-			token,
-			useThreads,
-		)
+// syncInterval is the spacing in bytes of the clean positions each worker records,
+// a range that has to be rescanned can rejoin its first scan at any of them.
+var syncInterval int64 = 64 * 1024
+
+// Options are the settings of a ReplaceAll run
+type Options struct {
+	Rules         []Rule         // The rules to apply, all in the same pass
+	Substitutions []Substitution // The plain tokens to replace, in the same pass as the rules
+	// The XML elements to replace instead of rules and substitutions, the input is then read as an XML document
+	// with a single thread and cannot be checkpointed
+	Elements []Element
+	// The JSON fields to replace instead of rules and substitutions, the input is then read as JSON values with
+	// a single thread, or with NDJSON as a value on every line, split across threads at line ends.
+	// Either way it cannot be checkpointed.
+	Fields  []Field
+	NDJSON  bool
+	Threads int
+	// The most skipped bytes each thread holds in memory while a replacement is open,
+	// past this they are moved to a temp file. Zero keeps everything in memory.
+	SpoolThreshold int64
+	// The compression of the input, detected from its magic bytes or extension when empty.
+	// Gzip members and zstd frames are split across threads, other compressed input uses a single thread.
+	InputCompression Compression
+	// The compression of the output, none when empty, or the compression of the input when it is replaced in place
+	OutputCompression Compression
+	// The encoding of the input, UTF-8 when empty. Input in another encoding is decoded to UTF-8 before it is matched,
+	// so match offsets and byte counts are of the decoded text, and encoded again in OutputEncoding, the input encoding
+	// when empty. A byte order mark is kept, unless OutputEncoding has none.
+	InputEncoding  Encoding
+	OutputEncoding Encoding
+	// When the output file is the input file, the original is kept with this suffix added to its name
+	BackupSuffix string
+	// The directory the partial output of each thread and any spooled bytes are written to, in a directory
+	// of their own that is removed once the run is over. os.TempDir when empty.
+	// The output itself is written to a temp file next to the output file, so it can be renamed to it.
+	TempDir string
+	// The permissions of the output file, when zero it is readable and writable by all less the umask.
+	// The output is written to a temp file and renamed once complete, so an existing output file
+	// is only replaced by a successful run.
+	Mode os.FileMode
+	// An output file that already exists is an error instead of being replaced, even one that only appears while
+	// the run is writing its temp file. A file replaced in place is always replaced.
+	NoClobber bool
+	// Called with the progress of the replacement about once every ProgressInterval
+	// (progress.DefaultInterval when zero), each thread is a worker.
+	OnProgress       func(p progress.Progress)
+	ProgressInterval time.Duration
+	// When set, how far each thread has got is saved to this file about once every CheckpointInterval
+	// (DefaultCheckpointInterval when zero), and the temp files are kept in a directory next to it
+	// until the run succeeds. With Resume an interrupted run picks up from the checkpoint, giving the same
+	// output as a run that was never interrupted, or starts from the beginning when there is none.
+	Checkpoint         string
+	CheckpointInterval time.Duration
+	Resume             bool
+	// Where messages go, those of a thread have its number as the worker. Nothing is logged when nil.
+	Logger logging.Logger
+	// The automata of the validated rules, built once for a run and shared by its threads
+	automata *ruleAutomata
+}
+
+// ReplaceAll replaces everything between startToken and endToken in the input file with token,
+// writing the result to the output file.
+// The input is split into threads ranges that are replaced in parallel, every range
+// hands its unfinished token state to the next so the output is always the same as
+// a single threaded run.
+func ReplaceAll(inputFileName string, outputFileName string, startToken string, endToken string, token string, threads int) (result Result, err error) {
+	return ReplaceAllContext(context.Background(), inputFileName, outputFileName, startToken, endToken, token, threads)
+}
+
+// ReplaceAllContext is ReplaceAll stopping as soon as ctx is done, see ReplaceAllWithContext
+func ReplaceAllContext(ctx context.Context, inputFileName string, outputFileName string, startToken string, endToken string, token string, threads int) (result Result, err error) {
+	return ReplaceAllWithContext(ctx, inputFileName, outputFileName, Options{
+		Rules:   []Rule{{StartToken: startToken, EndToken: endToken, Token: token}},
+		Threads: threads,
+	})
+}
+
+// ReplaceTokens replaces every occurrence of each substitution's needle in the input file with its replacement,
+// writing the result to the output file. Like ReplaceAll, the input is split across threads.
+func ReplaceTokens(inputFileName string, outputFileName string, substitutions []Substitution, threads int) (result Result, err error) {
+	return ReplaceAllWith(inputFileName, outputFileName, Options{
+		Substitutions: substitutions,
+		Threads:       threads,
+	})
+}
+
+// ReplaceAllWith is ReplaceAll configured by opts.
+// Either file name may be "-" for stdin or stdout, input that cannot be seeked is streamed with a single thread.
+func ReplaceAllWith(inputFileName string, outputFileName string, opts Options) (result Result, err error) {
+	return ReplaceAllWithContext(context.Background(), inputFileName, outputFileName, opts)
+}
+
+// ReplaceAllWithContext is ReplaceAllWith stopping as soon as ctx is done.
+// Every thread stops before its next block, the temp files are removed, the output file is left
+// as it was and ctx.Err() is returned.
+func ReplaceAllWithContext(ctx context.Context, inputFileName string, outputFileName string, opts Options) (result Result, err error) {
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+	log := util.NewLog(opts.Logger)
+	if opts.automata == nil {
+		opts.automata, err = compile(opts.Rules, opts.Substitutions, opts.Elements, opts.Fields)
 		if err != nil {
-			util.Error("pass %d resulted in an error, aborting: %s", ct, err)
-			break
+			log.Error("invalid rules: %s", err)
+			return
 		}
-		if confident {
-			util.Info("pass %d was confident that all replacements occurred", ct)
-			break
-		} else {
-			if useThreads == 1 {
-				util.Info("not confident after 1 thread, giving up")
-				break
-			} else {
-				useThreads = int(math.Ceil(float64(useThreads) / 2))
-				util.Info("pass %d was not confident, reducing threads to %d and trying again", ct, useThreads)
-			}
+	}
+	if len(opts.Elements) > 0 {
+		if opts.Checkpoint != "" {
+			err = errors.New("XML elements cannot be checkpointed")
+			log.Error("%s", err)
+			return
 		}
+		// A range of a document cannot be read without what came before it
+		opts.Threads = 1
 	}
-	if err == nil {
-		err = os.Rename(useInputFileName, outputFileName)
+	if len(opts.Fields) > 0 {
+		if opts.Checkpoint != "" {
+			err = errors.New("JSON fields cannot be checkpointed")
+			log.Error("%s", err)
+			return
+		}
+		if !opts.NDJSON {
+			// A range of a value cannot be read without what came before it, a range of lines can
+			opts.Threads = 1
+		}
+	}
+	if opts.Resume && opts.Checkpoint == "" {
+		err = errors.New("there is no checkpoint to resume from")
+		log.Error("%s", err)
+		return
+	}
+	if opts.NoClobber && !util.IsStdStream(outputFileName) && !sameFile(inputFileName, outputFileName) {
+		// Checked again as the output is committed, this only saves a run that could not be
+		if _, serr := os.Stat(outputFileName); serr == nil {
+			err = fmt.Errorf("%s already exists", outputFileName)
+			log.Error("%s", err)
+			return
+		}
+	}
+	if !seekable(inputFileName) {
+		if opts.Checkpoint != "" {
+			err = fmt.Errorf("input %s cannot be seeked, so it cannot be checkpointed", inputFileName)
+			log.Error("%s", err)
+			return
+		}
+		log.Debug("input %s cannot be seeked, streaming it with a single thread", inputFileName)
+		result, err = replaceAllStreamFile(ctx, inputFileName, outputFileName, opts)
+		return
+	}
+	if opts.InputCompression == "" {
+		opts.InputCompression, err = DetectCompression(inputFileName)
 		if err != nil {
-			util.Error("could not rename %s to %s: %s", useInputFileName, outputFileName, err)
+			log.Error("couldn't detect the compression of the input file (%s): %s", inputFileName, err)
+			return
 		}
-		for c := 0; c < ct; c++ {
-			tFileName := getNextTempFile(outputFileName, c)
-			err = os.Remove(tFileName)
-			if err != nil {
-				util.Error("error deleting temp file %s: %s", tFileName, err)
-			}
+		log.Debug("input %s is compressed with %s", inputFileName, opts.InputCompression)
+	}
+	if opts.InputEncoding == UTF16 {
+		opts.InputEncoding, err = DetectByteOrder(inputFileName, opts.InputEncoding, opts.InputCompression)
+		if err != nil {
+			log.Error("couldn't detect the byte order of the input file (%s): %s", inputFileName, err)
+			return
+		}
+		log.Debug("input %s is %s", inputFileName, opts.InputEncoding)
+	}
+	if opts.OutputEncoding == "" {
+		opts.OutputEncoding = opts.InputEncoding
+	}
+	inPlace := sameFile(inputFileName, outputFileName)
+	if inPlace && opts.OutputCompression == "" {
+		opts.OutputCompression = opts.InputCompression
+	}
+	var runDir string
+	if opts.Checkpoint != "" {
+		runDir, err = checkpointDir(opts)
+	} else {
+		runDir, err = createRunDir(log, opts.TempDir)
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		// A checkpointed run keeps its temp files until it succeeds
+		if opts.Checkpoint == "" || err == nil {
+			removeRunDir(log, runDir)
+		}
+		if opts.Checkpoint != "" && err == nil {
+			removeTempFile(log, opts.Checkpoint)
 		}
+	}()
+	opts.TempDir = runDir
+	tempBaseName := outputFileName
+	if util.IsStdStream(outputFileName) {
+		tempBaseName = filepath.Join(runDir, "stdout")
+		opts.Mode = 0600
 	}
+	if !opts.Resume {
+		err = checkSpace(log, inputFileName, runDir, tempBaseName, opts)
+		if err != nil {
+			return
+		}
+	}
+	var tempFileName string
+	tempFileName, result, err = replaceAllPass(ctx, 0, inputFileName, tempBaseName, opts)
+	if err == nil && util.IsStdStream(outputFileName) {
+		err = copyToStdout(ctx, log, tempFileName)
+		removeTempFile(log, tempFileName)
+		return
+	}
+	if inPlace {
+		err = commitInPlace(log, tempFileName, outputFileName, opts.BackupSuffix, err)
+		return
+	}
+	err = commitTempFile(log, tempFileName, outputFileName, opts.NoClobber, err)
 	return
 }
 
-// replaceAllPass executes a single pass of the replaceall function
-// multiple passes are used when the confidence of the AllReplacer isn't unified on 'confident'
+// ReplaceAllStream applies opts to everything read from in, writing the result to out as it is read.
+// A stream cannot be split, so it is always replaced with a single thread.
+func ReplaceAllStream(in io.Reader, out io.Writer, opts Options) (result Result, err error) {
+	return ReplaceAllStreamContext(context.Background(), in, out, opts)
+}
+
+// ReplaceAllStreamContext is ReplaceAllStream stopping as soon as ctx is done, in which case ctx.Err() is returned
+func ReplaceAllStreamContext(ctx context.Context, in io.Reader, out io.Writer, opts Options) (result Result, err error) {
+	strgr := AllReplacer{
+		Rules:             opts.Rules,
+		Substitutions:     opts.Substitutions,
+		Elements:          opts.Elements,
+		Fields:            opts.Fields,
+		NDJSON:            opts.NDJSON,
+		SpoolThreshold:    opts.SpoolThreshold,
+		SpoolDir:          opts.TempDir,
+		InputCompression:  opts.InputCompression,
+		OutputCompression: opts.OutputCompression,
+		InputEncoding:     opts.InputEncoding,
+		OutputEncoding:    opts.OutputEncoding,
+		OnProgress:        opts.OnProgress,
+		ProgressInterval:  opts.ProgressInterval,
+		Logger:            opts.Logger,
+		automata:          opts.automata,
+		ReaderSpawner: func() (io.Reader, error) {
+			return in, nil
+		},
+		WriterSpawner: func() (io.Writer, error) {
+			return out, nil
+		},
+	}
+	return strgr.ReplaceContext(ctx)
+}
+
+// replaceAllStreamFile streams the input file, or stdin, through ReplaceAllStream to the output file, or stdout
+func replaceAllStreamFile(ctx context.Context, inputFileName string, outputFileName string, opts Options) (result Result, err error) {
+	log := util.NewLog(opts.Logger)
+	var input io.Reader
+	var inputFile *os.File
+	input, inputFile, err = openStream(inputFileName, &opts)
+	if err != nil {
+		return
+	}
+	if inputFile != os.Stdin {
+		defer inputFile.Close()
+	}
+	if util.IsStdStream(outputFileName) {
+		return ReplaceAllStreamContext(ctx, input, os.Stdout, opts)
+	}
+
+	tempFileName := getNextTempFile(outputFileName, 0)
+	var tempFile *os.File
+	tempFile, err = util.CreateFile(tempFileName, opts.Mode)
+	if err != nil {
+		log.Error("cannot open temporary output file (%s): %s", tempFileName, err)
+		return
+	}
+	result, err = ReplaceAllStreamContext(ctx, input, tempFile, opts)
+	cerr := tempFile.Close()
+	if cerr != nil {
+		log.Error("error closing temporary output file (%s): %s", tempFileName, cerr)
+		if err == nil {
+			err = cerr
+		}
+	}
+	err = commitTempFile(log, tempFileName, outputFileName, opts.NoClobber, err)
+	return
+}
+
+// openStream opens the input file, or stdin, to be read from start to end,
+// detecting its compression when opts does not give one.
+func openStream(inputFileName string, opts *Options) (input io.Reader, inputFile *os.File, err error) {
+	log := util.NewLog(opts.Logger)
+	inputFile = os.Stdin
+	if !util.IsStdStream(inputFileName) {
+		inputFile, err = os.Open(inputFileName)
+		if err != nil {
+			log.Error("couldn't open input file (%s): %s", inputFileName, err)
+			return
+		}
+	}
+	br := bufio.NewReaderSize(inputFile, DefaultBufferSize)
+	if opts.InputCompression == "" {
+		// The magic bytes are peeked at, so they are still read by the decompressor
+		head, _ := br.Peek(magicSize)
+		opts.InputCompression = detectCompression(head, inputFileName)
+		log.Debug("input %s is compressed with %s", inputFileName, opts.InputCompression)
+	}
+	input = br
+	return
+}
+
+// seekable reports whether the input can be split across threads, which needs a regular file.
+// A file that cannot be stat'd is treated as seekable so the threaded pass reports why.
+func seekable(inputFileName string) bool {
+	if util.IsStdStream(inputFileName) {
+		return false
+	}
+	stats, err := os.Stat(inputFileName)
+	return err != nil || stats.Mode().IsRegular()
+}
+
+// commitTempFile syncs the temp file and renames it to the output file when err is nil, failing instead of replacing
+// an existing output file with noClobber. Otherwise, or when it cannot be renamed, it removes the temp file.
+func commitTempFile(log *util.Log, tempFileName string, outputFileName string, noClobber bool, err error) error {
+	if err == nil {
+		err = syncFile(tempFileName)
+		if err != nil {
+			log.Error("couldn't sync %s to disk: %s", tempFileName, err)
+		}
+	}
+	if err != nil {
+		log.Error("replacement resulted in an error, aborting: %s", err)
+		removeTempFile(log, tempFileName)
+		return err
+	}
+	if noClobber {
+		err = util.RenameNew(tempFileName, outputFileName)
+	} else {
+		err = os.Rename(tempFileName, outputFileName)
+	}
+	if err != nil {
+		log.Error("could not rename %s to %s: %s", tempFileName, outputFileName, err)
+		removeTempFile(log, tempFileName)
+	}
+	return err
+}
+
+// copyToStdout writes the content of a finished temp file to stdout
+func copyToStdout(ctx context.Context, log *util.Log, tempFileName string) (err error) {
+	var tempFile *os.File
+	tempFile, err = os.Open(tempFileName)
+	if err != nil {
+		log.Error("cannot open temporary output file (%s): %s", tempFileName, err)
+		return
+	}
+	defer tempFile.Close()
+	_, err = io.Copy(os.Stdout, contextReader{ctx: ctx, r: tempFile})
+	if err != nil {
+		log.Error("couldn't write output to stdout: %s", err)
+	}
+	return
+}
+
+func removeTempFile(log *util.Log, tempFileName string) {
+	derr := os.Remove(tempFileName)
+	if derr != nil && !os.IsNotExist(derr) {
+		log.Error("error deleting temp file %s: %s", tempFileName, derr)
+	}
+}
+
+// chunkResult is what a worker reports back once it has scanned its range
+type chunkResult struct {
+	id    int
+	end   matchState // The unfinished token state at the end of the range
+	tally tally      // What was counted in the range
+	sync  []tally    // The tallies at the clean positions seen within the range
+	err   error
+}
+
+// segment is part of a partial file that makes it into the final output
+type segment struct {
+	fileName string
+	offset   int64
+}
+
+// replaceAllPass executes a single pass of the replaceall function.
+// Every range is first scanned as if nothing was open at its start, then the ranges are
+// stitched in order, a range whose predecessor left a token unfinished is rescanned from
+// that state until it lines back up with its first scan.
 func replaceAllPass(
+	ctx context.Context,
 	pass int,
 	inputFileName string,
 	outputFileName string,
-	startToken string,
-	endToken string,
-	token string,
-	threads int,
+	opts Options,
 ) (
 	tempFileName string,
-	confident bool,
+	result Result,
 	err error,
 ) {
-	var stats os.FileInfo
-	stats, err = os.Stat(inputFileName)
+	log := util.NewLog(opts.Logger)
+	var ranges []inputRange
+	ranges, err = splitInput(ctx, log, inputFileName, opts.Threads, opts.InputCompression, opts.InputEncoding,
+		len(opts.Fields) > 0 && opts.NDJSON)
 	if err != nil {
-		util.Error("couldn't get file stats on input file (%s): %s", inputFileName, err)
-	} else {
-		// Need to determine thread size
-		tSize := int64(math.Ceil(float64(stats.Size()) / float64(threads)))
+		return
+	}
+	threads := len(ranges)
+	log.Debug("pass-%d: Using %d threads", pass, threads)
+	result.Passes = pass + 1
+	result.Threads = threads
 
-		util.Debug("pass-%d: Using a thread size of %d (file size %d)", pass, tSize, stats.Size())
+	tempFileName = getNextTempFile(outputFileName, pass)
+
+	var size int64
+	if stats, serr := os.Stat(inputFileName); serr == nil {
+		size = stats.Size()
+	}
+	var cp *checkpointer
+	if opts.Checkpoint != "" {
+		cp, err = openCheckpoint(opts, inputFileName, ranges)
+		if err != nil {
+			return
+		}
+	}
 
-		confidenceChannel := make(chan bool, threads)
+	// Rescans are not counted, the bytes were already read once
+	tracker := progress.NewTracker(threads, size, opts.ProgressInterval, opts.OnProgress)
+	resultChannel := make(chan chunkResult, threads)
+	for i := 0; i < threads; i++ {
+		in := matchState{}
+		from := tally{}
+		recorder := &syncRecorder{}
+		if cp != nil {
+			if cp.done(i) {
+				log.With("worker", i).Debug("pass-%d: done before the checkpoint", pass)
+				r := cp.result(i)
+				if ranges[i].decoded {
+					tracker.Add(i, ranges[i].length)
+				} else {
+					tracker.Add(i, r.tally.read)
+				}
+				resultChannel <- r
+				continue
+			}
+			var serr error
+			in, from, recorder, serr = cp.start(i)
+			if serr != nil {
+				resultChannel <- chunkResult{id: i, end: in, err: serr}
+				continue
+			}
+			tracker.Add(i, from.read)
+		}
+		strgr := newFileReplacer(inputFileName, getNextTempWorkFile(opts.TempDir, i), opts, ranges[i], from, i)
+		strgr.tracker = tracker
+		strgr.worker = i
+		strgr.checkpoints = cp
 
-		tempFileName = getNextTempFile(outputFileName, pass)
+		// Do this in it's own thread
+		go replaceWorker(ctx, strgr, in, recorder, resultChannel, i)
+	}
 
-		for i := 0; i < threads; i++ {
-			pTempFileName := getNextTempWorkFile(tempFileName, i)
+	// Consume
+	results := make([]chunkResult, threads)
+	var eb strings.Builder
+	for i := 0; i < threads; i++ {
+		r := <-resultChannel
+		if r.err != nil {
+			eb.WriteString(fmt.Sprintf("[%d]: %s; ", r.id, r.err))
+		}
+		results[r.id] = r
+	}
+	tracker.Finish()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if eb.Len() > 0 {
+		err = errors.New(eb.String())
+	}
 
-			strgr := &AllReplacer{
-				StartToken: startToken,
-				EndToken:   endToken,
-				Token:      token,
-				StartAt:    tSize * int64(i),
-				GoUntil:    tSize,
+	var reruns []string
+	var spills []*spool
+	if err == nil {
+		// Stitch the ranges together in order
+		var segments [][]segment
+		var total tally
+		carry := results[0].end
+		total.add(results[0].tally)
+		segments = append(segments, []segment{{fileName: getNextTempWorkFile(opts.TempDir, 0)}})
+		for i := 1; i < threads && err == nil; i++ {
+			pTempFileName := getNextTempWorkFile(opts.TempDir, i)
+			if carry.clean() {
+				segments = append(segments, []segment{{fileName: pTempFileName}})
+				carry = results[i].end
+				total.add(results[i].tally)
+				continue
 			}
+			rTempFileName := getNextTempRerunFile(opts.TempDir, i)
+			reruns = append(reruns, rTempFileName)
+			log.With("worker", i).Debug("pass-%d: starts inside an unfinished token, rescanning it", pass)
 
-			var threadedOutput *os.File
-			strgr.WriterSpawner = func() (writer io.Writer, err error) {
-				threadedOutput, err = util.GetCleanFile(pTempFileName)
+			if cp != nil && carry.spill != nil {
+				// The checkpoint refers to the spool file the range before ended with, the rescan is given a copy
+				carry.spill, err = carry.spill.copy(opts.TempDir)
 				if err != nil {
-					util.Error("[%d]: couldn't create temp partial file (%s): %s", i, pTempFileName, err)
+					break
 				}
-				return threadedOutput, err
 			}
-			writerCleanup := func() {
-				err = threadedOutput.Close()
-				if err != nil {
-					util.Error("[%d]: couldn't close temp partial file (%s): %s", i, pTempFileName, err)
-				} else {
-					util.Debug("[%d]: closed temp partial file (%s)", i, pTempFileName)
-				}
+			strgr := newFileReplacer(inputFileName, rTempFileName, opts, ranges[i], tally{}, i)
+			joiner := &syncJoiner{points: results[i].sync}
+			var rescanned tally
+			carry, rescanned, err = strgr.replaceChunk(ctx, carry, joiner, i)
+			spills = append(spills, carry.spill)
+			if err != nil {
+				break
 			}
-			strgr.WriterCleanup = &writerCleanup
+			total.add(rescanned)
+			if joiner.joined != nil {
+				log.With("worker", i).Debug("pass-%d: rescan rejoined its first scan at %d", pass, joiner.joined.read)
+				segments = append(segments, []segment{{fileName: rTempFileName}, {fileName: pTempFileName, offset: joiner.joined.written}})
+				carry = results[i].end
+				total.add(results[i].tallyAfter(joiner.i))
+			} else {
+				segments = append(segments, []segment{{fileName: rTempFileName}})
+			}
+		}
 
-			var threadedInput *os.File
-			strgr.ReaderSpawner = func() (reader io.Reader, err error) {
-				threadedInput, err = os.Open(inputFileName)
-				if err != nil {
-					util.Error("[%d]: couldn't open input file (%s): %s", i, inputFileName, err)
-				}
-				return threadedInput, err
+		if err == nil {
+			err = combineSegments(ctx, log, tempFileName, segments, carry, opts.OutputCompression, opts.OutputEncoding, opts.Mode)
+		}
+		result = total.result()
+		result.Passes = pass + 1
+		result.Threads = threads
+		result.Confident = carry.clean()
+		result.BytesWritten += carry.pendingSize()
+		if carry.depth > 0 {
+			result.Unterminated = 1
+		}
+	}
+
+	// Cleanup
+	keep := cp != nil && err != nil
+	if keep {
+		// The checkpoint still refers to the partial and spool files, a closed spool is never discarded
+		for _, r := range results {
+			r.end.spill.close()
+		}
+	}
+	for _, sp := range spills {
+		sp.discard()
+	}
+	for _, rTempFileName := range reruns {
+		derr := os.Remove(rTempFileName)
+		if derr != nil && !os.IsNotExist(derr) {
+			log.Error("error deleting temp rescan file (%s): %s", rTempFileName, derr)
+		}
+	}
+	if keep {
+		return
+	}
+	for _, r := range results {
+		r.end.spill.discard()
+	}
+	for i := 0; i < threads; i++ {
+		pTempFileName := getNextTempWorkFile(opts.TempDir, i)
+		derr := os.Remove(pTempFileName)
+		if derr != nil && !os.IsNotExist(derr) {
+			log.Error("error deleting temp partial file (%s): %s", pTempFileName, derr)
+		}
+	}
+	return
+}
+
+// combineSegments combines the stitched segments into the temp output file,
+// followed by whatever was still pending once the last range was done.
+// The segments are UTF-8, they are encoded as they are combined.
+func combineSegments(
+	ctx context.Context,
+	log *util.Log,
+	tempFileName string,
+	segments [][]segment,
+	last matchState,
+	compression Compression,
+	encoding Encoding,
+	mode os.FileMode,
+) (err error) {
+	var tempFile *os.File
+	tempFile, err = util.CreateFile(tempFileName, mode)
+	if err != nil {
+		log.Error("cannot open temporary output file (%s): %s", tempFileName, err)
+		return
+	}
+	var cw io.WriteCloser
+	cw, err = compression.newWriter(tempFile)
+	if err != nil {
+		log.Error("cannot write %s output: %s", compression, err)
+		tempFile.Close()
+		return
+	}
+	var ew io.WriteCloser
+	ew, err = encoding.newWriter(cw)
+	if err != nil {
+		log.Error("cannot write %s output: %s", encoding, err)
+		cw.Close()
+		tempFile.Close()
+		return
+	}
+
+	// Combine the files
+	cmbr := combine.StreamCombiner{
+		Output: ew,
+		Buffer: 1024,
+	}
+	var tFiles []*os.File
+	for _, segs := range segments {
+		for _, seg := range segs {
+			var pTempFile *os.File
+			pTempFile, err = os.Open(seg.fileName)
+			if err != nil {
+				log.Error("cannot open partial file %s: %s", seg.fileName, err)
+				break
 			}
-			readerCleanup := func() {
-				err = threadedInput.Close()
+			tFiles = append(tFiles, pTempFile)
+			if seg.offset > 0 {
+				_, err = pTempFile.Seek(seg.offset, io.SeekStart)
 				if err != nil {
-					util.Error("[%d]: couldn't close input file (%s): %s", i, inputFileName, err)
-				} else {
-					util.Debug("[%d]: closed input file (%s)", i, inputFileName)
+					log.Error("cannot seek partial file %s to %d: %s", seg.fileName, seg.offset, err)
+					break
 				}
 			}
-			strgr.ReaderCleanup = &readerCleanup
+			cmbr.Streams = append(cmbr.Streams, pTempFile)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if size := last.pendingSize(); size > 0 {
+		log.Debug("writing %d bytes left pending at the end of the file", size)
+		cmbr.Streams = append(cmbr.Streams, last.pendingReader())
+	}
 
-			// Do this in it's own thread
-			go replaceWorker(*strgr, confidenceChannel, i)
+	if err == nil {
+		err = cmbr.CombineContext(ctx)
+	}
+	eerr := ew.Close()
+	if eerr != nil {
+		log.Error("error encoding %s output: %s", encoding, eerr)
+		if err == nil {
+			err = eerr
+		}
+	}
+	cerr := cw.Close()
+	if cerr != nil {
+		log.Error("error finishing %s output: %s", compression, cerr)
+		if err == nil {
+			err = cerr
+		}
+	}
+	for _, file := range tFiles {
+		terr := file.Close()
+		if terr != nil {
+			log.Error("error closing temporary partial file (%s): %s", file.Name(), terr)
+		}
+	}
+	terr := tempFile.Close()
+	if terr != nil {
+		log.Error("error closing temporary output file (%s): %s", tempFile.Name(), terr)
+	}
+	return
+}
+
+// newFileReplacer creates an AllReplacer reading the given range of the input file
+// and writing to the partial file. A range resumed from a checkpoint picks up after the bytes from counts,
+// appending to what it wrote before.
+func newFileReplacer(
+	inputFileName string,
+	pTempFileName string,
+	opts Options,
+	rng inputRange,
+	from tally,
+	id int,
+) AllReplacer {
+	strgr := AllReplacer{
+		Rules:            opts.Rules,
+		Substitutions:    opts.Substitutions,
+		Elements:         opts.Elements,
+		Fields:           opts.Fields,
+		NDJSON:           opts.NDJSON,
+		SpoolThreshold:   opts.SpoolThreshold,
+		SpoolDir:         opts.TempDir,
+		InputCompression: opts.InputCompression,
+		InputEncoding:    opts.InputEncoding,
+		OutputEncoding:   UTF8,
+		Logger:           opts.Logger,
+		automata:         opts.automata,
+	}
+	log := strgr.logger(id)
+	if !rng.decoded {
+		strgr.from = from
+		strgr.StartAt = rng.start + from.read
+		strgr.GoUntil = rng.length - from.read
+	}
 
+	var threadedOutput *os.File
+	strgr.WriterSpawner = func() (writer io.Writer, err error) {
+		if opts.Checkpoint != "" {
+			// A file left by an interrupted run is reused
+			threadedOutput, err = openPartial(pTempFileName, strgr.from.written)
+		} else {
+			threadedOutput, err = util.CreateFile(pTempFileName, 0600)
 		}
-		var eb strings.Builder
-		confident = true
-		// Consume
-		for i := 0; i < threads; i++ {
-			c := <-confidenceChannel
-			if !c {
-				confident = false
-			}
+		if err != nil {
+			log.Error("couldn't create temp partial file (%s): %s", pTempFileName, err)
+		}
+		return threadedOutput, err
+	}
+	writerCleanup := func() {
+		if threadedOutput == nil {
+			return
+		}
+		err := threadedOutput.Close()
+		if err != nil {
+			log.Error("couldn't close temp partial file (%s): %s", pTempFileName, err)
+		} else {
+			log.Debug("closed temp partial file (%s)", pTempFileName)
 		}
+	}
+	strgr.WriterCleanup = &writerCleanup
 
-		if eb.Len() > 0 {
-			err = errors.New(eb.String())
+	var threadedInput *os.File
+	strgr.ReaderSpawner = func() (reader io.Reader, err error) {
+		threadedInput, err = os.Open(inputFileName)
+		if err != nil {
+			log.Error("couldn't open input file (%s): %s", inputFileName, err)
+			return threadedInput, err
+		}
+		if rng.decoded {
+			// Only the members or code units of this range are decoded
+			return io.NewSectionReader(threadedInput, rng.start, rng.length), nil
+		}
+		return threadedInput, err
+	}
+	readerCleanup := func() {
+		if threadedInput == nil {
+			return
+		}
+		err := threadedInput.Close()
+		if err != nil {
+			log.Error("couldn't close input file (%s): %s", inputFileName, err)
+		} else {
+			log.Debug("closed input file (%s)", inputFileName)
 		}
+	}
+	strgr.ReaderCleanup = &readerCleanup
+	return strgr
+}
 
-		if err == nil {
-			var tempFile *os.File
-			tempFile, err = util.GetCleanFile(tempFileName)
-			if err == nil {
-
-				// Combine the files
-				cmbr := combine.StreamCombiner{
-					Output: tempFile,
-					Buffer: 1024,
-				}
-				var tFiles []*os.File
-				for i := 0; i < threads; i++ {
-					pTempFileName := getNextTempWorkFile(tempFileName, i)
-
-					var pTempFile *os.File
-					pTempFile, err = os.Open(pTempFileName)
-					if err != nil {
-						util.Error("cannot open partial file %s: %s", pTempFileName, err)
-						break
-					}
-					cmbr.Streams = append(cmbr.Streams, pTempFile)
-					tFiles = append(tFiles, pTempFile)
-				}
+// inputRange is the part of the input file a single worker replaces.
+// A range of a compressed file is a run of whole members, and a range of a file in another encoding than UTF-8
+// is a run of whole characters, both are given in bytes of the file and decoded as they are read.
+type inputRange struct {
+	start   int64
+	length  int64
+	decoded bool
+}
 
-				err = cmbr.Combine()
-				for _, file := range tFiles {
-					terr := file.Close()
-					if terr != nil {
-						util.Error("error closing temporary partial file (%s): %s", file.Name(), terr)
-					}
-				}
-				terr := tempFile.Close()
-				if terr != nil {
-					util.Error("error closing temporary output file (%s): %s", tempFile.Name(), terr)
-				}
-			} else {
-				util.Error("cannot open temporary output file (%s): %s", tempFileName, err)
+// splitInput splits the input file into at most threads ranges of about the same size,
+// with lines set every range starts at the start of a line.
+func splitInput(
+	ctx context.Context,
+	log *util.Log,
+	inputFileName string,
+	threads int,
+	compression Compression,
+	encoding Encoding,
+	lines bool,
+) (ranges []inputRange, err error) {
+	var file *os.File
+	file, err = os.Open(inputFileName)
+	if err != nil {
+		log.Error("couldn't open input file (%s): %s", inputFileName, err)
+		return
+	}
+	defer file.Close()
+	var stats os.FileInfo
+	stats, err = file.Stat()
+	if err != nil {
+		log.Error("couldn't get file stats on input file (%s): %s", inputFileName, err)
+		return
+	}
+	size := stats.Size()
+	if threads < 1 {
+		threads = 1
+	}
+
+	if compression.compressed() {
+		offsets := []int64{0}
+		// A member of a file in another encoding than UTF-8 can end part way through a character, or any member
+		// part way through a line
+		if threads > 1 && !encoding.decoded() && !lines {
+			offsets, err = compression.members(ctx, file, size)
+			if err != nil {
+				log.Error("couldn't find the %s members of the input file (%s): %s", compression, inputFileName, err)
+				return
+			}
+		}
+		// Group consecutive members until each group holds about its share of the file
+		start := int64(0)
+		for m := 1; m <= len(offsets); m++ {
+			end := size
+			if m < len(offsets) {
+				end = offsets[m]
 			}
+			if end == size || end >= size*int64(len(ranges)+1)/int64(threads) {
+				ranges = append(ranges, inputRange{start: start, length: end - start, decoded: true})
+				start = end
+			}
+		}
+		log.Debug("split %d %s members of %s into %d ranges", len(offsets), compression, inputFileName, len(ranges))
+		return
+	}
 
-			// Cleanup
-			for i := 0; i < threads; i++ {
-				pTempFileName := getNextTempWorkFile(tempFileName, i)
-				err = os.Remove(pTempFileName)
-				if err != nil {
-					util.Error("error deleting temp partial file (%s): %s", pTempFileName, err)
-				}
+	if int64(threads) > size {
+		threads = int(size)
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	// Need to determine thread size
+	tSize := int64(math.Ceil(float64(size) / float64(threads)))
+	log.Debug("Using a thread size of %d (file size %d)", tSize, size)
+	for i := 0; i < threads; i++ {
+		ranges = append(ranges, inputRange{start: tSize * int64(i), length: tSize})
+	}
+	if lines {
+		// Every range has to start on a line of its own, which also starts on a character,
+		// a range left without a line of its own goes
+		split := []inputRange{ranges[0]}
+		for i := 1; i < len(ranges); i++ {
+			var start int64
+			start, err = encoding.lineStart(file, ranges[i].start)
+			if err != nil {
+				log.Error("couldn't split the input file (%s) into lines: %s", inputFileName, err)
+				return
+			}
+			if last := &split[len(split)-1]; start > last.start && start < size {
+				last.length = start - last.start
+				split = append(split, inputRange{start: start, length: tSize})
 			}
 		}
+		ranges = split
+		for i := range ranges {
+			ranges[i].decoded = encoding.decoded()
+		}
+		ranges[len(ranges)-1].length = size - ranges[len(ranges)-1].start
+		log.Debug("split %s into %d ranges of whole lines", inputFileName, len(ranges))
+	} else if encoding.decoded() {
+		// Every range has to start on a character of its own
+		for i := range ranges {
+			ranges[i].decoded = true
+			if i == 0 {
+				continue
+			}
+			ranges[i].start, err = encoding.boundary(file, ranges[i].start)
+			if err != nil {
+				log.Error("couldn't split the %s input file (%s): %s", encoding, inputFileName, err)
+				return
+			}
+			ranges[i-1].length = ranges[i].start - ranges[i-1].start
+		}
 	}
 	return
 }
+
+// getNextTempFile returns a name for the temp file a pass writes the output to, next to the output file
+// so it can be renamed to it. The name is unique to the run so concurrent runs never share it.
 func getNextTempFile(outputFileName string, pass int) string {
-	path, file := splitPath(outputFileName)
-	file = fmt.Sprintf("stringalinger_tmp%d_%s", pass, file)
-	return path + file
+	dir, file := filepath.Split(outputFileName)
+	return filepath.Join(dir, fmt.Sprintf(".%s.stringaling%d-%d-%d.tmp", file, pass, os.Getpid(), time.Now().UnixNano()))
 }
 
-func getNextTempWorkFile(outputFileName string, pass int) string {
-	path, file := splitPath(outputFileName)
-	file = fmt.Sprintf("%d_%s", pass, file)
-	return path + file
+// getNextTempWorkFile returns the name of the partial output of a thread in the run directory
+func getNextTempWorkFile(runDir string, id int) string {
+	return filepath.Join(runDir, fmt.Sprintf("%d.part", id))
 }
 
-func splitPath(fullpath string) (path string, filename string) {
-	pieces := strings.Split(fullpath, "/")
-	filename = pieces[len(pieces)-1]
-	path = strings.Join(pieces[0:len(pieces)-1], "/")
-	if path == "" && len(pieces) > 1 {
-		path = "/"
-	} else if path != "" {
-		path = path + "/"
+// getNextTempRerunFile returns the name of the output of a thread's rescan in the run directory
+func getNextTempRerunFile(runDir string, id int) string {
+	return filepath.Join(runDir, fmt.Sprintf("r%d.part", id))
+}
+
+// createRunDir creates a directory of its own in tempDir, os.TempDir when empty, for the temp files of a run
+func createRunDir(log *util.Log, tempDir string) (runDir string, err error) {
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	runDir, err = ioutil.TempDir(tempDir, "stringaling_")
+	if err != nil {
+		log.Error("cannot create a temp directory in %s: %s", tempDir, err)
+		return
 	}
+	log.Debug("writing temp files to %s", runDir)
 	return
 }
 
-// replaceWorker fires off replaceall.AllReplacer r in a new thread, reporting its confidence back to
-// the supplied confidenceChannel reporting on an id
-func replaceWorker(r AllReplacer, confidenceChannel chan bool, id int) {
-	confident, err := r.Replace(id)
+// removeRunDir removes the temp directory of a run along with anything still in it
+func removeRunDir(log *util.Log, runDir string) {
+	err := os.RemoveAll(runDir)
 	if err != nil {
-		util.Error("[%d]: replacement resulted in an error: %s", id, err)
+		log.Error("error deleting temp directory %s: %s", runDir, err)
+	}
+}
+
+// tallyAfter returns what the first scan of the range counted after its nth clean position
+func (r chunkResult) tallyAfter(n int) tally {
+	t := r.tally.since(r.sync[n])
+	// The deepest nesting after the clean position is the deepest of any tally taken after it
+	t.maxDepth = r.tally.recentDepth
+	for _, p := range r.sync[n+1:] {
+		if p.recentDepth > t.maxDepth {
+			t.maxDepth = p.recentDepth
+		}
+	}
+	return t
+}
+
+// syncRecorder records the tally at the first clean position at or after every syncInterval bytes
+type syncRecorder struct {
+	at     int64
+	points []tally
+}
+
+func (r *syncRecorder) next() int64 {
+	if r.at == 0 {
+		r.at = syncInterval
+	}
+	return r.at
+}
+
+func (r *syncRecorder) clean(t tally) bool {
+	r.points = append(r.points, t)
+	r.at = (t.read/syncInterval + 1) * syncInterval
+	return false
+}
+
+// syncJoiner stops a rescan as soon as it is clean at a position the first scan was also clean at,
+// from there on both scans produce the same bytes.
+type syncJoiner struct {
+	points []tally
+	i      int
+	joined *tally
+}
+
+func (j *syncJoiner) next() int64 {
+	if j.i < len(j.points) {
+		return j.points[j.i].read
+	}
+	return math.MaxInt64
+}
+
+func (j *syncJoiner) clean(t tally) bool {
+	for j.i < len(j.points) && j.points[j.i].read < t.read {
+		j.i++
+	}
+	if j.i < len(j.points) && j.points[j.i].read == t.read {
+		p := j.points[j.i]
+		j.joined = &p
+		return true
+	}
+	return false
+}
+
+// replaceWorker fires off replaceall.AllReplacer r in a new thread from state in, a clean state unless
+// it is resumed from a checkpoint, reporting the state it ended in and the clean positions it saw back to
+// the supplied resultChannel reporting on an id
+func replaceWorker(ctx context.Context, r AllReplacer, in matchState, recorder *syncRecorder, resultChannel chan chunkResult, id int) {
+	end, t, err := r.replaceChunk(ctx, in, recorder, id)
+	if err != nil && err != ctx.Err() {
+		r.logger(id).Error("replacement resulted in an error: %s", err)
+	}
+	resultChannel <- chunkResult{
+		id:    id,
+		end:   end,
+		tally: t,
+		sync:  recorder.points,
+		err:   err,
 	}
-	confidenceChannel <- confident
 }
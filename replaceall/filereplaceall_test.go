@@ -1,9 +1,22 @@
 package replaceall
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stipo42/stringaling/internal/util"
+	"github.com/stipo42/stringaling/logging"
+	"github.com/stipo42/stringaling/progress"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestReplaceAll(t *testing.T) {
@@ -15,7 +28,11 @@ func TestReplaceAll(t *testing.T) {
 	token := "<redacted></redacted>"
 	threads := 5
 
-	err := ReplaceAll(inputFileName, outputFileName, startToken, endToken, token, threads)
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	_, err = ReplaceAll(inputFileName, outputFileName, startToken, endToken, token, threads)
 	if err != nil {
 		t.Errorf("error during execution: %s", err)
 		t.Fail()
@@ -39,6 +56,774 @@ func TestReplaceAll(t *testing.T) {
 	}
 }
 
+func TestReplaceAll_Threads(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	expectedFileName := "testdata/TestReplaceAll-expected.xml"
+	startToken := "<phi>"
+	endToken := "</phi>"
+	token := "<redacted></redacted>"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	expected, err := quickRead(expectedFileName)
+	if err != nil {
+		t.Fatalf("could not read expected file (%s): %s", expectedFileName, err)
+	}
+	for _, threads := range []int{1, 2, 3, 4, 7, 16, 61, 200, 1000} {
+		outputFileName := fmt.Sprintf("testdata/results/results-clean-%d.xml", threads)
+		_, err = ReplaceAll(inputFileName, outputFileName, startToken, endToken, token, threads)
+		if err != nil {
+			t.Errorf("%d threads: error during execution: %s", threads, err)
+			continue
+		}
+		var actual string
+		actual, err = quickRead(outputFileName)
+		if err != nil {
+			t.Errorf("%d threads: could not read output file (%s): %s", threads, outputFileName, err)
+		} else if actual != expected {
+			t.Errorf("%d threads: actual did not equal expected: %s != %s", threads, actual, expected)
+		}
+	}
+}
+
+func TestReplaceAll_ThreadsRejoin(t *testing.T) {
+	defer func(i int64) { syncInterval = i }(syncInterval)
+	syncInterval = 8
+
+	inputFileName := "testdata/results/rejoin-input.txt"
+	var sb strings.Builder
+	for i := 0; i < 50; i++ {
+		sb.WriteString(fmt.Sprintf("line %d <kw nested <kw deep /kw> still /kw> kept <k /k", i))
+		if i%7 == 0 {
+			sb.WriteString(" /kw> stray ")
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("trailing <kw never closed")
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	err = ioutil.WriteFile(inputFileName, []byte(sb.String()), 0644)
+	if err != nil {
+		t.Fatalf("could not write input file (%s): %s", inputFileName, err)
+	}
+
+	expectedResult, err := ReplaceAll(inputFileName, "testdata/results/rejoin-1.txt", "<kw", "/kw>", "CRACKS", 1)
+	if err != nil {
+		t.Fatalf("error during single threaded execution: %s", err)
+	}
+	expected, err := quickRead("testdata/results/rejoin-1.txt")
+	if err != nil {
+		t.Fatalf("could not read single threaded output: %s", err)
+	}
+	if expectedResult.Replacements != 50 || expectedResult.MaxDepth != 2 || expectedResult.Unterminated != 1 || expectedResult.Confident ||
+		expectedResult.BytesRead != int64(sb.Len()) || expectedResult.BytesWritten != int64(len(expected)) ||
+		expectedResult.BytesRead-expectedResult.BytesRemoved+50*int64(len("CRACKS")) != expectedResult.BytesWritten {
+		t.Errorf("unexpected single threaded result: %+v", expectedResult)
+	}
+	for _, threads := range []int{2, 5, 13, 64, 333} {
+		outputFileName := fmt.Sprintf("testdata/results/rejoin-%d.txt", threads)
+		var result Result
+		result, err = ReplaceAll(inputFileName, outputFileName, "<kw", "/kw>", "CRACKS", threads)
+		if err != nil {
+			t.Errorf("%d threads: error during execution: %s", threads, err)
+			continue
+		}
+		if result.Threads != threads {
+			t.Errorf("%d threads: result has %d threads", threads, result.Threads)
+		}
+		result.Threads, result.Duration = expectedResult.Threads, expectedResult.Duration
+		if result != expectedResult {
+			t.Errorf("%d threads: result differs from a single threaded run:\n%+v\n!=\n%+v", threads, result, expectedResult)
+		}
+		var actual string
+		actual, err = quickRead(outputFileName)
+		if err != nil {
+			t.Errorf("%d threads: could not read output file (%s): %s", threads, outputFileName, err)
+		} else if actual != expected {
+			t.Errorf("%d threads: output differs from a single threaded run:\n%s\n!=\n%s", threads, actual, expected)
+		}
+	}
+}
+
+func TestReplaceAllWith_Spool(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	expectedFileName := "testdata/TestReplaceAll-expected.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	expected, err := quickRead(expectedFileName)
+	if err != nil {
+		t.Fatalf("could not read expected file (%s): %s", expectedFileName, err)
+	}
+	for _, threads := range []int{1, 3, 16} {
+		outputFileName := fmt.Sprintf("testdata/results/results-spool-%d.xml", threads)
+		_, err = ReplaceAllWith(inputFileName, outputFileName, Options{
+			Rules:          []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted></redacted>"}},
+			Threads:        threads,
+			SpoolThreshold: 10,
+		})
+		if err != nil {
+			t.Errorf("%d threads: error during execution: %s", threads, err)
+			continue
+		}
+		var actual string
+		actual, err = quickRead(outputFileName)
+		if err != nil {
+			t.Errorf("%d threads: could not read output file (%s): %s", threads, outputFileName, err)
+		} else if actual != expected {
+			t.Errorf("%d threads: actual did not equal expected: %s != %s", threads, actual, expected)
+		}
+	}
+}
+
+func TestReplaceAllWith_Rules(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	expected, err := quickRead(inputFileName)
+	if err != nil {
+		t.Fatalf("could not read input file (%s): %s", inputFileName, err)
+	}
+	expected = strings.NewReplacer(
+		"<name>James Franco</name>", "<name/>",
+		"<name>Mister T</name>", "<name/>",
+		"<name>Ronald Rump</name>", "<name/>",
+		"<ssn>123-45-6789</ssn>", "<ssn/>",
+		"<ssn>123-55-5555</ssn>", "<ssn/>",
+		"<ssn>666-66-6666</ssn>", "<ssn/>",
+	).Replace(expected)
+	for _, threads := range []int{1, 4, 50} {
+		outputFileName := fmt.Sprintf("testdata/results/results-rules-%d.xml", threads)
+		_, err = ReplaceAllWith(inputFileName, outputFileName, Options{
+			Rules: []Rule{
+				{StartToken: "<name>", EndToken: "</name>", Token: "<name/>"},
+				{StartToken: "<ssn>", EndToken: "</ssn>", Token: "<ssn/>"},
+			},
+			Threads: threads,
+		})
+		if err != nil {
+			t.Errorf("%d threads: error during execution: %s", threads, err)
+			continue
+		}
+		var actual string
+		actual, err = quickRead(outputFileName)
+		if err != nil {
+			t.Errorf("%d threads: could not read output file (%s): %s", threads, outputFileName, err)
+		} else if actual != expected {
+			t.Errorf("%d threads: actual did not equal expected: %s != %s", threads, actual, expected)
+		}
+	}
+}
+
+func TestReplaceTokens(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	expected, err := quickRead(inputFileName)
+	if err != nil {
+		t.Fatalf("could not read input file (%s): %s", inputFileName, err)
+	}
+	expected = strings.NewReplacer("<phi>", "<secret>", "</phi>", "</secret>").Replace(expected)
+	for _, threads := range []int{1, 4, 50} {
+		outputFileName := fmt.Sprintf("testdata/results/results-tokens-%d.xml", threads)
+		_, err = ReplaceTokens(inputFileName, outputFileName, []Substitution{
+			{Needle: "<phi>", Replacement: "<secret>"},
+			{Needle: "</phi>", Replacement: "</secret>"},
+		}, threads)
+		if err != nil {
+			t.Errorf("%d threads: error during execution: %s", threads, err)
+			continue
+		}
+		var actual string
+		actual, err = quickRead(outputFileName)
+		if err != nil {
+			t.Errorf("%d threads: could not read output file (%s): %s", threads, outputFileName, err)
+		} else if actual != expected {
+			t.Errorf("%d threads: actual did not equal expected: %s != %s", threads, actual, expected)
+		}
+	}
+}
+
+func TestReplaceAllStream(t *testing.T) {
+	inputString := "Hello billy <kw> SPAM  </kw> this <kw> never closed"
+	expectedString := "Hello billy CRACKS this <kw> never closed"
+	sw := bytes.NewBufferString("")
+	// A reader that cannot be seeked, like a pipe
+	input := struct{ io.Reader }{strings.NewReader(inputString)}
+	_, err := ReplaceAllStream(input, sw, Options{
+		Rules: []Rule{{StartToken: "<kw>", EndToken: "</kw>", Token: "CRACKS"}},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if sw.String() != expectedString {
+		t.Errorf("expected\n'%s'\nbut got\n'%s'", expectedString, sw.String())
+	}
+}
+
+func TestReplaceAllWithContext_Cancelled(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	outputDir := "testdata/results/cancelled"
+	outputFileName := outputDir + "/results-cancelled.xml"
+
+	err := os.RemoveAll(outputDir)
+	if err == nil {
+		err = os.MkdirAll(outputDir, 0755)
+	}
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, threads := range []int{1, 5} {
+		_, err = ReplaceAllWithContext(ctx, inputFileName, outputFileName, Options{
+			Rules:          []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted></redacted>"}},
+			Threads:        threads,
+			SpoolThreshold: 10,
+		})
+		if err != context.Canceled {
+			t.Errorf("%d threads: expected %s but got %v", threads, context.Canceled, err)
+		}
+		left, rerr := ioutil.ReadDir(outputDir)
+		if rerr != nil {
+			t.Fatalf("could not read results directory: %s", rerr)
+		}
+		for _, f := range left {
+			t.Errorf("%d threads: %s was left behind", threads, f.Name())
+		}
+	}
+}
+
+func TestReplaceAllWith_Output(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	outputFileName := "testdata/results/results-output.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err == nil {
+		err = ioutil.WriteFile(outputFileName, []byte("OLD"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("could not create output file (%s): %s", outputFileName, err)
+	}
+	opts := Options{
+		Rules:   []Rule{{StartToken: "<phi>", EndToken: "</phi>"}},
+		Threads: 3,
+		Mode:    0600,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ReplaceAllWithContext(ctx, inputFileName, outputFileName, opts)
+	if err != context.Canceled {
+		t.Errorf("expected %s but got %v", context.Canceled, err)
+	}
+	actual, err := quickRead(outputFileName)
+	if err != nil || actual != "OLD" {
+		t.Errorf("expected a failed run to leave the output file as it was, got '%s' (%v)", actual, err)
+	}
+
+	_, err = ReplaceAllWith(inputFileName, outputFileName, opts)
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	stats, err := os.Stat(outputFileName)
+	if err != nil {
+		t.Fatalf("could not stat output file (%s): %s", outputFileName, err)
+	}
+	if runtime.GOOS != "windows" && stats.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 but got %o", stats.Mode().Perm())
+	}
+}
+
+func TestReplaceAllWith_NoClobber(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	outputFileName := "testdata/results/results-no-clobber.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err == nil {
+		err = ioutil.WriteFile(outputFileName, []byte("OLD"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("could not create output file (%s): %s", outputFileName, err)
+	}
+	opts := Options{
+		Rules:     []Rule{{StartToken: "<phi>", EndToken: "</phi>"}},
+		Threads:   3,
+		NoClobber: true,
+	}
+	_, err = ReplaceAllWith(inputFileName, outputFileName, opts)
+	if err == nil {
+		t.Errorf("expected an error replacing into an existing output file")
+	}
+	actual, err := quickRead(outputFileName)
+	if err != nil || actual != "OLD" {
+		t.Errorf("expected the existing output file to be left as it was, got '%s' (%v)", actual, err)
+	}
+
+	// An output file that only appears while the run is writing is not replaced either
+	err = os.Remove(outputFileName)
+	if err != nil {
+		t.Fatalf("could not remove output file (%s): %s", outputFileName, err)
+	}
+	var once sync.Once
+	opts.OnProgress = func(p progress.Progress) {
+		once.Do(func() {
+			_ = ioutil.WriteFile(outputFileName, []byte("NEW"), 0644)
+		})
+	}
+	_, err = ReplaceAllWith(inputFileName, outputFileName, opts)
+	if err == nil {
+		t.Errorf("expected an error replacing into an output file created during the run")
+	}
+	actual, err = quickRead(outputFileName)
+	if err != nil || actual != "NEW" {
+		t.Errorf("expected the output file created during the run to be left as it was, got '%s' (%v)", actual, err)
+	}
+	left, err := filepath.Glob("testdata/results/.results-no-clobber.xml.stringaling*")
+	if err != nil {
+		t.Fatalf("could not list results directory: %s", err)
+	}
+	for _, f := range left {
+		t.Errorf("%s was left behind", f)
+	}
+
+	err = os.Remove(outputFileName)
+	if err != nil {
+		t.Fatalf("could not remove output file (%s): %s", outputFileName, err)
+	}
+	opts.OnProgress = nil
+	_, err = ReplaceAllWith(inputFileName, outputFileName, opts)
+	if err != nil {
+		t.Errorf("unexpected error replacing into a new output file: %s", err)
+	}
+}
+
+func TestReplaceAllWith_TempDir(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	expectedFileName := "testdata/TestReplaceAll-expected.xml"
+	outputFileName := "testdata/results/results-temp-dir.xml"
+	tempDir := "testdata/results/temp"
+
+	err := os.RemoveAll(tempDir)
+	if err == nil {
+		err = os.MkdirAll(tempDir, 0755)
+	}
+	if err == nil {
+		err = os.RemoveAll(outputFileName)
+	}
+	if err != nil {
+		t.Fatalf("could not create temp directory: %s", err)
+	}
+	expected, err := quickRead(expectedFileName)
+	if err != nil {
+		t.Fatalf("could not read expected file (%s): %s", expectedFileName, err)
+	}
+	_, err = ReplaceAllWith(inputFileName, outputFileName, Options{
+		Rules:          []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted></redacted>"}},
+		Threads:        5,
+		SpoolThreshold: 10,
+		TempDir:        tempDir,
+	})
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	actual, err := quickRead(outputFileName)
+	if err != nil {
+		t.Errorf("could not read output file (%s): %s", outputFileName, err)
+	} else if actual != expected {
+		t.Errorf("actual did not equal expected: %s != %s", actual, expected)
+	}
+	left, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("could not read temp directory: %s", err)
+	}
+	for _, f := range left {
+		t.Errorf("%s was left behind", f.Name())
+	}
+}
+
+func TestReplaceAllWith_Resume(t *testing.T) {
+	defer func(i int64) { syncInterval = i }(syncInterval)
+	syncInterval = 1024
+
+	inputFileName := "testdata/results/resume-input.txt"
+	checkpoint := "testdata/results/resume.checkpoint"
+	var sb strings.Builder
+	for i := 0; sb.Len() < 2*1024*1024; i++ {
+		sb.WriteString(fmt.Sprintf("line %d <kw nested <kw deep /kw> still /kw> kept <k /k\n", i))
+		if i%500 == 0 {
+			// Long enough to spool and to run across ranges
+			sb.WriteString("<kw " + strings.Repeat("skipped ", 20000) + "/kw>\n")
+		}
+	}
+	sb.WriteString("trailing <kw never closed")
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err == nil {
+		err = ioutil.WriteFile(inputFileName, []byte(sb.String()), 0644)
+	}
+	if err == nil {
+		err = os.RemoveAll(checkpoint)
+	}
+	if err != nil {
+		t.Fatalf("could not write input file (%s): %s", inputFileName, err)
+	}
+	opts := Options{
+		Rules:              []Rule{{StartToken: "<kw", EndToken: "/kw>", Token: "CRACKS"}},
+		Threads:            3,
+		SpoolThreshold:     64,
+		CheckpointInterval: time.Nanosecond,
+	}
+	expectedResult, err := ReplaceAllWith(inputFileName, "testdata/results/resume-expected.txt", opts)
+	if err != nil {
+		t.Fatalf("error during uninterrupted execution: %s", err)
+	}
+	expected, err := quickRead("testdata/results/resume-expected.txt")
+	if err != nil {
+		t.Fatalf("could not read uninterrupted output: %s", err)
+	}
+
+	// Interrupt the run every 300K more bytes until it gets to the end
+	outputFileName := "testdata/results/resume-actual.txt"
+	opts.Checkpoint = checkpoint
+	opts.ProgressInterval = time.Nanosecond
+	var result Result
+	runs := 0
+	for ; runs < 50; runs++ {
+		target := int64(runs+1) * 300 * 1024
+		ctx, cancel := context.WithCancel(context.Background())
+		opts.OnProgress = func(p progress.Progress) {
+			if p.Bytes >= target {
+				cancel()
+			}
+		}
+		result, err = ReplaceAllWithContext(ctx, inputFileName, outputFileName, opts)
+		cancel()
+		if err == nil {
+			break
+		}
+		if err != context.Canceled {
+			t.Fatalf("run %d: error during execution: %s", runs, err)
+		}
+		if _, serr := os.Stat(checkpoint); serr != nil {
+			t.Fatalf("run %d: no checkpoint was left: %s", runs, serr)
+		}
+		if runs == 0 {
+			_, err = ReplaceAllWith(inputFileName, outputFileName, Options{Rules: opts.Rules, Threads: 3, Checkpoint: checkpoint})
+			if err == nil {
+				t.Errorf("a run that does not resume should not overwrite the checkpoint")
+			}
+		}
+		opts.Resume = true
+	}
+	if runs < 2 {
+		t.Errorf("the run was only interrupted %d times", runs)
+	}
+	result.Duration = expectedResult.Duration
+	if result != expectedResult {
+		t.Errorf("result differs from an uninterrupted run:\n%+v\n!=\n%+v", result, expectedResult)
+	}
+	actual, err := quickRead(outputFileName)
+	if err != nil {
+		t.Errorf("could not read output file (%s): %s", outputFileName, err)
+	} else if actual != expected {
+		t.Errorf("output differs from an uninterrupted run")
+	}
+	for _, left := range []string{checkpoint, checkpoint + ".parts"} {
+		if _, serr := os.Stat(left); !os.IsNotExist(serr) {
+			t.Errorf("%s was left behind", left)
+		}
+	}
+}
+
+func TestReplaceAllWith_ResumeRead(t *testing.T) {
+	// Every range was read to its end, but the run died before it saved any as done
+	inputFileName := "testdata/results/resume-read-input.txt"
+	opts := Options{
+		Rules:          []Rule{{StartToken: "<kw", EndToken: "/kw>", Token: "CRACKS"}},
+		Threads:        3,
+		Checkpoint:     "testdata/results/resume-read.checkpoint",
+		SpoolThreshold: 16,
+	}
+	cp := checkpointRanges(t, inputFileName, strings.Repeat("kept <kw "+strings.Repeat("x", 100)+" /kw> kept\n", 1000), opts)
+	for i := range cp.file.Workers {
+		cp.file.Workers[i].Done = false
+	}
+	content, err := json.Marshal(cp.file)
+	if err == nil {
+		err = ioutil.WriteFile(opts.Checkpoint, content, 0600)
+	}
+	if err != nil {
+		t.Fatalf("could not write checkpoint: %s", err)
+	}
+
+	outputFileName := "testdata/results/resume-read-output.txt"
+	opts.Resume = true
+	result, err := ReplaceAllWith(inputFileName, outputFileName, opts)
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	actual, err := quickRead(outputFileName)
+	if err != nil {
+		t.Fatalf("could not read output file (%s): %s", outputFileName, err)
+	}
+	if expected := strings.Repeat("kept CRACKS kept\n", 1000); actual != expected {
+		t.Errorf("output differs from an uninterrupted run: %d != %d bytes", len(actual), len(expected))
+	}
+	if result.Replacements != 1000 || !result.Confident {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+// countdownContext is cancelled once Err has been asked for more than ok times
+type countdownContext struct {
+	context.Context
+	ok int
+}
+
+func (c *countdownContext) Err() error {
+	if c.ok > 0 {
+		c.ok--
+		return nil
+	}
+	return context.Canceled
+}
+
+func TestReplaceAllWith_ResumeStitch(t *testing.T) {
+	// Every range is done, the run dies while rescanning a range that starts inside a spooled token
+	inputFileName := "testdata/results/resume-stitch-input.txt"
+	opts := Options{
+		Rules:          []Rule{{StartToken: "<kw", EndToken: "/kw>", Token: "CRACKS"}},
+		Threads:        2,
+		Checkpoint:     "testdata/results/resume-stitch.checkpoint",
+		SpoolThreshold: 16,
+	}
+	cp := checkpointRanges(t, inputFileName, "kept <kw "+strings.Repeat("x", 1000)+" /kw> kept\n", opts)
+	if cp.file.Workers[0].State.Spill == "" {
+		t.Fatalf("the first range did not end in a spooled token: %+v", cp.file.Workers[0])
+	}
+	stitchOpts := opts
+	stitchOpts.TempDir = cp.dir
+	stitchOpts.InputCompression = NoCompression
+	stitchOpts.Resume = true
+	_, _, err := replaceAllPass(&countdownContext{Context: context.Background(), ok: 2}, 0, inputFileName,
+		"testdata/results/resume-stitch-output.txt", stitchOpts)
+	if err != context.Canceled {
+		t.Fatalf("expected %s but got %v", context.Canceled, err)
+	}
+
+	outputFileName := "testdata/results/resume-stitch-output.txt"
+	opts.Resume = true
+	_, err = ReplaceAllWith(inputFileName, outputFileName, opts)
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	actual, err := quickRead(outputFileName)
+	if err != nil {
+		t.Fatalf("could not read output file (%s): %s", outputFileName, err)
+	} else if actual != "kept CRACKS kept\n" {
+		t.Errorf("unexpected output: %q", actual)
+	}
+}
+
+// checkpointRanges writes input to inputFileName and scans every range of it to its end for a new checkpoint
+func checkpointRanges(t *testing.T, inputFileName string, input string, opts Options) *checkpointer {
+	err := os.MkdirAll("testdata/results", 0755)
+	if err == nil {
+		err = ioutil.WriteFile(inputFileName, []byte(input), 0644)
+	}
+	if err == nil {
+		err = os.RemoveAll(opts.Checkpoint)
+	}
+	if err != nil {
+		t.Fatalf("could not write input file (%s): %s", inputFileName, err)
+	}
+	opts.TempDir, err = checkpointDir(opts)
+	if err != nil {
+		t.Fatalf("could not create checkpoint directory: %s", err)
+	}
+	opts.InputCompression = NoCompression
+	ranges, err := splitInput(context.Background(), util.NewLog(nil), inputFileName, opts.Threads, opts.InputCompression, "", false)
+	if err != nil {
+		t.Fatalf("could not split input: %s", err)
+	}
+	cp, err := openCheckpoint(opts, inputFileName, ranges)
+	if err != nil {
+		t.Fatalf("could not open checkpoint: %s", err)
+	}
+	for i, rng := range ranges {
+		strgr := newFileReplacer(inputFileName, getNextTempWorkFile(opts.TempDir, i), opts, rng, tally{}, i)
+		strgr.checkpoints = cp
+		strgr.worker = i
+		end, _, rerr := strgr.replaceChunk(context.Background(), matchState{}, &syncRecorder{}, i)
+		if rerr != nil {
+			t.Fatalf("range %d: unexpected error: %s", i, rerr)
+		}
+		end.spill.close()
+	}
+	return cp
+}
+
+// cancellingReader cancels its context once it has been read from
+type cancellingReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (cr cancellingReader) Read(p []byte) (int, error) {
+	cr.cancel()
+	return cr.Reader.Read(p)
+}
+
+func TestReplaceAllStreamContext_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	input := cancellingReader{Reader: strings.NewReader(strings.Repeat("Hello <kw> SPAM </kw> ", 10000)), cancel: cancel}
+	sw := bytes.NewBufferString("")
+	_, err := ReplaceAllStreamContext(ctx, input, sw, Options{
+		Rules: []Rule{{StartToken: "<kw>", EndToken: "</kw>", Token: "CRACKS"}},
+	})
+	if err != context.Canceled {
+		t.Errorf("expected %s but got %v", context.Canceled, err)
+	}
+}
+
+func TestReplaceAllWith_Progress(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	outputFileName := "testdata/results/results-progress.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	stats, err := os.Stat(inputFileName)
+	if err != nil {
+		t.Fatalf("could not stat input file (%s): %s", inputFileName, err)
+	}
+	var last progress.Progress
+	var mu sync.Mutex
+	_, err = ReplaceAllWith(inputFileName, outputFileName, Options{
+		Rules:   []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted></redacted>"}},
+		Threads: 3,
+		OnProgress: func(p progress.Progress) {
+			mu.Lock()
+			defer mu.Unlock()
+			last = p
+		},
+	})
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	if !last.Done || len(last.Workers) != 3 || last.Bytes != stats.Size() || last.Total != stats.Size() {
+		t.Errorf("unexpected last progress: %+v", last)
+	}
+}
+
+// recordingLogger keeps every message it is given with its level
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []string
+	workers map[interface{}]bool
+}
+
+func (r *recordingLogger) record(level string, msg string, args []interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, level+" "+msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i] == "worker" {
+			r.workers[args[i+1]] = true
+		}
+	}
+}
+
+func (r *recordingLogger) Debug(msg string, args ...interface{}) { r.record("DEBUG", msg, args) }
+func (r *recordingLogger) Info(msg string, args ...interface{})  { r.record("INFO", msg, args) }
+func (r *recordingLogger) Warn(msg string, args ...interface{})  { r.record("WARN", msg, args) }
+func (r *recordingLogger) Error(msg string, args ...interface{}) { r.record("ERROR", msg, args) }
+
+func TestReplaceAllWith_Logger(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	outputFileName := "testdata/results/results-logger.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	logger := &recordingLogger{workers: make(map[interface{}]bool)}
+	_, err = ReplaceAllWith(inputFileName, outputFileName, Options{
+		Rules:   []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted></redacted>"}},
+		Threads: 3,
+		Logger:  logger,
+	})
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	if len(logger.records) == 0 {
+		t.Fatalf("nothing was logged")
+	}
+	for _, worker := range []int{0, 1, 2} {
+		if !logger.workers[worker] {
+			t.Errorf("nothing was logged for worker %d: %v", worker, logger.workers)
+		}
+	}
+
+	_, err = ReplaceAllWith(inputFileName, outputFileName, Options{
+		Rules:   []Rule{{StartToken: "<phi>", EndToken: "</phi>"}},
+		Threads: 3,
+		Logger:  logging.NewText(ioutil.Discard, logging.LevelInfo),
+	})
+	if err != nil {
+		t.Errorf("error during execution with a text logger: %s", err)
+	}
+}
+
+func TestReplaceAllWith_Stdout(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	expectedFileName := "testdata/TestReplaceAll-expected.xml"
+	outputFileName := "testdata/results/results-stdout.xml"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	expected, err := quickRead(expectedFileName)
+	if err != nil {
+		t.Fatalf("could not read expected file (%s): %s", expectedFileName, err)
+	}
+	stdout, err := os.Create(outputFileName)
+	if err != nil {
+		t.Fatalf("could not create output file (%s): %s", outputFileName, err)
+	}
+	defer func(s *os.File) { os.Stdout = s }(os.Stdout)
+	os.Stdout = stdout
+	_, err = ReplaceAllWith(inputFileName, "-", Options{
+		Rules:   []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted></redacted>"}},
+		Threads: 5,
+	})
+	stdout.Close()
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	actual, err := quickRead(outputFileName)
+	if err != nil {
+		t.Errorf("could not read output file (%s): %s", outputFileName, err)
+	} else if actual != expected {
+		t.Errorf("actual did not equal expected: %s != %s", actual, expected)
+	}
+}
+
 func quickRead(fileName string) (content string, err error) {
 	var f *os.File
 	f, err = os.Open(fileName)
@@ -49,3 +834,28 @@ func quickRead(fileName string) (content string, err error) {
 	}
 	return
 }
+
+func BenchmarkReplaceAll_Fixture(b *testing.B) {
+	inputFileName := "testdata/results/benchmark-input.xml"
+	outputFileName := "testdata/results/benchmark-clean.xml"
+	input, err := benchmarkInput()
+	if err != nil {
+		b.Fatalf("could not build benchmark input: %s", err)
+	}
+	err = os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		b.Fatalf("could not create results directory: %s", err)
+	}
+	err = ioutil.WriteFile(inputFileName, input, 0644)
+	if err != nil {
+		b.Fatalf("could not write benchmark input (%s): %s", inputFileName, err)
+	}
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = ReplaceAll(inputFileName, outputFileName, "<phi>", "</phi>", "<redacted></redacted>", 1)
+		if err != nil {
+			b.Fatalf("error during execution: %s", err)
+		}
+	}
+}
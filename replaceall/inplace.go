@@ -0,0 +1,165 @@
+package replaceall
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+// ReplaceInPlace applies opts to a file, replacing it with the result.
+// The result is written to a temp file in the same directory, synced to disk, given the permissions
+// and ownership of the original and then renamed over it, so the file is never left half written.
+// When opts.BackupSuffix is set, the original is kept with the suffix added to its name.
+func ReplaceInPlace(fileName string, opts Options) (result Result, err error) {
+	return ReplaceInPlaceContext(context.Background(), fileName, opts)
+}
+
+// ReplaceInPlaceContext is ReplaceInPlace stopping as soon as ctx is done, the file is then left as it was
+func ReplaceInPlaceContext(ctx context.Context, fileName string, opts Options) (result Result, err error) {
+	log := util.NewLog(opts.Logger)
+	if util.IsStdStream(fileName) {
+		err = fmt.Errorf("cannot replace %s in place", fileName)
+		log.Error("%s", err)
+		return
+	}
+	stats, err := os.Stat(fileName)
+	if err != nil {
+		log.Error("couldn't get file stats on input file (%s): %s", fileName, err)
+		return
+	}
+	if !stats.Mode().IsRegular() {
+		err = fmt.Errorf("cannot replace %s in place, it is not a regular file", fileName)
+		log.Error("%s", err)
+		return
+	}
+	return ReplaceAllWithContext(ctx, fileName, fileName, opts)
+}
+
+// sameFile reports whether both names are the same existing file, which means replacing it in place
+func sameFile(inputFileName string, outputFileName string) bool {
+	if util.IsStdStream(inputFileName) || util.IsStdStream(outputFileName) {
+		return false
+	}
+	in, err := os.Stat(inputFileName)
+	if err != nil {
+		return false
+	}
+	out, err := os.Stat(outputFileName)
+	return err == nil && os.SameFile(in, out)
+}
+
+// commitInPlace renames the temp file over the file it replaces when err is nil, giving it the original's
+// permissions and ownership and keeping a backup of the original first if backupSuffix is set.
+// Otherwise, the temp file is removed and the file is left as it was.
+func commitInPlace(log *util.Log, tempFileName string, fileName string, backupSuffix string, err error) error {
+	if err != nil {
+		return commitTempFile(log, tempFileName, fileName, false, err)
+	}
+	err = keepAttributes(log, fileName, tempFileName)
+	if err != nil {
+		return commitTempFile(log, tempFileName, fileName, false, err)
+	}
+	backupFileName := ""
+	if backupSuffix != "" {
+		backupFileName = fileName + backupSuffix
+		err = backupFile(log, fileName, backupFileName)
+		if err != nil {
+			log.Error("couldn't back up %s to %s: %s", fileName, backupFileName, err)
+			return commitTempFile(log, tempFileName, fileName, false, err)
+		}
+		log.Debug("backed up %s to %s", fileName, backupFileName)
+	}
+	err = commitTempFile(log, tempFileName, fileName, false, nil)
+	if err != nil {
+		if backupFileName != "" {
+			removeTempFile(log, backupFileName)
+		}
+		return err
+	}
+	syncDir(log, filepath.Dir(fileName))
+	return nil
+}
+
+// keepAttributes gives the temp file the permissions and ownership of the file it replaces
+func keepAttributes(log *util.Log, fileName string, tempFileName string) error {
+	stats, err := os.Stat(fileName)
+	if err != nil {
+		log.Error("couldn't get file stats on %s: %s", fileName, err)
+		return err
+	}
+	err = os.Chmod(tempFileName, stats.Mode().Perm())
+	if err != nil {
+		log.Error("couldn't set the permissions of %s: %s", tempFileName, err)
+		return err
+	}
+	err = chownLike(tempFileName, stats)
+	if err != nil {
+		log.Error("couldn't give %s the ownership of %s: %s", tempFileName, fileName, err)
+	}
+	return err
+}
+
+// backupFile keeps the content of a file under backupFileName, replacing any previous backup.
+// It is hard linked when it can be, so the file is never missing, and copied otherwise.
+func backupFile(log *util.Log, fileName string, backupFileName string) (err error) {
+	removeTempFile(log, backupFileName)
+	if os.Link(fileName, backupFileName) == nil {
+		return nil
+	}
+	var in, out *os.File
+	in, err = os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	stats, err := in.Stat()
+	if err != nil {
+		return
+	}
+	out, err = os.OpenFile(backupFileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, stats.Mode().Perm())
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeTempFile(log, backupFileName)
+	}
+	return
+}
+
+// syncFile flushes a finished file to disk
+func syncFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir flushes a rename in dir to disk, not every platform can so errors are only logged
+func syncDir(log *util.Log, dir string) {
+	d, err := os.Open(dir)
+	if err == nil {
+		err = d.Sync()
+		d.Close()
+	}
+	if err != nil {
+		log.Debug("couldn't sync directory %s: %s", dir, err)
+	}
+}
@@ -0,0 +1,100 @@
+package replaceall
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestReplaceInPlace(t *testing.T) {
+	fileName := "testdata/results/in-place.txt"
+	backupFileName := fileName + ".bak"
+	inputString := "Hello billy <kw> SPAM  </kw> this <kw>"
+	expectedString := "Hello billy CRACKS this <kw>"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	os.Remove(backupFileName)
+	for _, threads := range []int{1, 3} {
+		err = ioutil.WriteFile(fileName, []byte(inputString), 0600)
+		if err == nil {
+			err = os.Chmod(fileName, 0640)
+		}
+		if err != nil {
+			t.Fatalf("could not write input file (%s): %s", fileName, err)
+		}
+		_, err = ReplaceInPlace(fileName, Options{
+			Rules:        []Rule{{StartToken: "<kw>", EndToken: "</kw>", Token: "CRACKS"}},
+			Threads:      threads,
+			BackupSuffix: ".bak",
+		})
+		if err != nil {
+			t.Fatalf("%d threads: error during execution: %s", threads, err)
+		}
+		actual, err := quickRead(fileName)
+		if err != nil {
+			t.Fatalf("%d threads: could not read file (%s): %s", threads, fileName, err)
+		} else if actual != expectedString {
+			t.Errorf("%d threads: expected\n'%s'\nbut got\n'%s'", threads, expectedString, actual)
+		}
+		backup, err := quickRead(backupFileName)
+		if err != nil {
+			t.Errorf("%d threads: could not read backup file (%s): %s", threads, backupFileName, err)
+		} else if backup != inputString {
+			t.Errorf("%d threads: expected the backup to be\n'%s'\nbut got\n'%s'", threads, inputString, backup)
+		}
+		stats, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatalf("%d threads: could not stat file (%s): %s", threads, fileName, err)
+		}
+		if runtime.GOOS != "windows" && stats.Mode().Perm() != 0640 {
+			t.Errorf("%d threads: expected mode 0640 but got %o", threads, stats.Mode().Perm())
+		}
+	}
+}
+
+func TestReplaceInPlace_Compressed(t *testing.T) {
+	fileName := "testdata/results/in-place.txt.gz"
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	for _, threads := range []int{1, 3} {
+		var compressed bytes.Buffer
+		err = compress(&compressed, Gzip, []byte("Hello billy <kw> SPAM  </kw> this"))
+		if err == nil {
+			err = ioutil.WriteFile(fileName, compressed.Bytes(), 0600)
+		}
+		if err != nil {
+			t.Fatalf("could not write input file (%s): %s", fileName, err)
+		}
+		_, err = ReplaceInPlace(fileName, Options{
+			Rules:   []Rule{{StartToken: "<kw>", EndToken: "</kw>", Token: "CRACKS"}},
+			Threads: threads,
+		})
+		if err != nil {
+			t.Fatalf("%d threads: error during execution: %s", threads, err)
+		}
+		// The file is still compressed the way it was
+		if c, derr := DetectCompression(fileName); derr != nil || c != Gzip {
+			t.Errorf("%d threads: expected the file to be %s but it is %s (%v)", threads, Gzip, c, derr)
+		}
+		actual, err := decompress(fileName, Gzip)
+		if err != nil {
+			t.Errorf("%d threads: could not decompress file (%s): %s", threads, fileName, err)
+		} else if string(actual) != "Hello billy CRACKS this" {
+			t.Errorf("%d threads: unexpected content: %q", threads, actual)
+		}
+	}
+}
+
+func TestReplaceInPlace_Stdin(t *testing.T) {
+	_, err := ReplaceInPlace("-", Options{Rules: []Rule{{StartToken: "<kw>", EndToken: "</kw>"}}})
+	if err == nil {
+		t.Errorf("expected an error replacing stdin in place")
+	}
+}
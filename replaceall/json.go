@@ -0,0 +1,729 @@
+package replaceall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+// Field replaces or drops a JSON value found by the key it is under, or by a path of keys and array indexes.
+//
+// While fields are replaced the input is read as a stream of JSON values, one after another, instead of being
+// matched token by token: a value is found by its key however the key is escaped, and never inside a string.
+// A value nested in one that is replaced goes with it, when several fields match the same value the first wins.
+// The input has to be valid JSON, a syntax error stops the run, so the output is valid JSON too.
+type Field struct {
+	Name string // An optional name for the field, used in messages
+	// The key of the value, e.g. ssn, or a path of keys ending in it, e.g. patient/ssn for an ssn directly
+	// in the object under patient. A path starting with / starts at the top of each value, like a JSON pointer,
+	// ~1 is a / and ~0 a ~ in a key. An array index is a step like a key, * is any key or index.
+	Path string
+	// Written as is in place of the value, so it has to be a JSON value such as "[redacted]" with its quotes,
+	// or 0. Empty writes null.
+	Token string
+	// The value is removed, together with its key in an object, instead of being replaced
+	Drop bool
+}
+
+// label returns how field f is referred to in messages
+func (fd Field) label(f int) string {
+	if fd.Name != "" {
+		return fmt.Sprintf("field %d (%s)", f, fd.Name)
+	}
+	return fmt.Sprintf("field %d", f)
+}
+
+// steps returns the unescaped keys of the field's path, and whether it starts at the top of a value
+func (fd Field) steps() (keys []string, rooted bool) {
+	rooted = strings.HasPrefix(fd.Path, "/")
+	keys = strings.Split(strings.TrimPrefix(fd.Path, "/"), "/")
+	for i, key := range keys {
+		keys[i] = strings.Replace(strings.Replace(key, "~1", "/", -1), "~0", "~", -1)
+	}
+	return
+}
+
+// token returns what is written in place of the value
+func (fd Field) token() string {
+	if fd.Token == "" {
+		return "null"
+	}
+	return fd.Token
+}
+
+// validateFields checks the fields can be replaced, rules, substitutions and elements cannot be applied with them
+func validateFields(fields []Field, rules []Rule, subs []Substitution, elements []Element) error {
+	if len(rules) > 0 || len(subs) > 0 || len(elements) > 0 {
+		return errors.New("JSON fields cannot be replaced in the same run as rules, needles or XML elements")
+	}
+	paths := make(map[string]int)
+	for f, fd := range fields {
+		if fd.Path == "" || fd.Path == "/" {
+			return fmt.Errorf("%s: a path is required", fd.label(f))
+		}
+		for i := 0; i < len(fd.Path); i++ {
+			if fd.Path[i] == '~' && (i+1 == len(fd.Path) || fd.Path[i+1] != '0' && fd.Path[i+1] != '1') {
+				return fmt.Errorf("%s: '%s' has a ~ that is not ~0 or ~1", fd.label(f), fd.Path)
+			}
+		}
+		if o, ok := paths[fd.Path]; ok {
+			return fmt.Errorf("%s: path '%s' is already used by %s", fd.label(f), fd.Path, fields[o].label(o))
+		}
+		paths[fd.Path] = f
+		if fd.Drop && fd.Token != "" {
+			return fmt.Errorf("%s: a dropped value has no replacement", fd.label(f))
+		}
+		if !json.Valid([]byte(fd.token())) {
+			return fmt.Errorf("%s: replacement '%s' is not a JSON value", fd.label(f), fd.Token)
+		}
+	}
+	return nil
+}
+
+// newFieldPaths returns the matcher of the paths of fields
+func newFieldPaths(fields []Field) *pathMatcher {
+	var steps [][]string
+	var rooted []bool
+	for _, fd := range fields {
+		keys, r := fd.steps()
+		steps = append(steps, keys)
+		rooted = append(rooted, r)
+	}
+	return newPathMatcher(steps, rooted)
+}
+
+// Where in the JSON text the next byte is
+const (
+	jsonBOM       = iota // Part way through a byte order mark at the start of the input
+	jsonValue            // Before a value, after a [, a : or a comma in an array, or at the top
+	jsonKeyStart         // Before a key, after a { or a comma in an object
+	jsonKey              // In a key
+	jsonColon            // After a key
+	jsonString           // In a string value
+	jsonLiteral          // In true, false or null
+	jsonMinus            // After the - of a number
+	jsonZero             // After the leading 0 of a number
+	jsonInt              // In the integer digits of a number
+	jsonDot              // After the . of a number
+	jsonFrac             // In the fraction digits of a number
+	jsonExp              // After the e of a number
+	jsonExpSign          // After the sign of an exponent
+	jsonExpDigits        // In the digits of an exponent
+	jsonAfter            // After a value
+)
+
+// maxJSONDepth is how deeply arrays and objects can be nested, the same limit as package encoding/json
+const maxJSONDepth = 10000
+
+// maxHeldSpace is how much whitespace after a comma is held back with it, any more is dropped
+const maxHeldSpace = 1024
+
+// jsonLevel is an open array or object
+type jsonLevel struct {
+	state   int32 // The state of the array or object
+	array   bool
+	index   int  // The index of the next element of an array
+	written bool // A member or element was written, so the next one needs a comma
+}
+
+// jsonRedactor is the engine of an AllReplacer replacing JSON fields.
+// It follows the syntax of the JSON text a byte at a time, and only holds back a comma, the whitespace after it
+// and the key of the next member until it knows whether the member is dropped, so its memory does not grow with
+// the size of the input or of its values.
+type jsonRedactor struct {
+	fields    []Field
+	tokens    [][]byte // What is written in place of the value of each field
+	paths     *pathMatcher
+	ndjson    bool // Every line is a value of its own
+	out       io.Writer
+	state     int         // Where in the JSON text the next byte is
+	run       int         // How many bytes of a byte order mark or a literal were read
+	literal   string      // The literal being read
+	escape    int         // Where in an escape in a string the next byte is, 1 after the \, 2 to 5 in the hex digits
+	hex       rune        // The hex digits of a \u escape read so far
+	surrogate rune        // The first half of a surrogate pair in a key, zero when none
+	key       []byte      // The key being read, as far as it can still be one of the keys in the paths
+	held      []byte      // A comma, the whitespace after it and the key of a member that may be dropped
+	space     int         // How many bytes of held are the comma and whitespace
+	decided   bool        // The state of the value of the key being read is known, the rest of the key is not held
+	keyAt     int64       // The offset of the key being read
+	empty     bool        // The array or object just opened, so it can close
+	levels    []jsonLevel // The open arrays and objects
+	value     int32       // The state of the value being read, or about to be
+	counted   bool        // The value about to be read was counted as dropped at its key
+	open      int         // The values being replaced, nested in one another
+	field     int         // The field being replaced, while open is not zero
+	openedAt  int64       // The offset the value being replaced, or the member being dropped, starts at
+	pos       int64       // The bytes consumed so far
+	base      int64       // The offset of the first byte consumed, so matches are reported with input offsets
+	written   int64
+	counts    tally
+	onMatch   func(m Match)
+	log       *util.Log
+}
+
+// newJSONRedactor creates a redactor for the fields of s writing to out, from the start of a value or a line
+func newJSONRedactor(s AllReplacer, out io.Writer, id ...int) *jsonRedactor {
+	j := &jsonRedactor{
+		fields:  s.Fields,
+		paths:   newFieldPaths(s.Fields),
+		ndjson:  s.NDJSON,
+		out:     out,
+		state:   jsonValue,
+		key:     make([]byte, 0, 64),
+		held:    make([]byte, 0, 64),
+		base:    s.StartAt,
+		onMatch: s.OnMatch,
+		log:     s.logger(id...),
+	}
+	for _, fd := range s.Fields {
+		j.tokens = append(j.tokens, []byte(fd.token()))
+	}
+	if j.base == 0 {
+		j.state = jsonBOM
+	}
+	return j
+}
+
+// scan consumes p, every byte that is not held back is written or, inside a value being replaced, dropped
+func (j *jsonRedactor) scan(p []byte) (err error) {
+	start := 0 // The first byte of p not written, held or dropped yet
+	for i := 0; i < len(p) && err == nil; {
+		c := p[i]
+		switch j.state {
+		case jsonBOM:
+			if c != utf8BOM[j.run] {
+				if j.run > 0 {
+					return j.unexpected(c, i)
+				}
+				j.state = jsonValue
+				continue
+			}
+			if j.run++; j.run == len(utf8BOM) {
+				j.state = jsonValue
+			}
+		case jsonValue:
+			if isSpace(c) {
+				if err = j.whitespace(c, i); err == nil && len(j.held) > 0 {
+					err = j.pass(p[start:i])
+					j.hold(c)
+					start = i + 1
+				}
+				break
+			}
+			if c == ']' && j.empty {
+				j.state = jsonAfter
+				continue
+			}
+			j.enter()
+			if len(j.held) > 0 || j.paths.states[j.value].match >= 0 {
+				// What was held or what is replaced goes after the bytes before the value
+				err = j.pass(p[start:i])
+				start = i
+			}
+			if err == nil {
+				err = j.startValue(j.base + j.pos + int64(i))
+			}
+			if err != nil {
+				break
+			}
+			switch {
+			case c == '"':
+				j.state, j.escape = jsonString, 0
+			case c == '{' || c == '[':
+				if len(j.levels) == maxJSONDepth {
+					return fmt.Errorf("JSON nested deeper than %d at offset %d", maxJSONDepth, j.base+j.pos+int64(i))
+				}
+				j.levels = append(j.levels, jsonLevel{state: j.value, array: c == '['})
+				j.state, j.empty = jsonKeyStart, true
+				if c == '[' {
+					j.state = jsonValue
+				}
+			case c == '-':
+				j.state = jsonMinus
+			case c == '0':
+				j.state = jsonZero
+			case c >= '1' && c <= '9':
+				j.state = jsonInt
+			case c == 't':
+				j.state, j.literal, j.run = jsonLiteral, "true", 1
+			case c == 'f':
+				j.state, j.literal, j.run = jsonLiteral, "false", 1
+			case c == 'n':
+				j.state, j.literal, j.run = jsonLiteral, "null", 1
+			default:
+				return j.unexpected(c, i)
+			}
+		case jsonKeyStart:
+			switch {
+			case isSpace(c):
+				if err = j.whitespace(c, i); err == nil && len(j.held) > 0 {
+					err = j.pass(p[start:i])
+					j.hold(c)
+					start = i + 1
+				}
+			case c == '}' && j.empty:
+				j.state = jsonAfter
+				continue
+			case c == '"':
+				err = j.pass(p[start:i])
+				j.space = len(j.held)
+				j.held = append(j.held, c)
+				j.key = j.key[:0]
+				j.keyAt = j.base + j.pos + int64(i)
+				j.state, j.escape, j.surrogate, j.decided = jsonKey, 0, 0, false
+				start = i + 1
+			default:
+				return j.unexpected(c, i)
+			}
+		case jsonKey:
+			if j.escape == 0 && !j.decided {
+				// Hold the plain bytes up to the next that needs a look, or until the key is too long
+				n := i
+				for n < len(p) && p[n] != '"' && p[n] != '\\' && p[n] >= 0x20 && len(j.key)+n-i <= j.paths.longest {
+					n++
+				}
+				if n > i {
+					j.unpair()
+					j.held = append(j.held, p[i:n]...)
+					j.key = append(j.key, p[i:n]...)
+					i, start = n, n
+					continue
+				}
+			} else if n := skipString(p, i); j.escape == 0 && n > i {
+				i = n
+				continue
+			}
+			end, serr := j.stringByte(c, i)
+			if serr != nil {
+				return serr
+			}
+			if j.decided {
+				if end {
+					j.state = jsonColon
+				}
+				break
+			}
+			j.held = append(j.held, c)
+			start = i + 1
+			if end {
+				j.state = jsonColon
+				j.unpair()
+				err = j.decide(j.paths.name(j.key))
+			} else if len(j.key) > j.paths.longest {
+				// Too long to be any of the keys in the paths
+				err = j.decide(-1)
+			}
+		case jsonColon:
+			switch {
+			case isSpace(c):
+				err = j.whitespace(c, i)
+			case c == ':':
+				j.state, j.empty = jsonValue, false
+			default:
+				return j.unexpected(c, i)
+			}
+		case jsonString:
+			if n := skipString(p, i); j.escape == 0 && n > i {
+				i = n
+				continue
+			}
+			end, serr := j.stringByte(c, i)
+			if serr != nil {
+				return serr
+			}
+			if end {
+				i++
+				if j.endValue(j.value, j.base+j.pos+int64(i)) {
+					start = i
+				}
+				j.state = jsonAfter
+				continue
+			}
+		case jsonLiteral:
+			if c != j.literal[j.run] {
+				return j.unexpected(c, i)
+			}
+			if j.run++; j.run == len(j.literal) {
+				i++
+				if j.endValue(j.value, j.base+j.pos+int64(i)) {
+					start = i
+				}
+				j.state = jsonAfter
+				continue
+			}
+		case jsonMinus, jsonZero, jsonInt, jsonDot, jsonFrac, jsonExp, jsonExpSign, jsonExpDigits:
+			next := numberState(j.state, c)
+			if next >= 0 {
+				j.state = next
+				break
+			}
+			if !numberEnds(j.state) {
+				return j.unexpected(c, i)
+			}
+			if j.endValue(j.value, j.base+j.pos+int64(i)) {
+				start = i
+			}
+			j.state = jsonAfter
+			continue
+		case jsonAfter:
+			n := len(j.levels)
+			switch {
+			case isSpace(c):
+				err = j.whitespace(c, i)
+			case n == 0:
+				// The next value at the top
+				j.state, j.empty = jsonValue, false
+				continue
+			case c == ',':
+				err = j.pass(p[start:i])
+				j.held = append(j.held[:0], c)
+				start = i + 1
+				j.state, j.empty = jsonKeyStart, false
+				if j.levels[n-1].array {
+					j.state = jsonValue
+				}
+			case c == '}' && !j.levels[n-1].array || c == ']' && j.levels[n-1].array:
+				i++
+				l := j.levels[n-1]
+				j.levels = j.levels[:n-1]
+				if j.endValue(l.state, j.base+j.pos+int64(i)) {
+					start = i
+				}
+				continue
+			default:
+				return j.unexpected(c, i)
+			}
+		}
+		i++
+	}
+	if err == nil {
+		err = j.pass(p[start:])
+	}
+	j.pos += int64(len(p))
+	return
+}
+
+// skipString returns the index of the first byte of p from i on in a string that needs a look,
+// the closing quote, an escape or a control character
+func skipString(p []byte, i int) int {
+	for i < len(p) && p[i] != '"' && p[i] != '\\' && p[i] >= 0x20 {
+		i++
+	}
+	return i
+}
+
+// isSpace reports whether c is whitespace between JSON tokens
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// whitespace checks the whitespace c at p[i] can be where it is, a newline only ends a value of NDJSON input
+func (j *jsonRedactor) whitespace(c byte, i int) error {
+	if c == '\n' && j.ndjson && len(j.levels) > 0 {
+		return fmt.Errorf("a line of NDJSON input ends part way through a value, at offset %d", j.base+j.pos+int64(i))
+	}
+	return nil
+}
+
+// hold adds whitespace after a comma to what is held back with it
+func (j *jsonRedactor) hold(c byte) {
+	if len(j.held) < maxHeldSpace {
+		j.held = append(j.held, c)
+	}
+}
+
+// unexpected returns the syntax error of c at p[i]
+func (j *jsonRedactor) unexpected(c byte, i int) error {
+	return fmt.Errorf("invalid JSON: unexpected %q at offset %d", c, j.base+j.pos+int64(i))
+}
+
+// stringByte follows c at p[i] in a string, reporting whether it is the closing quote.
+// The bytes of a key are decoded into key as long as it can still be one of the keys in the paths.
+func (j *jsonRedactor) stringByte(c byte, i int) (end bool, err error) {
+	decode := j.state == jsonKey && !j.decided
+	switch {
+	case j.escape == 1:
+		j.escape = 0
+		var b byte
+		switch c {
+		case '"', '\\', '/':
+			b = c
+		case 'b':
+			b = '\b'
+		case 'f':
+			b = '\f'
+		case 'n':
+			b = '\n'
+		case 'r':
+			b = '\r'
+		case 't':
+			b = '\t'
+		case 'u':
+			j.escape, j.hex = 2, 0
+			return
+		default:
+			return false, j.unexpected(c, i)
+		}
+		if decode {
+			j.unpair()
+			j.key = append(j.key, b)
+		}
+	case j.escape > 1:
+		var d rune
+		switch {
+		case c >= '0' && c <= '9':
+			d = rune(c - '0')
+		case c >= 'a' && c <= 'f':
+			d = rune(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			d = rune(c-'A') + 10
+		default:
+			return false, j.unexpected(c, i)
+		}
+		j.hex = j.hex<<4 | d
+		if j.escape++; j.escape < 6 {
+			return
+		}
+		j.escape = 0
+		if decode {
+			j.decodeRune(j.hex)
+		}
+	case c == '\\':
+		j.escape = 1
+	case c == '"':
+		return true, nil
+	case c < 0x20:
+		return false, j.unexpected(c, i)
+	default:
+		if decode {
+			j.unpair()
+			j.key = append(j.key, c)
+		}
+	}
+	return
+}
+
+// decodeRune adds the character of a \u escape to the key, joining the halves of a surrogate pair
+func (j *jsonRedactor) decodeRune(r rune) {
+	if j.surrogate != 0 && r >= 0xdc00 && r <= 0xdfff {
+		r = 0x10000 + (j.surrogate-0xd800)<<10 + r - 0xdc00
+		j.surrogate = 0
+	} else {
+		j.unpair()
+		if r >= 0xd800 && r <= 0xdbff {
+			j.surrogate = r
+			return
+		}
+	}
+	var b [utf8.UTFMax]byte
+	j.key = append(j.key, b[:utf8.EncodeRune(b[:], r)]...)
+}
+
+// unpair adds a first half of a surrogate pair that is not followed by the second to the key,
+// as the replacement character like package encoding/json
+func (j *jsonRedactor) unpair() {
+	if j.surrogate != 0 {
+		j.surrogate = 0
+		j.key = append(j.key, string(utf8.RuneError)...)
+	}
+}
+
+// numberState returns the state after c in a number, or -1 when c is not part of it
+func numberState(state int, c byte) int {
+	digit := c >= '0' && c <= '9'
+	switch state {
+	case jsonMinus:
+		if c == '0' {
+			return jsonZero
+		}
+		if digit {
+			return jsonInt
+		}
+	case jsonZero, jsonInt, jsonFrac:
+		if digit && state != jsonZero {
+			return state
+		}
+		if c == '.' && state != jsonFrac {
+			return jsonDot
+		}
+		if c == 'e' || c == 'E' {
+			return jsonExp
+		}
+	case jsonDot:
+		if digit {
+			return jsonFrac
+		}
+	case jsonExp:
+		if c == '+' || c == '-' {
+			return jsonExpSign
+		}
+		if digit {
+			return jsonExpDigits
+		}
+	case jsonExpSign, jsonExpDigits:
+		if digit {
+			return jsonExpDigits
+		}
+	}
+	return -1
+}
+
+// numberEnds reports whether a number can end in state
+func numberEnds(state int) bool {
+	return state == jsonZero || state == jsonInt || state == jsonFrac || state == jsonExpDigits
+}
+
+// decide works out the state of the value of the key being read once the key is known, the held comma and key
+// are then written, or dropped with the rest of the member when its field drops it
+func (j *jsonRedactor) decide(key int32) error {
+	j.decided = true
+	j.value = j.paths.after(j.levels[len(j.levels)-1].state, key)
+	if f := j.paths.states[j.value].match; f >= 0 && j.fields[f].Drop {
+		j.counted = true
+		j.open++
+		j.counts.nested(j.open)
+		if j.open == 1 {
+			j.field, j.openedAt = f, j.keyAt
+			j.held = j.held[:0]
+			return nil
+		}
+	}
+	return j.release()
+}
+
+// enter works out the state of the value about to be read, the state of a member's value is known from its key
+func (j *jsonRedactor) enter() {
+	n := len(j.levels)
+	if n == 0 {
+		j.value = 0
+	} else if l := &j.levels[n-1]; l.array {
+		j.value = j.paths.after(l.state, j.paths.index(l.index))
+		l.index++
+		j.space = len(j.held)
+	}
+}
+
+// startValue works out whether the value starting at offset at is replaced, before its first byte is passed
+func (j *jsonRedactor) startValue(at int64) (err error) {
+	if j.counted {
+		// Dropped with its key
+		j.counted = false
+		return nil
+	}
+	f := j.paths.states[j.value].match
+	if f < 0 {
+		return j.release()
+	}
+	if j.open == 0 && j.fields[f].Drop {
+		j.held = j.held[:0]
+	} else if err = j.release(); err != nil {
+		return
+	}
+	j.open++
+	j.counts.nested(j.open)
+	if j.open == 1 {
+		j.field, j.openedAt = f, at
+		if !j.fields[f].Drop {
+			err = j.write(j.tokens[f])
+		}
+	}
+	return
+}
+
+// release writes what is held back for a member or element that is kept, without the comma before it
+// when every one before it in its array or object was dropped
+func (j *jsonRedactor) release() error {
+	if n := len(j.levels); n > 0 && j.open == 0 {
+		l := &j.levels[n-1]
+		if !l.written {
+			j.held = j.held[:copy(j.held, j.held[j.space:])]
+		}
+		l.written = true
+	}
+	j.space = 0
+	err := j.pass(j.held)
+	j.held = j.held[:0]
+	return err
+}
+
+// endValue follows the end of a value in state, end is the offset after its last byte.
+// It reports whether the value was being replaced, the bytes of it not passed yet are then dropped.
+func (j *jsonRedactor) endValue(state int32, end int64) bool {
+	if j.paths.states[state].match < 0 || j.open == 0 {
+		return false
+	}
+	j.open--
+	if j.open == 0 {
+		length := end - j.openedAt
+		j.counts.replacements++
+		j.counts.removed += length
+		if j.onMatch != nil {
+			fd := j.fields[j.field]
+			name := fd.Name
+			if name == "" {
+				name = fd.Path
+			}
+			j.onMatch(Match{Kind: MatchField, Index: j.field, Name: name, Offset: j.openedAt, Length: length})
+		}
+	}
+	return true
+}
+
+// pass writes p, or drops it inside a value being replaced
+func (j *jsonRedactor) pass(p []byte) error {
+	if j.open > 0 {
+		return nil
+	}
+	return j.write(p)
+}
+
+func (j *jsonRedactor) write(p []byte) (err error) {
+	if len(p) > 0 {
+		var n int
+		n, err = j.out.Write(p)
+		j.written += int64(n)
+		if err != nil {
+			j.log.Error("couldn't write bytes: %s", err)
+		}
+	}
+	return
+}
+
+// flush ends a number the input ended in, input that ends part way through a value is an error
+// since it is not valid JSON
+func (j *jsonRedactor) flush() error {
+	end := j.base + j.pos
+	if numberEnds(j.state) {
+		j.endValue(j.value, end)
+		j.state = jsonAfter
+	}
+	if j.open > 0 {
+		return fmt.Errorf("the input ended inside the value of %s at offset %d", j.fields[j.field].label(j.field), j.openedAt)
+	}
+	between := j.state == jsonAfter || j.state == jsonValue || j.state == jsonBOM && j.run == 0
+	if len(j.levels) > 0 || !between {
+		return fmt.Errorf("invalid JSON: the input ended part way through a value, at offset %d", end)
+	}
+	return nil
+}
+
+func (j *jsonRedactor) tally() tally {
+	t := j.counts
+	t.read = j.pos
+	t.written = j.written
+	return t
+}
+
+// halted is always false, the input is read to the end
+func (j *jsonRedactor) halted() bool {
+	return false
+}
+
+// discard does nothing, nothing is spooled
+func (j *jsonRedactor) discard() {}
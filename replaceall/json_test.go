@@ -0,0 +1,216 @@
+package replaceall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var jsonCases = []struct {
+	fields   []Field
+	input    string
+	expected string
+}{
+	{[]Field{{Path: "ssn", Token: `"***"`}}, `{"name":"a","ssn":"123-45","x":{"ssn":7}}`, `{"name":"a","ssn":"***","x":{"ssn":"***"}}`},
+	// Keys are matched however they are escaped, never inside strings
+	{[]Field{{Path: "ssn"}}, `{"ssn":1,"note":"\"ssn\": 2","\"ssn":3}`, `{"ssn":null,"note":"\"ssn\": 2","\"ssn":3}`},
+	{[]Field{{Path: "café"}, {Path: "\U0001f600"}}, `{"café":1,"😀":2,"\ud83d":3}`, `{"café":null,"😀":null,"\ud83d":3}`},
+	// Any value, nested ones go with it
+	{[]Field{{Path: "phi", Token: "0"}}, `{"phi":{"a":[1,{"phi":2}]},"b":[true,false,null,-1.5e+3]}`, `{"phi":0,"b":[true,false,null,-1.5e+3]}`},
+	{[]Field{{Path: "patient/ssn", Token: "0"}}, `{"patient":{"ssn":1,"x":{"ssn":2}},"ssn":3}`, `{"patient":{"ssn":0,"x":{"ssn":2}},"ssn":3}`},
+	{[]Field{{Path: "/a/b", Token: "0"}}, `{"a":{"b":1,"c":{"a":{"b":2}}}}`, `{"a":{"b":0,"c":{"a":{"b":2}}}}`},
+	{[]Field{{Path: "/ids/1", Token: "0"}, {Path: "/list/*/id", Token: "0"}}, `{"ids":[1,2,3],"list":[{"id":1},{"id":2}]}`, `{"ids":[1,0,3],"list":[{"id":0},{"id":0}]}`},
+	{[]Field{{Path: "/a~1b/c~0d", Token: "0"}}, `{"a/b":{"c~d":1,"c/d":2}}`, `{"a/b":{"c~d":0,"c/d":2}}`},
+	// The first field matching wins
+	{[]Field{{Path: "a/phi", Token: "1"}, {Path: "phi", Token: "2"}}, `{"a":{"phi":0},"phi":0}`, `{"a":{"phi":1},"phi":2}`},
+	// Dropped members and elements take a comma with them
+	{[]Field{{Path: "ssn", Drop: true}}, `{"ssn":1,"a":2,"ssn":3,"b":4,"ssn":5}`, `{"a":2,"b":4}`},
+	{[]Field{{Path: "ssn", Drop: true}}, `{"ssn":1}`, `{}`},
+	{[]Field{{Path: "ssn", Drop: true}}, `{"ssn":1,"ssn":{"a":[]}}`, `{}`},
+	{[]Field{{Path: "/a/*", Drop: true}}, `{"a":[1,2,3],"b":[4]}`, `{"a":[],"b":[4]}`},
+	{[]Field{{Path: "/a/0", Drop: true}, {Path: "/a/2", Drop: true}}, `{"a":[1, 2, 3]}`, `{"a":[2]}`},
+	{[]Field{{Path: "ssn", Drop: true}}, "{\n  \"ssn\": 1,\n  \"a\": 2,\n  \"ssn\": 3\n}\n", "{\n  \"a\": 2\n}\n"},
+	// Concatenated values, each starting at the top
+	{[]Field{{Path: "/ssn"}}, "\xef\xbb\xbf{\"ssn\":1} {\"ssn\":2}\n[{\"ssn\":3}] \"ssn\" 4", "\xef\xbb\xbf{\"ssn\":null} {\"ssn\":null}\n[{\"ssn\":3}] \"ssn\" 4"},
+}
+
+func TestReplace_JSON(t *testing.T) {
+	for c, jc := range jsonCases {
+		if !validValues(jc.expected) {
+			t.Errorf("case %d: the expected output is not valid JSON", c)
+		}
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = strings.NewReader(jc.input)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			actual, err := ioutil.ReadAll(NewReaderWith(r, Options{Fields: jc.fields}))
+			if err != nil {
+				t.Errorf("case %d: unexpected error: %s", c, err)
+			} else if string(actual) != jc.expected {
+				t.Errorf("case %d: %q != %q", c, actual, jc.expected)
+			}
+		}
+	}
+}
+
+// validValues reports whether s is a run of valid JSON values, after any byte order mark
+func validValues(s string) bool {
+	d := json.NewDecoder(strings.NewReader(strings.TrimPrefix(s, "\ufeff")))
+	for {
+		var v interface{}
+		err := d.Decode(&v)
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+func TestReplace_JSONBounded(t *testing.T) {
+	// Neither a long key nor a long value grows what is held
+	fields := []Field{{Path: "ssn", Drop: true}}
+	var out bytes.Buffer
+	j := newJSONRedactor(AllReplacer{Fields: fields}, &out)
+	input := `{"` + strings.Repeat("k", 10000) + `":"` + strings.Repeat("v", 10000) + `", "ssn":[` +
+		strings.Repeat("1,", 10000) + `1], "a":1}`
+	var held int
+	for i := 0; i < len(input); i++ {
+		if err := j.scan([]byte{input[i]}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(j.held) > held {
+			held = len(j.held)
+		}
+	}
+	if err := j.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if held > len(`, "ssn"`)+1 {
+		t.Errorf("held %d bytes of a key", held)
+	}
+	if !strings.HasSuffix(out.String(), `", "a":1}`) || j.counts.replacements != 1 {
+		t.Errorf("unexpected output ending %q after %d replacements", out.String()[out.Len()-20:], j.counts.replacements)
+	}
+}
+
+func TestReplaceAllWith_NDJSON(t *testing.T) {
+	fields := []Field{
+		{Name: "ssn", Path: "ssn", Token: `"***"`},
+		{Path: "/contact/phone", Drop: true},
+	}
+	record := `{"id":%d,"ssn":"12%d","contact":{"phone":"555","email":"a@b"},"note":"\"ssn\": x"}` + "\n"
+	expected := `{"id":%d,"ssn":"***","contact":{"email":"a@b"},"note":"\"ssn\": x"}` + "\n"
+	var input, output strings.Builder
+	for i := 0; i < 500; i++ {
+		input.WriteString(fmt.Sprintf(record, i, i))
+		output.WriteString(fmt.Sprintf(expected, i))
+	}
+	inputFileName := "testdata/results/ndjson-input.json"
+	err := ioutil.WriteFile(inputFileName, []byte(input.String()), 0644)
+	if err != nil {
+		t.Fatalf("could not write input: %s", err)
+	}
+	for _, threads := range []int{1, 4, 9} {
+		outputFileName := fmt.Sprintf("testdata/results/ndjson-output-%d.json", threads)
+		var result Result
+		result, err = ReplaceAllWith(inputFileName, outputFileName, Options{Fields: fields, NDJSON: true, Threads: threads})
+		if err != nil {
+			t.Fatalf("%d threads: error during execution: %s", threads, err)
+		}
+		actual, rerr := quickRead(outputFileName)
+		if rerr != nil {
+			t.Fatalf("%d threads: could not read output: %s", threads, rerr)
+		}
+		if actual != output.String() {
+			t.Errorf("%d threads: unexpected output: %q", threads, actual[:100])
+		}
+		if result.Replacements != 1000 || result.Threads != threads || !result.Confident {
+			t.Errorf("%d threads: unexpected result: %+v", threads, result)
+		}
+	}
+
+	// A file in UTF-16 is split at its line ends too
+	err = ioutil.WriteFile("testdata/results/ndjson-input-utf16.json", encode(t, "\ufeff"+input.String(), UTF16BE), 0644)
+	if err != nil {
+		t.Fatalf("could not write input: %s", err)
+	}
+	_, err = ReplaceAllWith("testdata/results/ndjson-input-utf16.json", "testdata/results/ndjson-output-utf16.json",
+		Options{Fields: fields, NDJSON: true, Threads: 7, InputEncoding: UTF16, OutputEncoding: UTF8})
+	if err != nil {
+		t.Fatalf("UTF-16: error during execution: %s", err)
+	}
+	actual, err := quickRead("testdata/results/ndjson-output-utf16.json")
+	if err != nil {
+		t.Fatalf("UTF-16: could not read output: %s", err)
+	}
+	if actual != "\ufeff"+output.String() {
+		t.Errorf("UTF-16: unexpected output: %q", actual[:100])
+	}
+
+	report, err := DryRun(inputFileName, Options{Fields: fields, NDJSON: true}, nil)
+	if err != nil {
+		t.Fatalf("unexpected dry run error: %s", err)
+	}
+	if report.Regions != 1000 || report.PerRule[0] != 500 || report.PerRule[1] != 500 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestReplace_JSONInvalid(t *testing.T) {
+	fields := []Field{{Path: "ssn"}}
+	for _, input := range []string{
+		`{"a":1,}`,
+		`[1,]`,
+		`{"a" 1}`,
+		`{"a":01}`,
+		`{"a":1.}`,
+		`{"a":tru}`,
+		`{"a":"\x"}`,
+		"{\"a\":\"\n\"}",
+		`{"ssn":[1,2}`,
+		`{"ssn":"1`,
+		`{"a":1`,
+		`]`,
+	} {
+		_, err := ioutil.ReadAll(NewReaderWith(strings.NewReader(input), Options{Fields: fields}))
+		if err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+	// A newline only ends a value of NDJSON input at the top
+	_, err := ioutil.ReadAll(NewReaderWith(strings.NewReader("{\"a\":\n1}\n"), Options{Fields: fields, NDJSON: true}))
+	if err == nil {
+		t.Errorf("expected an error for a value across lines")
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	for _, fields := range [][]Field{
+		{{Path: ""}},
+		{{Path: "/"}},
+		{{Path: "a~2"}},
+		{{Path: "a~"}},
+		{{Path: "ssn"}, {Path: "ssn"}},
+		{{Path: "ssn", Token: "***"}},
+		{{Path: "ssn", Token: `"a" "b"`}},
+		{{Path: "ssn", Token: "0", Drop: true}},
+	} {
+		if err := validate(nil, nil, nil, fields); err == nil {
+			t.Errorf("%+v should not be valid", fields)
+		}
+	}
+	if err := validate(nil, []Substitution{{Needle: "a"}}, nil, []Field{{Path: "ssn"}}); err == nil {
+		t.Errorf("fields should not be replaced with needles")
+	}
+	if err := validate(nil, nil, nil, []Field{{Path: "/a/*/0", Token: `{"a":[1]}`}, {Path: "b", Drop: true}}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
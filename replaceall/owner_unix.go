@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package replaceall
+
+import (
+	"os"
+	"syscall"
+)
+
+// chownLike gives a file the owner and group in stats, when they differ from its own
+func chownLike(fileName string, stats os.FileInfo) error {
+	want, ok := stats.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	current, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if have, ok := current.Sys().(*syscall.Stat_t); ok && have.Uid == want.Uid && have.Gid == want.Gid {
+		return nil
+	}
+	return os.Chown(fileName, int(want.Uid), int(want.Gid))
+}
@@ -0,0 +1,8 @@
+package replaceall
+
+import "os"
+
+// chownLike does nothing, files on windows have no owner and group to copy
+func chownLike(fileName string, stats os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,151 @@
+package replaceall
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// anyName is the step of a path matching any name
+const anyName = -2
+
+// pathMatcher tells which of a set of paths, if any, the names of the open elements of a document lead to,
+// for XML the names of the elements and for JSON the keys and indexes of the values.
+// A state is how far the names so far match every path, they are made as they are first needed,
+// and the state outside the document's root is 0.
+type pathMatcher struct {
+	steps   [][]int32        // The names of each path
+	rooted  []bool           // Whether each path starts at the root
+	names   map[string]int32 // The names in the paths, any other name is -1
+	longest int              // The length of the longest name in the paths
+	lengths []bool           // Whether a name in the paths is as long as each length up to longest
+	indexes []int32          // The name of each array index up to the largest in the paths
+	states  []pathState      // The states made so far
+	ids     map[string]int32 // The state of each set of partial matches
+	next    [][]int32        // The state inside each name plus one from each state, -1 until it is needed
+}
+
+// pathState is the paths matching the names of the open elements so far
+type pathState struct {
+	partial []pathStep // The paths that continue inside the element
+	match   int        // The path that ends here, -1 for none
+}
+
+// pathStep is how many names of a path are matched
+type pathStep struct {
+	path    int
+	matched int
+}
+
+// newPathMatcher returns the matcher of paths of steps, a step of * matches any name
+func newPathMatcher(steps [][]string, rooted []bool) *pathMatcher {
+	p := &pathMatcher{
+		rooted: rooted,
+		names:  make(map[string]int32),
+		ids:    make(map[string]int32),
+	}
+	root := pathState{match: -1}
+	for path, names := range steps {
+		ids := make([]int32, len(names))
+		for i, name := range names {
+			if name == "*" {
+				ids[i] = anyName
+				continue
+			}
+			n, ok := p.names[name]
+			if !ok {
+				n = int32(len(p.names))
+				p.names[name] = n
+			}
+			ids[i] = n
+			if len(name) > p.longest {
+				p.longest = len(name)
+			}
+		}
+		p.steps = append(p.steps, ids)
+		if rooted[path] {
+			root.partial = append(root.partial, pathStep{path: path})
+		}
+	}
+	p.lengths = make([]bool, p.longest+1)
+	for name, n := range p.names {
+		p.lengths[len(name)] = true
+		if i, err := strconv.Atoi(name); err == nil && i >= 0 && strconv.Itoa(i) == name {
+			for len(p.indexes) <= i {
+				p.indexes = append(p.indexes, -1)
+			}
+			p.indexes[i] = n
+		}
+	}
+	p.intern(root)
+	return p
+}
+
+// name returns the name the paths know name as, -1 for a name they do not have
+func (p *pathMatcher) name(name []byte) int32 {
+	if len(name) > p.longest || !p.lengths[len(name)] {
+		return -1
+	}
+	if n, ok := p.names[string(name)]; ok {
+		return n
+	}
+	return -1
+}
+
+// index returns the name the paths know the array index i as, -1 for an index they do not have
+func (p *pathMatcher) index(i int) int32 {
+	if i < len(p.indexes) {
+		return p.indexes[i]
+	}
+	return -1
+}
+
+// after returns the state inside name, in an element or document in state
+func (p *pathMatcher) after(state int32, name int32) int32 {
+	if p.next[state][name+1] >= 0 {
+		return p.next[state][name+1]
+	}
+	steps := append([]pathStep(nil), p.states[state].partial...)
+	for path := range p.steps {
+		// A path not starting at the root can start anywhere
+		if !p.rooted[path] {
+			steps = append(steps, pathStep{path: path})
+		}
+	}
+	next := pathState{match: -1}
+	for _, s := range steps {
+		step := p.steps[s.path][s.matched]
+		if step != anyName && step != name {
+			continue
+		}
+		if s.matched+1 < len(p.steps[s.path]) {
+			next.partial = append(next.partial, pathStep{path: s.path, matched: s.matched + 1})
+		} else if next.match < 0 || s.path < next.match {
+			next.match = s.path
+		}
+	}
+	id := p.intern(next)
+	p.next[state][name+1] = id
+	return id
+}
+
+// intern returns the id of state, adding it when it is new
+func (p *pathMatcher) intern(state pathState) int32 {
+	sort.Slice(state.partial, func(i, j int) bool {
+		a, b := state.partial[i], state.partial[j]
+		return a.path < b.path || a.path == b.path && a.matched < b.matched
+	})
+	key := fmt.Sprint(state.match, state.partial)
+	if id, ok := p.ids[key]; ok {
+		return id
+	}
+	id := int32(len(p.states))
+	p.states = append(p.states, state)
+	p.ids[key] = id
+	next := make([]int32, len(p.names)+1)
+	for i := range next {
+		next[i] = -1
+	}
+	p.next = append(p.next, next)
+	return id
+}
@@ -0,0 +1,436 @@
+package replaceall
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// CaseFold is how the tokens of a rule match letters of another case
+type CaseFold string
+
+const (
+	FoldNone    CaseFold = ""        // Letters only match themselves
+	FoldASCII   CaseFold = "ascii"   // A to Z also match a to z and the other way round
+	FoldUnicode CaseFold = "unicode" // Letters match every letter of their Unicode simple case folding, so k also matches K and the Kelvin sign
+)
+
+// ParseCaseFold parses the name of a case folding, as given on the command line or in a rules file
+func ParseCaseFold(name string) (f CaseFold, err error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		f = FoldNone
+	case "ascii":
+		f = FoldASCII
+	case "unicode":
+		f = FoldUnicode
+	default:
+		err = fmt.Errorf("unknown case folding '%s', expected none, ascii or unicode", name)
+	}
+	return
+}
+
+// Normalization is the Unicode normalization form the tokens of a rule are matched under
+type Normalization string
+
+const (
+	NormalizeNone Normalization = ""     // Tokens only match the exact code points they are made of
+	NFC           Normalization = "nfc"  // Canonically equivalent text matches, e.g. é as one code point or as e and a combining acute accent
+	NFKC          Normalization = "nfkc" // Compatible text matches too, e.g. full width ＜ｐｈｉ＞ or the ligature ﬁ
+)
+
+// ParseNormalization parses the name of a normalization form, as given on the command line or in a rules file
+func ParseNormalization(name string) (n Normalization, err error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		n = NormalizeNone
+	case "nfc":
+		n = NFC
+	case "nfkc":
+		n = NFKC
+	default:
+		err = fmt.Errorf("unknown normalization '%s', expected none, nfc or nfkc", name)
+	}
+	return
+}
+
+// decomposer returns the form that decomposes text for n, a composed form matches whatever has the same decomposition
+func (n Normalization) decomposer() norm.Form {
+	if n == NFKC {
+		return norm.NFKD
+	}
+	return norm.NFD
+}
+
+// pattern is a token as an automaton matches it, a graph whose paths from the first node to the last
+// spell out every byte string matching the token, a byte per edge
+type pattern struct {
+	edges   [][]edge // The edges leaving each node, the first node is 0
+	last    int32    // The node a match ends on
+	longest []int    // The most bytes on a path to each node, unbounded past a loop
+	fixed   int      // The length of every match, -1 when matches can differ in length
+	limit   int      // The most bytes a match is made of, longer matches of a pattern with loops are not reported
+	back    [][]edge // The edges reaching each node, to find where a match started
+}
+
+// unbounded is the length of the paths through a loop
+const unbounded = math.MaxInt32
+
+type edge struct {
+	c  byte
+	to int32
+}
+
+// literalPattern returns the pattern matching exactly the bytes of token
+func literalPattern(token string) *pattern {
+	p := &pattern{}
+	prev := p.node()
+	for i := 0; i < len(token); i++ {
+		next := p.node()
+		p.edges[prev] = append(p.edges[prev], edge{c: token[i], to: next})
+		prev = next
+	}
+	p.last = prev
+	p.finish()
+	return p
+}
+
+// compilePattern returns the pattern matching token with the given case folding and normalization
+func compilePattern(token string, fold CaseFold, form Normalization) *pattern {
+	if form == NormalizeNone || !utf8.ValidString(token) {
+		if fold == FoldNone {
+			return literalPattern(token)
+		}
+		// A node between every two characters, joined by each case of the character
+		p := &pattern{}
+		prev := p.node()
+		for i := 0; i < len(token); {
+			r, size := utf8.DecodeRuneInString(token[i:])
+			next := p.node()
+			if r == utf8.RuneError && size == 1 {
+				p.path(prev, next, []byte{token[i]})
+			} else {
+				for _, v := range caseVariants(r, fold) {
+					p.path(prev, next, []byte(string(v)))
+				}
+			}
+			prev = next
+			i += size
+		}
+		p.last = prev
+		p.finish()
+		return p
+	}
+
+	// A node between every two code points of the decomposed token, joined by each character whose own decomposition
+	// is the code points in between. The combining marks of a character can come in any order that is canonically
+	// equivalent, each order gets nodes of its own.
+	p := &pattern{}
+	first := p.node()
+	p.last = p.node()
+	for _, order := range canonicalOrders([]rune(form.decomposer().String(token))) {
+		nodes := make([]int32, len(order)+1)
+		nodes[0] = first
+		for i := 1; i < len(order); i++ {
+			nodes[i] = p.node()
+		}
+		nodes[len(order)] = p.last
+		for i := range order {
+			for j := i + 1; j <= len(order) && j-i <= maxDecomposition; j++ {
+				for _, r := range composers(form, fold, order[i:j]) {
+					p.path(nodes[i], nodes[j], []byte(string(r)))
+				}
+			}
+		}
+	}
+	p.finish()
+	return p
+}
+
+func (p *pattern) node() int32 {
+	p.edges = append(p.edges, nil)
+	return int32(len(p.edges) - 1)
+}
+
+// path joins from to to by the bytes of b
+func (p *pattern) path(from int32, to int32, b []byte) {
+	for i, c := range b {
+		next := to
+		if i < len(b)-1 {
+			next = p.node()
+		}
+		p.edges[from] = append(p.edges[from], edge{c: c, to: next})
+		from = next
+	}
+}
+
+// finish works out the lengths of the paths through the graph once it is complete
+func (p *pattern) finish() {
+	p.back = make([][]edge, len(p.edges))
+	indegree := make([]int, len(p.edges))
+	for from, edges := range p.edges {
+		for _, e := range edges {
+			p.back[e.to] = append(p.back[e.to], edge{c: e.c, to: int32(from)})
+			indegree[e.to]++
+		}
+	}
+	// A node is visited once every path to it is known, which never happens to a node on or after a loop
+	p.longest = make([]int, len(p.edges))
+	shortest := make([]int, len(p.edges))
+	visited := make([]bool, len(p.edges))
+	var queue []int32
+	for n := range p.edges {
+		shortest[n] = -1
+		if indegree[n] == 0 {
+			queue = append(queue, int32(n))
+		}
+	}
+	shortest[0] = 0
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		visited[n] = true
+		for _, e := range p.edges[n] {
+			if shortest[n] >= 0 {
+				if p.longest[n]+1 > p.longest[e.to] {
+					p.longest[e.to] = p.longest[n] + 1
+				}
+				if shortest[e.to] < 0 || shortest[n]+1 < shortest[e.to] {
+					shortest[e.to] = shortest[n] + 1
+				}
+			}
+			indegree[e.to]--
+			if indegree[e.to] == 0 {
+				queue = append(queue, e.to)
+			}
+		}
+	}
+	for n := range p.longest {
+		if !visited[n] {
+			p.longest[n] = unbounded
+		}
+	}
+	p.fixed = -1
+	if visited[p.last] && shortest[p.last] == p.longest[p.last] {
+		p.fixed = p.longest[p.last]
+	}
+	p.limit = p.longest[p.last]
+}
+
+// matchLength returns the length of the longest match of the pattern that b ends with, 0 when b does not end with one
+func (p *pattern) matchLength(b []byte) (length int) {
+	if len(b) > p.limit {
+		b = b[len(b)-p.limit:]
+	}
+	if p.fixed >= 0 {
+		if p.fixed <= len(b) {
+			return p.fixed
+		}
+		return 0
+	}
+	// Walk the graph backwards from the last node
+	nodes := []int32{p.last}
+	seen := make(map[int32]bool)
+	for i := len(b) - 1; i >= 0 && len(nodes) > 0; i-- {
+		var next []int32
+		for _, n := range nodes {
+			for _, e := range p.back[n] {
+				if e.c == b[i] && !seen[e.to] {
+					seen[e.to] = true
+					next = append(next, e.to)
+				}
+			}
+		}
+		for _, n := range next {
+			delete(seen, n)
+			if n == 0 {
+				length = len(b) - i
+			}
+		}
+		nodes = next
+	}
+	return
+}
+
+// tokenKey returns what token is matched as, two tokens with the same key match the same text
+func tokenKey(token string, fold CaseFold, form Normalization) string {
+	if form != NormalizeNone && utf8.ValidString(token) {
+		token = form.decomposer().String(token)
+	}
+	if fold == FoldNone {
+		return token
+	}
+	return foldKey([]rune(token), fold)
+}
+
+// caseVariants returns r and every other case of it under fold
+func caseVariants(r rune, fold CaseFold) []rune {
+	variants := []rune{r}
+	switch fold {
+	case FoldASCII:
+		if r >= 'a' && r <= 'z' {
+			variants = append(variants, r-'a'+'A')
+		} else if r >= 'A' && r <= 'Z' {
+			variants = append(variants, r-'A'+'a')
+		}
+	case FoldUnicode:
+		for v := unicode.SimpleFold(r); v != r; v = unicode.SimpleFold(v) {
+			variants = append(variants, v)
+		}
+	}
+	return variants
+}
+
+// foldKey returns the code points with every letter replaced by the same one of its cases under fold
+func foldKey(runes []rune, fold CaseFold) string {
+	var sb strings.Builder
+	for _, r := range runes {
+		switch fold {
+		case FoldASCII:
+			if r >= 'A' && r <= 'Z' {
+				r = r - 'A' + 'a'
+			}
+		case FoldUnicode:
+			// The smallest code point of the orbit
+			for v := unicode.SimpleFold(r); v != r; v = unicode.SimpleFold(v) {
+				if v < r {
+					r = v
+				}
+			}
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// maxDecomposition is the most code points any character decomposes to, U+FDFA under NFKD
+const maxDecomposition = 18
+
+// maxOrders is the most canonically equivalent orders of a token's combining marks matched,
+// past this only the canonical order is
+const maxOrders = 24
+
+// canonicalOrders returns every order of the decomposed runes that is canonically equivalent to it,
+// combining marks of a different combining class can be swapped, those of the same class cannot
+func canonicalOrders(runes []rune) [][]rune {
+	orders := [][]rune{runes}
+	for start := 0; start < len(runes); {
+		end := start
+		for end < len(runes) && norm.NFD.PropertiesString(string(runes[end])).CCC() != 0 {
+			end++
+		}
+		if end-start < 2 {
+			start = end + 1
+			continue
+		}
+		var more [][]rune
+		for _, order := range orders {
+			for _, marks := range markOrders(order[start:end]) {
+				o := append(append(append([]rune(nil), order[:start]...), marks...), order[end:]...)
+				more = append(more, o)
+			}
+		}
+		if len(more) > maxOrders {
+			return [][]rune{runes}
+		}
+		orders = more
+		start = end + 1
+	}
+	return orders
+}
+
+// markOrders returns every order of the combining marks that keeps marks of the same class in the same order
+func markOrders(marks []rune) (orders [][]rune) {
+	if len(marks) <= 1 {
+		return [][]rune{marks}
+	}
+	for i, m := range marks {
+		// m can go first when no mark of its class comes before it
+		ccc := norm.NFD.PropertiesString(string(m)).CCC()
+		blocked := false
+		for _, b := range marks[:i] {
+			if norm.NFD.PropertiesString(string(b)).CCC() == ccc {
+				blocked = true
+				break
+			}
+		}
+		if blocked {
+			continue
+		}
+		rest := append(append([]rune(nil), marks[:i]...), marks[i+1:]...)
+		for _, o := range markOrders(rest) {
+			orders = append(orders, append([]rune{m}, o...))
+		}
+	}
+	return
+}
+
+// composers returns every character that decomposes under form to runes, compared under fold
+func composers(form Normalization, fold CaseFold, runes []rune) []rune {
+	var found []rune
+	seen := make(map[rune]bool)
+	add := func(r rune) {
+		if !seen[r] {
+			seen[r] = true
+			found = append(found, r)
+		}
+	}
+	if len(runes) == 1 {
+		// A character that is its own decomposition, such as an ASCII letter
+		for _, v := range caseVariants(runes[0], fold) {
+			if s := string(v); form.decomposer().String(s) == s {
+				add(v)
+			}
+		}
+	}
+	for _, r := range decompositions(form, fold)[foldKey(runes, fold)] {
+		add(r)
+	}
+	return found
+}
+
+type decompositionKey struct {
+	form Normalization
+	fold CaseFold
+}
+
+// decompositionTables are the characters that decompose to something else, by their decomposition under fold
+var decompositionTables = struct {
+	sync.Mutex
+	tables map[decompositionKey]map[string][]rune
+}{tables: make(map[decompositionKey]map[string][]rune)}
+
+// decompositions returns the table of the characters that decompose under form, building it the first time
+func decompositions(form Normalization, fold CaseFold) map[string][]rune {
+	decompositionTables.Lock()
+	defer decompositionTables.Unlock()
+	key := decompositionKey{form: form, fold: fold}
+	if table, ok := decompositionTables.tables[key]; ok {
+		return table
+	}
+	table := make(map[string][]rune)
+	decomposer := form.decomposer()
+	buf := make([]byte, utf8.UTFMax)
+	for r := rune(0); r <= unicode.MaxRune; r++ {
+		if r >= 0xd800 && r < 0xe000 {
+			// Surrogates are not characters
+			continue
+		}
+		n := utf8.EncodeRune(buf, r)
+		// Hangul syllables are decomposed by an algorithm rather than a table
+		if decomposer.Properties(buf[:n]).Decomposition() == nil && (r < 0xac00 || r > 0xd7a3) {
+			continue
+		}
+		if d := decomposer.String(string(r)); d != string(r) {
+			k := foldKey([]rune(d), fold)
+			table[k] = append(table[k], r)
+		}
+	}
+	decompositionTables.tables[key] = table
+	return table
+}
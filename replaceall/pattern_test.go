@@ -0,0 +1,107 @@
+package replaceall
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var foldCases = []struct {
+	rule     Rule
+	input    string
+	expected string
+}{
+	{Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "X", Fold: FoldASCII}, "a <PHI>1</Phi> b <phi>2</pHI> <Phi>", "a X b X <Phi>"},
+	{Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "X"}, "a <PHI>1</PHI> b <phi>2</phi>", "a <PHI>1</PHI> b X"},
+	{Rule{StartToken: "<k>", EndToken: "</k>", Token: "X", Fold: FoldASCII}, "<\u212a>1</\u212a> <k>2</K>", "<\u212a>1</\u212a> X"},
+	{Rule{StartToken: "<k>", EndToken: "</k>", Token: "X", Fold: FoldUnicode}, "<\u212a>1</K> <K>2</k>", "X X"},
+	{Rule{StartToken: "<stra\u00dfe>", EndToken: "</STRASSE>", Token: "X", Fold: FoldUnicode}, "<STRA\u1e9eE>1</strasse>", "X"},
+	{Rule{StartToken: "<\u00e9>", EndToken: "</\u00e9>", Token: "X", Fold: FoldUnicode}, "<\u00c9>1</\u00e9> <\u00c9>2</\u00c9>", "X X"},
+	{Rule{StartToken: "<caf\u00e9>", EndToken: "</caf\u00e9>", Token: "X", Normalize: NFC}, "<cafe\u0301>1</caf\u00e9> <caf\u00e9>2</cafe\u0301>", "X X"},
+	{Rule{StartToken: "<cafe\u0301>", EndToken: "</caf\u00e9>", Token: "X", Normalize: NFC}, "<caf\u00e9>1</cafe\u0301> <cafe>2</cafe>", "X <cafe>2</cafe>"},
+	{Rule{StartToken: "<caf\u00e9>", EndToken: "</caf\u00e9>", Token: "X"}, "<cafe\u0301>1</cafe\u0301>", "<cafe\u0301>1</cafe\u0301>"},
+	{Rule{StartToken: "<a\u0323\u0301>", EndToken: ";", Token: "X", Normalize: NFC}, "<a\u0301\u0323>1; <\u00e1\u0323>2; <\u1ea1\u0301>3;", "X X X"},
+	{Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "X", Normalize: NFC}, "\uff1c\uff50\uff48\uff49\uff1e1", "\uff1c\uff50\uff48\uff49\uff1e1"},
+	{Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "X", Normalize: NFKC}, "\uff1c\uff50\uff48\uff49\uff1e1</\uff50hi> <phi>2</phi>", "X X"},
+	// The names are not case sensitive
+	{Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "X", Fold: "ASCII"}, "a <PHI>1</Phi> b", "a X b"},
+	{Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "X", Normalize: "NFKC"}, "\uff1c\uff50\uff48\uff49\uff1e1</phi>", "X"},
+	{Rule{StartToken: "<fi>", EndToken: "</fi>", Token: "X", Normalize: NFKC}, "<\ufb01>1</fi> <fi>2</\ufb01>", "X X"},
+	{Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "X", Fold: FoldUnicode, Normalize: NFKC}, "<\uff30\uff28\uff29>1</Phi> <phi>2</PHI>", "X X"},
+	{Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "X", Fold: FoldASCII, Normalize: NFKC}, "<\uff30\uff28\uff29>1</phi>", "X"},
+	{Rule{StartToken: "<x>", EndToken: "<X>", Token: "T", Fold: FoldASCII}, "a<x>b<x>c<X>d<X>e", "aTcTe"},
+	{Rule{StartToken: "<ab>", EndToken: "</ab>", Token: "X", Fold: FoldUnicode}, "<a<AB>1<aB>2</AB>3</ab>", "<aX"},
+}
+
+func TestReplace_Fold(t *testing.T) {
+	for c, fc := range foldCases {
+		err := validateRules([]Rule{fc.rule}, nil)
+		if err != nil {
+			t.Errorf("case %d: invalid rule: %s", c, err)
+			continue
+		}
+		r := NewReaderWith(iotest.OneByteReader(strings.NewReader(fc.input)), Options{Rules: []Rule{fc.rule}})
+		actual, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", c, err)
+		} else if string(actual) != fc.expected {
+			t.Errorf("case %d: %q != %q", c, actual, fc.expected)
+		}
+	}
+}
+
+func TestReplaceAllWith_Fold(t *testing.T) {
+	rules := []Rule{
+		{StartToken: "<phi>", EndToken: "</phi>", Token: "X", Fold: FoldUnicode, Normalize: NFKC},
+		{StartToken: "<k>", EndToken: "</k>", Token: "X", Fold: FoldUnicode},
+		{StartToken: "<caf\u00e9>", EndToken: "</caf\u00e9>", Token: "X", Normalize: NFC},
+		{StartToken: "<fi>", EndToken: "</fi>", Token: "X", Fold: FoldASCII, Normalize: NFKC},
+	}
+	line := "<PHI>1</Phi> <\u212a>2</k> \uff1c\uff50\uff48\uff49\uff1e3</phi> <cafe\u0301>4</caf\u00e9> <\ufb01>5</FI> plain\n"
+	input := strings.Repeat(line, 500)
+	expected := strings.Repeat("X X X X X plain\n", 500)
+	inputFileName := "testdata/results/fold-input.txt"
+	err := ioutil.WriteFile(inputFileName, []byte(input), 0644)
+	if err != nil {
+		t.Fatalf("could not write input: %s", err)
+	}
+	for _, threads := range []int{1, 4, 9} {
+		outputFileName := fmt.Sprintf("testdata/results/fold-output-%d.txt", threads)
+		var result Result
+		result, err = ReplaceAllWith(inputFileName, outputFileName, Options{Rules: rules, Threads: threads})
+		if err != nil {
+			t.Fatalf("%d threads: error during execution: %s", threads, err)
+		}
+		actual, rerr := quickRead(outputFileName)
+		if rerr != nil {
+			t.Fatalf("%d threads: could not read output: %s", threads, rerr)
+		}
+		if actual != expected {
+			t.Errorf("%d threads: unexpected output: %q", threads, actual[:100])
+		}
+		if result.Replacements != 2500 || result.BytesRemoved != int64(len(input)-len(expected))+2500 || !result.Confident {
+			t.Errorf("%d threads: unexpected result: %+v", threads, result)
+		}
+	}
+}
+
+func TestParseCaseFold(t *testing.T) {
+	for name, expected := range map[string]CaseFold{"": FoldNone, "none": FoldNone, "ASCII": FoldASCII, "unicode": FoldUnicode} {
+		if f, err := ParseCaseFold(name); err != nil || f != expected {
+			t.Errorf("%s: %s %v", name, f, err)
+		}
+	}
+	for name, expected := range map[string]Normalization{"": NormalizeNone, "NFC": NFC, "nfkc": NFKC} {
+		if n, err := ParseNormalization(name); err != nil || n != expected {
+			t.Errorf("%s: %s %v", name, n, err)
+		}
+	}
+	if _, err := ParseNormalization("nfd"); err == nil {
+		t.Errorf("nfd should not be accepted")
+	}
+	if err := validateRules([]Rule{{StartToken: "a", EndToken: "b", Fold: "upper"}}, nil); err == nil {
+		t.Errorf("an unknown case folding should not be valid")
+	}
+}
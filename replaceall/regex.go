@@ -0,0 +1,254 @@
+package replaceall
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"unicode"
+	"unicode/utf8"
+)
+
+// regexPattern returns the pattern matching the regular expression expr, in the syntax of package regexp.
+// A match is at most maxLength bytes long, the pattern can still have loops, the scanner drops anything longer.
+// Anchors and word boundaries cannot be told in a stream, they are an error, as is an expression that matches
+// the empty string.
+func regexPattern(expr string, maxLength int) (p *pattern, err error) {
+	if maxLength <= 0 {
+		return nil, fmt.Errorf("regular expression '%s' needs a maximum match length", expr)
+	}
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return
+	}
+	c := regexCompiler{prog: prog, p: &pattern{}, nodes: make(map[uint32]int32), tails: make(map[uint32][]edgeRun)}
+	first := c.p.node()
+	c.p.last = c.p.node()
+
+	// A node for the start and after every instruction that reads a character, joined by the UTF-8 bytes
+	// of the characters read by the instructions that can come next
+	matchesEmpty, err := c.from(first, uint32(prog.Start))
+	if err != nil {
+		return
+	}
+	if matchesEmpty {
+		return nil, fmt.Errorf("regular expression '%s' matches the empty string", expr)
+	}
+	for done := 0; done < len(c.order); done++ {
+		pc := c.order[done]
+		if _, err = c.from(c.nodes[pc], prog.Inst[pc].Out); err != nil {
+			return
+		}
+	}
+	c.p.finish()
+	if c.p.limit > maxLength {
+		c.p.limit = maxLength
+	}
+	return c.p, nil
+}
+
+// edgeRun is the edges leaving a node for a range of bytes
+type edgeRun struct {
+	lo, hi byte
+	to     int32
+}
+
+type regexCompiler struct {
+	prog  *syntax.Prog
+	p     *pattern
+	nodes map[uint32]int32     // The node after each instruction that reads a character
+	order []uint32             // The instructions in the order their nodes were made
+	tails map[uint32][]edgeRun // The first bytes of the characters each instruction reads, leading on to the rest
+}
+
+// from joins node to every instruction reading a character that can follow pc, reporting whether the match
+// can end at pc instead
+func (c *regexCompiler) from(node int32, pc uint32) (matches bool, err error) {
+	var reads []uint32
+	matches, err = c.closure(pc, make(map[uint32]bool), &reads)
+	if err != nil {
+		return
+	}
+	for _, r := range reads {
+		var runs []edgeRun
+		runs, err = c.reads(r)
+		if err != nil {
+			return
+		}
+		for _, run := range runs {
+			for b := int(run.lo); b <= int(run.hi); b++ {
+				c.p.edges[node] = append(c.p.edges[node], edge{c: byte(b), to: run.to})
+			}
+		}
+	}
+	return
+}
+
+// closure finds the instructions reading a character that pc leads to without reading anything
+func (c *regexCompiler) closure(pc uint32, seen map[uint32]bool, reads *[]uint32) (matches bool, err error) {
+	if seen[pc] {
+		return
+	}
+	seen[pc] = true
+	inst := c.prog.Inst[pc]
+	switch inst.Op {
+	case syntax.InstMatch:
+		return true, nil
+	case syntax.InstFail:
+		return
+	case syntax.InstAlt, syntax.InstAltMatch:
+		matches, err = c.closure(inst.Out, seen, reads)
+		if err == nil {
+			var m bool
+			m, err = c.closure(inst.Arg, seen, reads)
+			matches = matches || m
+		}
+		return
+	case syntax.InstNop, syntax.InstCapture:
+		return c.closure(inst.Out, seen, reads)
+	case syntax.InstEmptyWidth:
+		return false, fmt.Errorf("anchors and word boundaries are not supported in a streamed token")
+	}
+	*reads = append(*reads, pc)
+	return
+}
+
+// reads returns the edges for the characters the instruction at pc reads, the same for every node they leave,
+// each character's last byte leads to the node after the instruction and, when the match can end there, the last node.
+func (c *regexCompiler) reads(pc uint32) ([]edgeRun, error) {
+	if runs, ok := c.tails[pc]; ok {
+		return runs, nil
+	}
+	after, ok := c.nodes[pc]
+	if !ok {
+		after = c.p.node()
+		c.nodes[pc] = after
+		c.order = append(c.order, pc)
+	}
+	ends, err := c.closure(c.prog.Inst[pc].Out, make(map[uint32]bool), new([]uint32))
+	if err != nil {
+		return nil, err
+	}
+	targets := []int32{after}
+	if ends {
+		targets = append(targets, c.p.last)
+	}
+
+	var runs []edgeRun
+	for _, seq := range utf8Sequences(runeRanges(c.prog.Inst[pc])) {
+		// The bytes after the first go through nodes of their own
+		next := targets
+		for i := len(seq) - 1; i > 0; i-- {
+			n := c.p.node()
+			for b := int(seq[i][0]); b <= int(seq[i][1]); b++ {
+				for _, to := range next {
+					c.p.edges[n] = append(c.p.edges[n], edge{c: byte(b), to: to})
+				}
+			}
+			next = []int32{n}
+		}
+		for _, to := range next {
+			runs = append(runs, edgeRun{lo: seq[0][0], hi: seq[0][1], to: to})
+		}
+	}
+	c.tails[pc] = runs
+	return runs, nil
+}
+
+// runeRanges returns the characters an instruction reads as pairs of first and last
+func runeRanges(inst syntax.Inst) []rune {
+	switch inst.Op {
+	case syntax.InstRune1:
+		return []rune{inst.Rune[0], inst.Rune[0]}
+	case syntax.InstRuneAny:
+		return []rune{0, unicode.MaxRune}
+	case syntax.InstRuneAnyNotNL:
+		return []rune{0, '\n' - 1, '\n' + 1, unicode.MaxRune}
+	}
+	if len(inst.Rune) == 1 {
+		// A single character, of any case when folding
+		var ranges []rune
+		r := inst.Rune[0]
+		variants := []rune{r}
+		if syntax.Flags(inst.Arg)&syntax.FoldCase != 0 {
+			variants = caseVariants(r, FoldUnicode)
+		}
+		for _, v := range variants {
+			ranges = append(ranges, v, v)
+		}
+		return ranges
+	}
+	return inst.Rune
+}
+
+// utf8Sequences returns the byte ranges of the UTF-8 encodings of the characters in ranges, as sequences of
+// ranges that every byte of an encoding falls in. Surrogates have no encoding and are left out.
+func utf8Sequences(ranges []rune) (seqs [][][2]byte) {
+	var todo [][2]rune
+	for i := 0; i+1 < len(ranges); i += 2 {
+		todo = append(todo, [2]rune{ranges[i], ranges[i+1]})
+	}
+	for len(todo) > 0 {
+		lo, hi := todo[len(todo)-1][0], todo[len(todo)-1][1]
+		todo = todo[:len(todo)-1]
+		if lo > hi {
+			continue
+		}
+		// Split where the surrogates are and where the encoding gets longer
+		if lo < 0xd800 && hi > 0xdfff {
+			todo = append(todo, [2]rune{lo, 0xd7ff}, [2]rune{0xe000, hi})
+			continue
+		}
+		if lo >= 0xd800 && lo <= 0xdfff {
+			lo = 0xe000
+		}
+		if hi >= 0xd800 && hi <= 0xdfff {
+			hi = 0xd7ff
+		}
+		if lo > hi {
+			continue
+		}
+		split := false
+		for _, max := range []rune{0x7f, 0x7ff, 0xffff} {
+			if lo <= max && hi > max {
+				todo = append(todo, [2]rune{lo, max}, [2]rune{max + 1, hi})
+				split = true
+				break
+			}
+		}
+		if split {
+			continue
+		}
+		// Split until every continuation byte covers its whole range or a single value
+		n := utf8.RuneLen(lo)
+		for i := 1; i < n; i++ {
+			m := rune(1)<<uint(6*i) - 1
+			if lo&^m != hi&^m {
+				if lo&m != 0 {
+					todo = append(todo, [2]rune{lo, lo | m}, [2]rune{(lo | m) + 1, hi})
+					split = true
+					break
+				}
+				if hi&m != m {
+					todo = append(todo, [2]rune{lo, hi&^m - 1}, [2]rune{hi &^ m, hi})
+					split = true
+					break
+				}
+			}
+		}
+		if split {
+			continue
+		}
+		var a, b [utf8.UTFMax]byte
+		utf8.EncodeRune(a[:], lo)
+		utf8.EncodeRune(b[:], hi)
+		seq := make([][2]byte, n)
+		for i := range seq {
+			seq[i] = [2]byte{a[i], b[i]}
+		}
+		seqs = append(seqs, seq)
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package replaceall
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var regexCases = []struct {
+	rule     Rule
+	input    string
+	expected string
+}{
+	{Rule{StartToken: `<phi[^>]*>`, EndToken: `</phi>`, Token: "X", Regex: true, MaxLength: 64}, `a <phi id="1">x</phi> b <phi>y</phi> c`, "a X b X c"},
+	// Nested start tokens with other attributes
+	{Rule{StartToken: `<phi[^>]*>`, EndToken: `</phi>`, Token: "X", Regex: true, MaxLength: 64}, `<phi a="1"><phi b="2">x</phi>y</phi>z`, "Xz"},
+	{Rule{StartToken: `<(phi|ssn)>`, EndToken: `</(phi|ssn)>`, Token: "X", Regex: true, MaxLength: 16}, "<phi>1</ssn> <ssn>2</phi> <pha>3</pha>", "X X <pha>3</pha>"},
+	// Longer than the maximum match length
+	{Rule{StartToken: `<phi[^>]*>`, EndToken: `</phi>`, Token: "X", Regex: true, MaxLength: 14}, `<phi id="12345">x</phi> <phi id="1">y</phi>`, `<phi id="12345">x</phi> X`},
+	{Rule{StartToken: `(?i)<caf\x{e9}>`, EndToken: `</caf[e\x{e9}]>`, Token: "X", Regex: true, MaxLength: 16}, "<CAF\u00c9>1</cafe> <caf\u00e9>2</caf\u00e9>", "X X"},
+	{Rule{StartToken: `\[\d+\]`, EndToken: `\[/\d+\]`, Token: "X", Regex: true, MaxLength: 8}, "a[12]b[/3]c[]d[/]e", "aXc[]d[/]e"},
+	// The same expression opens and closes
+	{Rule{StartToken: `--+`, EndToken: `--+`, Token: "X", Regex: true, MaxLength: 8}, "a--b---c", "aX-c"},
+	// A bounded repeat
+	{Rule{StartToken: `<phi[^>]{0,8}>`, EndToken: `</phi>`, Token: "X", Regex: true, MaxLength: 16}, "<phi <phi a>1</phi> <phi abcdefghi>2</phi>", "X <phi abcdefghi>2</phi>"},
+	// Any character, across lines only with (?s)
+	{Rule{StartToken: `<a.>`, EndToken: `</a>`, Token: "X", Regex: true, MaxLength: 8}, "<a\u20ac>1</a> <a\n>2</a>", "X <a\n>2</a>"},
+}
+
+func TestReplace_Regex(t *testing.T) {
+	for c, rc := range regexCases {
+		err := validateRules([]Rule{rc.rule}, nil)
+		if err != nil {
+			t.Errorf("case %d: invalid rule: %s", c, err)
+			continue
+		}
+		r := NewReaderWith(iotest.OneByteReader(strings.NewReader(rc.input)), Options{Rules: []Rule{rc.rule}})
+		actual, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", c, err)
+		} else if string(actual) != rc.expected {
+			t.Errorf("case %d: %q != %q", c, actual, rc.expected)
+		}
+	}
+}
+
+func TestReplace_RegexBounded(t *testing.T) {
+	// A start token that never finishes is only held back as far as the maximum match length
+	rule := Rule{StartToken: `<phi[^>]*>`, EndToken: `</phi>`, Token: "X", Regex: true, MaxLength: 64}
+	input := "<phi " + strings.Repeat("a", 100000) + "> <phi b>1</phi>"
+	var held int
+	sc, err := newStreamScanner(ioutil.Discard, Options{Rules: []Rule{rule}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; i < len(input); i++ {
+		err = sc.scan([]byte{input[i]})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(sc.st.pending) > held {
+			held = len(sc.st.pending)
+		}
+	}
+	if held > 2*rule.MaxLength+1 || sc.counts.replacements != 1 {
+		t.Errorf("held back %d bytes, made %d replacements", held, sc.counts.replacements)
+	}
+}
+
+func TestReplaceAllWith_Regex(t *testing.T) {
+	rules := []Rule{
+		{StartToken: `<phi[^>]*>`, EndToken: `</phi\s*>`, Token: "X", Regex: true, MaxLength: 256},
+		{StartToken: "<ssn>", EndToken: "</ssn>", Token: "S"},
+	}
+	line := `<phi id="a">1<phi class="b c">2</phi >3</phi> <ssn>4</ssn> <phi>` + "\n" + `5</phi> <phix y="z">6</phi> plain` + "\n"
+	input := strings.Repeat(line, 400)
+	expected := strings.Repeat("X S X X plain\n", 400)
+	inputFileName := "testdata/results/regex-input.txt"
+	err := ioutil.WriteFile(inputFileName, []byte(input), 0644)
+	if err != nil {
+		t.Fatalf("could not write input: %s", err)
+	}
+	for _, threads := range []int{1, 4, 9} {
+		outputFileName := fmt.Sprintf("testdata/results/regex-output-%d.txt", threads)
+		var result Result
+		result, err = ReplaceAllWith(inputFileName, outputFileName, Options{Rules: rules, Threads: threads})
+		if err != nil {
+			t.Fatalf("%d threads: error during execution: %s", threads, err)
+		}
+		actual, rerr := quickRead(outputFileName)
+		if rerr != nil {
+			t.Fatalf("%d threads: could not read output: %s", threads, rerr)
+		}
+		if actual != expected {
+			t.Errorf("%d threads: unexpected output: %q", threads, actual[:100])
+		}
+		if result.Replacements != 1600 || result.MaxDepth != 2 || !result.Confident {
+			t.Errorf("%d threads: unexpected result: %+v", threads, result)
+		}
+	}
+}
+
+func TestValidateRules_Regex(t *testing.T) {
+	for _, rule := range []Rule{
+		{StartToken: `<a>`, EndToken: `</a>`, Regex: true},
+		{StartToken: `^<a>`, EndToken: `</a>`, Regex: true, MaxLength: 8},
+		{StartToken: `<a>`, EndToken: `</a>\b`, Regex: true, MaxLength: 8},
+		{StartToken: `a*`, EndToken: `</a>`, Regex: true, MaxLength: 8},
+		{StartToken: `<a`, EndToken: `(</a>`, Regex: true, MaxLength: 8},
+		{StartToken: `<a>`, EndToken: `</a>`, Regex: true, MaxLength: 8, Fold: FoldASCII},
+		{StartToken: `<a>`, EndToken: `</a>`, MaxLength: 8},
+	} {
+		if err := validateRules([]Rule{rule}, nil); err == nil {
+			t.Errorf("%+v should not be valid", rule)
+		}
+	}
+}
+
+func TestValidateRules_RegexStates(t *testing.T) {
+	// Every repeat a start token can begin in again is a state of its own, too many are an error, not a hang
+	for _, expr := range []string{`<phi[^>]{0,40}>`, `<phi.*a.{16}>`} {
+		err := validateRules([]Rule{{StartToken: expr, EndToken: `</phi>`, Regex: true, MaxLength: 64}}, nil)
+		if err == nil || !strings.Contains(err.Error(), "too complex") {
+			t.Errorf("%s: expected the expression to be too complex, got %v", expr, err)
+		}
+	}
+	// Exact tokens never need more states than they have bytes
+	var subs []Substitution
+	for i := 0; i < 2*maxStates/16; i++ {
+		subs = append(subs, Substitution{Needle: fmt.Sprintf("needle-%09d", i)})
+	}
+	if err := validateRules(nil, subs); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -1,306 +1,410 @@
 package replaceall
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/stipo42/stringaling/internal/util"
+	"github.com/stipo42/stringaling/logging"
+	"github.com/stipo42/stringaling/progress"
 )
 
+// DefaultBufferSize is the size of the blocks AllReplacer reads and writes when no BufferSize is set
+const DefaultBufferSize = 64 * 1024
+
 type AllReplacer struct {
-	StartAt       int64 // The byte number to start at
-	GoUntil       int64 // The byte number to consume
-	StartToken    string
-	EndToken      string
-	Token         string
+	StartAt    int64 // The byte number to start at
+	GoUntil    int64 // The byte number to consume, when zero the reader is consumed until EOF
+	BufferSize int   // The size of the blocks read and written at a time, defaults to DefaultBufferSize
+	StartToken string
+	EndToken   string
+	Token      string
+	Rules      []Rule // More rules to apply in the same pass, after the one given by StartToken, EndToken and Token
+	// Plain tokens to replace in the same pass, they are looked for while no replacement is open
+	Substitutions []Substitution
+	// XML elements to replace instead of rules and substitutions, the input is then read as an XML document
+	// that starts at StartAt, see Element
+	Elements []Element
+	// JSON fields to replace instead of rules and substitutions, the input is then read as JSON values
+	// from StartAt on, see Field. With NDJSON every line is a value of its own and StartAt is at the start of a line.
+	Fields []Field
+	NDJSON bool
+	// The most skipped bytes held in memory while a replacement is open, past this they are
+	// moved to a spool file in SpoolDir (os.TempDir when empty). Zero keeps everything in memory.
+	SpoolThreshold int64
+	SpoolDir       string
+	// The spawned reader is decompressed from InputCompression and the spawned writer is
+	// compressed with OutputCompression, StartAt and GoUntil count decompressed bytes.
+	InputCompression  Compression
+	OutputCompression Compression
+	// The decompressed input is decoded from InputEncoding to UTF-8 before it is matched, and the output is encoded to
+	// OutputEncoding before it is compressed, the input encoding when empty. UTF-8 is neither decoded nor encoded.
+	// StartAt and GoUntil count bytes before decoding, match offsets and the counts of the result bytes after it.
+	InputEncoding  Encoding
+	OutputEncoding Encoding
+	// Called with every region replaced, every needle substituted and any replacement left unterminated,
+	// in input order. Offsets count from the start of the input, StartAt included.
+	OnMatch func(m Match)
+	// Called with the progress of Replace about once every ProgressInterval (progress.DefaultInterval when zero)
+	// and once more when it is done. Bytes are counted as read from the spawned reader, before any decompression,
+	// and InputSize is the number expected, for the ETA. When zero GoUntil is used, if set.
+	OnProgress       func(p progress.Progress)
+	ProgressInterval time.Duration
+	InputSize        int64
+	// Where messages go, the id given to Replace is added to them as the worker. Nothing is logged when nil.
+	Logger        logging.Logger
 	ReaderSpawner func() (io.Reader, error)
 	WriterSpawner func() (io.Writer, error)
 	ReaderCleanup *func()
 	WriterCleanup *func()
+	dryRun        bool              // Nothing is written, so skipped bytes do not need to be held back
+	tracker       *progress.Tracker // Counts the bytes read, shared by the workers of a threaded run
+	worker        int               // The worker the tracker counts the bytes read for
+	// What a range resumed from a checkpoint had already counted, StartAt and GoUntil skip the bytes it read
+	from        tally
+	checkpoints *checkpointer // Saves how far the first scan of a range has got, nil when not checkpointing
+	automata    *ruleAutomata // The automata of the validated rules, shared by the workers of a run, built when nil
+}
+
+// engine is what replaceFrom feeds the input through, the scanner matching rules and substitutions,
+// or the redactor of XML elements or JSON fields
+type engine interface {
+	scan(p []byte) error // Consumes p, writing out what is not replaced
+	flush() error        // Writes out anything held back, once the end of the input is reached
+	tally() tally
+	halted() bool // Reports whether the engine stopped before the end of its range
+	discard()     // Removes any spool file
+}
+
+// matchState is the unfinished token state of an AllReplacer at a byte boundary.
+// It is handed from the end of one range to the start of the next so that a file
+// split across workers is replaced exactly as a single pass would replace it.
+type matchState struct {
+	depth    int    // When not zero, don't write byte to output
+	rule     int    // The rule whose replacement is open when depth is not zero
+	openedAt int64  // The offset of the start token of the open replacement
+	region   int64  // The bytes of the open replacement so far, start token included
+	partial  int    // The length of the token that may be in progress at the end of pending
+	pending  []byte // The skipped bytes held back in case a replacement or token never finishes
+	spill    *spool // The skipped bytes before pending that were moved out of memory
+}
+
+// clean reports whether nothing is open or held back,
+// from a clean state the rest of a range does not depend on anything before it.
+func (m matchState) clean() bool {
+	return m.depth == 0 && m.partial == 0 && len(m.pending) == 0 && m.spill == nil
+}
+
+// pendingSize returns the number of skipped bytes held back, in memory or spooled
+func (m matchState) pendingSize() int64 {
+	size := int64(len(m.pending))
+	if m.spill != nil {
+		size += m.spill.size
+	}
+	return size
+}
+
+// pendingReader returns a reader over all the skipped bytes held back
+func (m matchState) pendingReader() io.Reader {
+	if m.spill == nil {
+		return bytes.NewReader(m.pending)
+	}
+	return io.MultiReader(m.spill.reader(), bytes.NewReader(m.pending))
+}
+
+// syncWatcher observes the positions at which a scan is in a clean state,
+// it is used to line up two scans of the same range that started from different states.
+type syncWatcher interface {
+	// next returns the next position within the range the watcher wants to see
+	next() int64
+	// clean is called with the tally at the first clean position at or after next(),
+	// returning true stops the scan.
+	clean(t tally) bool
 }
 
 // Replace performs the replacement for the configured AllReplacer
 // optionally an id may be supplied for keeping track of threading when
 // output is verbose
-// This function returns a flag representing the confidence that this function
-// caught all the replacements.
+// This function returns what the replacement did, including whether it is confident
+// it caught all the replacements.
 // When the function is not confident it basically means the start and end token count
 // is uneven.
-func (s AllReplacer) Replace(id ...int) (confident bool, err error) {
-	start := time.Now().UnixNano()
-	if s.StartToken == s.EndToken {
-		confident, err = s.replaceSameStartEnd(id...)
-	} else {
-		confident, err = s.replace(id...)
-	}
-	if s.ReaderCleanup != nil {
-		util.Debug("%d: running reader cleanup", id)
-		c := *s.ReaderCleanup
-		c()
+func (s AllReplacer) Replace(id ...int) (result Result, err error) {
+	return s.ReplaceContext(context.Background(), id...)
+}
+
+// ReplaceContext is Replace stopping as soon as ctx is done, in which case ctx.Err() is returned
+// and whatever was written so far is incomplete.
+func (s AllReplacer) ReplaceContext(ctx context.Context, id ...int) (result Result, err error) {
+	start := time.Now()
+	if s.tracker == nil && s.OnProgress != nil {
+		size := s.InputSize
+		if size == 0 && !s.InputCompression.compressed() {
+			size = s.GoUntil
+		}
+		s.tracker = progress.NewTracker(1, size, s.ProgressInterval, s.OnProgress)
+		defer s.tracker.Finish()
 	}
-	if s.WriterCleanup != nil {
-		util.Debug("%d: running writer cleanup", id)
-		c := *s.WriterCleanup
-		c()
+	var st matchState
+	var t tally
+	st, t, err = s.replaceFrom(ctx, matchState{}, nil, true, id...)
+	result = t.result()
+	result.Confident = st.clean()
+	if st.depth > 0 {
+		result.Unterminated = 1
 	}
-	diff := time.Now().UnixNano() - start
-	util.Info("Replace took %s to execute", util.HumanReadable(diff))
+	result.Passes = 1
+	result.Threads = 1
+	s.cleanup(id...)
+	result.Duration = time.Since(start)
+	s.logger(id...).Info("Replace took %s to execute", util.HumanReadable(result.Duration.Nanoseconds()))
 
 	return
 }
 
-// SpawnReader will spawn a new io.Reader for the AllReplacer to read from.
-func (s AllReplacer) SpawnReader() (reader io.Reader, err error) {
-	return s.ReaderSpawner()
-}
-
-// SpawnWriter will spawn a new io.Writer for the AllReplacer to write to.
-func (s AllReplacer) SpawnWriter() (writer io.Writer, err error) {
-	return s.WriterSpawner()
+// replaceChunk performs the replacement for the configured range starting from state in,
+// the state reached at the end of the range is returned instead of being written out,
+// so the next range can pick up exactly where this one left off.
+func (s AllReplacer) replaceChunk(ctx context.Context, in matchState, watcher syncWatcher, id ...int) (out matchState, t tally, err error) {
+	start := time.Now().UnixNano()
+	out, t, err = s.replaceFrom(ctx, in, watcher, false, id...)
+	s.cleanup(id...)
+	diff := time.Now().UnixNano() - start
+	s.logger(id...).Debug("replacing range took %s to execute", util.HumanReadable(diff))
+	return
 }
 
-// replace is used to replace content between different start and end tokens
-func (s AllReplacer) replace(id ...int) (confident bool, err error) {
-	noWriteDepth := 0 // When not zero, don't write byte to output
-	chunk := make([]byte, 1)
-	sct := 0 // Increase every time the consecutively read byte matches that index of the start token, when longer than start token length, depth increases
-	ect := 0 // Increase every time the consecutively read byte matches that index of the end token,   when longer than end   token length, depth decreases
-	skipped := 0
-
-	slen := len(s.StartToken)
-	elen := len(s.EndToken)
-
-	byteCtr := int64(0)
+// replaceFrom spawns the reader and writer and runs the matching engine from state in,
+// when flush is set any bytes still pending at the end of the range are written out.
+// ctx is checked before every block is read.
+func (s AllReplacer) replaceFrom(ctx context.Context, in matchState, watcher syncWatcher, flush bool, id ...int) (out matchState, t tally, err error) {
+	out = in
+	log := s.logger(id...)
+	if s.automata == nil {
+		s.automata, err = compile(s.rules(), s.Substitutions, s.Elements, s.Fields)
+		if err != nil {
+			log.Error("invalid rules: %s", err)
+			return
+		}
+	}
 	var reader io.Reader
 	var writer io.Writer
 	reader, err = s.SpawnReader()
-	// Holds the temporary skipped bytes
-	// Only holds data when skipping, drops its value when not skipping
-	// If the end of the stream is hit while skipping, it is written to the output
-	var cupdate []byte
 	if err != nil {
-		util.Error("%d: could not spawn a reader struct: %s", id, err)
-	} else {
-		writer, err = s.SpawnWriter()
+		log.Error("could not spawn a reader struct: %s", err)
+		return
+	}
+	writer, err = s.SpawnWriter()
+	if err != nil {
+		log.Error("could not spawn a writer struct: %s", err)
+		return
+	}
+	if s.InputCompression.compressed() {
+		// The compressed bytes are counted, those are the ones the input size is known in
+		reader = s.tracker.Reader(s.worker, reader)
+		var dr io.ReadCloser
+		dr, err = s.InputCompression.newReader(reader)
 		if err != nil {
-			util.Error("%d: could not spawn a writer struct: %s", id, err)
-		} else {
-			rerr := s.fastForward(reader)
-			for rerr == nil {
-				var b int
-				b, rerr = reader.Read(chunk)
-				byteCtr += int64(b)
-				if rerr != nil {
-					if rerr == io.EOF {
-						util.Debug("%d: end of file: %s", id, rerr)
-					} else {
-						util.Error("%d: couldn't read chunk: %s", id, rerr)
-						err = rerr
-					}
-					if len(cupdate) > 0 {
-						s.write(cupdate, writer, id...)
-					}
-				} else {
-					if noWriteDepth > 0 {
-						skipped += 1
-					}
-					startBackfill := s.missCheck(chunk[0], noWriteDepth, s.StartToken, &sct, &ect, id...)
-					if len(startBackfill) > 0 {
-						cupdate = removeLastIndexes(cupdate, len(startBackfill))
-						s.write(startBackfill, writer, id...)
-					}
-					endBackfill := s.missCheck(chunk[0], noWriteDepth, s.EndToken, &ect, &sct, id...)
-					if len(endBackfill) > 0 {
-						cupdate = removeLastIndexes(cupdate, len(endBackfill))
-						s.write(endBackfill, writer, id...)
-					}
-					if sct >= slen {
-						sct = 0
-						noWriteDepth += 1
-					}
-					if ect >= elen {
-						ect = 0
-						noWriteDepth -= 1
-						if noWriteDepth < 0 {
-							// Mismatched end to start, write end back, reduce cupdate
-							cupdate = removeLastIndexes(cupdate, elen-1)
-							s.writeS(s.EndToken, writer, id...)
-							noWriteDepth = 0
-						} else if noWriteDepth <= 0 {
-							skipped += slen
-							util.Debug("%d: replaced %d bytes", id, skipped)
-							s.writeS(s.Token, writer, id...)
-							cupdate = nil
-						}
-					} else if noWriteDepth == 0 && sct == 0 && ect == 0 {
-						s.write(chunk, writer, id...)
-					} else {
-						util.Debug("%d: Appending '%s' to cupdate, noWriteDepth = %d, sct = %d, ect = %d, cupdate = %s", id, string(chunk), noWriteDepth, sct, ect, string(cupdate))
-						cupdate = append(cupdate, chunk[0])
-					}
-				}
-				if byteCtr >= s.GoUntil {
-					util.Debug("%d: Hit end of byte duty", id)
-					confident = len(cupdate) == 0
-					if len(cupdate) > 0 {
-						s.write(cupdate, writer, id...)
-					}
+			log.Error("could not read %s input: %s", s.InputCompression, err)
+			return
+		}
+		defer dr.Close()
+		reader = dr
+	}
+	err = s.fastForward(log, reader)
+	if err != nil {
+		return
+	}
+	if s.GoUntil > 0 {
+		reader = io.LimitReader(reader, s.GoUntil)
+	}
+	if !s.InputCompression.compressed() {
+		reader = s.tracker.Reader(s.worker, reader)
+	}
+	var inputEncoding Encoding
+	reader, inputEncoding, err = s.InputEncoding.newReader(reader)
+	if err != nil {
+		log.Error("could not read %s input: %s", s.InputEncoding, err)
+		return
+	}
+	outputEncoding := s.OutputEncoding
+	if outputEncoding == "" {
+		outputEncoding = inputEncoding
+	}
+	var cw io.WriteCloser
+	cw, err = s.OutputCompression.newWriter(writer)
+	if err != nil {
+		log.Error("could not write %s output: %s", s.OutputCompression, err)
+		return
+	}
+	var ew io.WriteCloser
+	ew, err = outputEncoding.newWriter(cw)
+	if err != nil {
+		log.Error("could not write %s output: %s", outputEncoding, err)
+		return
+	}
+
+	size := s.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	bw := bufio.NewWriterSize(ew, size)
+	var sc *scanner
+	var eng engine
+	if len(s.Fields) > 0 {
+		eng = newJSONRedactor(s, bw, id...)
+	} else if len(s.Elements) > 0 {
+		eng = newXMLRedactor(s, bw, id...)
+	} else {
+		sc = newScanner(s, &out, bw, watcher, id...)
+		eng = sc
+	}
+	chunk := make([]byte, size)
+	for !eng.halted() {
+		if err = ctx.Err(); err != nil {
+			log.Debug("stopped after %d bytes: %s", eng.tally().read, err)
+			break
+		}
+		var b int
+		var rerr error
+		b, rerr = reader.Read(chunk)
+		if b > 0 {
+			err = eng.scan(chunk[:b])
+			if err != nil {
+				break
+			}
+			if sc != nil && s.checkpointable() && s.checkpoints.due(s.worker) {
+				err = s.checkpoint(sc, bw, writer, false)
+				if err != nil {
 					break
 				}
 			}
 		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				log.Debug("end of range after %d bytes", eng.tally().read)
+			} else {
+				log.Error("couldn't read chunk: %s", rerr)
+				err = rerr
+			}
+			break
+		}
 	}
-
+	if flush || sc == nil {
+		// A document or a line is never carried over to another range, its range always ends with it
+		if err == nil {
+			err = eng.flush()
+		}
+		eng.discard()
+	}
+	ferr := bw.Flush()
+	if err == nil {
+		err = ferr
+	}
+	ferr = ew.Close()
+	if err == nil {
+		err = ferr
+	}
+	ferr = cw.Close()
+	if err == nil {
+		err = ferr
+	}
+	if err == nil && sc != nil && s.checkpoints != nil {
+		err = s.checkpoint(sc, bw, writer, true)
+	}
+	t = eng.tally()
 	return
 }
 
-// replaceSameStartEnd is used when the start and end tokens are the same,
-// the logic is slightly different / simplified in this scenario
-func (s AllReplacer) replaceSameStartEnd(id ...int) (confident bool, err error) {
-	noWriteDepth := 0 // When not zero, don't write byte to output
-	chunk := make([]byte, 1)
-	ct := 0 // Increase every time the consecutively read byte matches that index of the start token, when longer than start token length, depth increases
-	skipped := 0
-
-	slen := len(s.StartToken)
+// checkpointable reports whether a range can be checkpointed part way through,
+// a decompressor cannot be picked up in the middle of a member so compressed input is only checkpointed once done,
+// nor can a decoder in the middle of a character.
+func (s AllReplacer) checkpointable() bool {
+	return s.checkpoints != nil && !s.InputCompression.compressed() && !s.OutputCompression.compressed() &&
+		!s.InputEncoding.decoded() && !s.OutputEncoding.decoded()
+}
 
-	byteCtr := int64(0)
-	var reader io.Reader
-	var writer io.Writer
-	reader, err = s.SpawnReader()
-	// Holds the temporary skipped bytes
-	// Only holds data when skipping, drops its value when not skipping
-	// If the end of the stream is hit while skipping, it is written to the output
-	var cupdate []byte
+// checkpoint saves how far the scan has got once everything it wrote is on disk
+func (s AllReplacer) checkpoint(sc *scanner, bw *bufio.Writer, writer io.Writer, done bool) (err error) {
+	err = bw.Flush()
 	if err != nil {
-		util.Error("could not spawn a reader struct: %s", err)
-	} else {
-		writer, err = s.SpawnWriter()
-		if err != nil {
-			util.Error("%d: could not spawn a writer struct: %s", id, err)
-		} else {
-			rerr := s.fastForward(reader)
-			for rerr == nil {
-				var b int
-				b, rerr = reader.Read(chunk)
-				byteCtr += int64(b)
-				if rerr != nil {
-					if rerr == io.EOF {
-						util.Debug("%d: End of file: %s", id, rerr)
-					} else {
-						util.Error("%d: Couldn't read chunk: %s", id, rerr)
-						err = rerr
-					}
-					if len(cupdate) > 0 {
-						s.write(cupdate, writer, id...)
-					}
-				} else {
-					if noWriteDepth > 0 {
-						skipped += 1
-					}
-					backfill := s.missCheck(chunk[0], noWriteDepth, s.StartToken, &ct, nil, id...)
-					if len(backfill) > 0 {
-						cupdate = removeLastIndexes(cupdate, len(backfill))
-						s.write(backfill, writer, id...)
-					}
-					if ct >= slen {
-						ct = 0
-						if noWriteDepth == 0 {
-							noWriteDepth = 1
-						} else if noWriteDepth == 1 {
-							skipped += slen
-							util.Debug("%d: replaced %d bytes", id, skipped)
-							s.writeS(s.Token, writer, id...)
-							cupdate = nil
-							noWriteDepth = 0
-						}
-					} else if noWriteDepth == 0 && ct == 0 {
-						s.write(chunk, writer, id...)
-					} else {
-						util.Debug("%d: Appending '%s' to cupdate, noWriteDepth = %d, ct = %d, cupdate = %s", id, string(chunk), noWriteDepth, ct, string(cupdate))
-						cupdate = append(cupdate, chunk[0])
-					}
-				}
-				if byteCtr >= s.GoUntil {
-					util.Debug("%d: Hit end of byte duty", id)
-					confident = len(cupdate) == 0
-					if len(cupdate) > 0 {
-						s.write(cupdate, writer, id...)
-					}
-					break
-				}
-			}
+		return
+	}
+	recorder, _ := sc.watcher.(*syncRecorder)
+	err = s.checkpoints.save(s.worker, sc.tally(), *sc.st, recorder, done, func() error {
+		if file, ok := writer.(interface{ Sync() error }); ok {
+			return file.Sync()
 		}
+		return nil
+	})
+	if err == nil {
+		sc.dropRetired()
 	}
-
 	return
 }
 
-// missCheck handles misses on tokens
-// a missCheck can happen even when counts are at zero, so the reset return value indicates if a reset happened
-func (s AllReplacer) missCheck(thisByte byte, noWriteDepth int, myToken string, myCount *int, otherCount *int, id ...int) (backfill []byte) {
-	var miss bool
-	if thisByte == myToken[*myCount] {
-		*myCount += 1
-	} else {
-		miss = true
+// rules returns every rule the AllReplacer applies
+func (s AllReplacer) rules() []Rule {
+	if s.StartToken == "" && s.EndToken == "" {
+		return s.Rules
 	}
-	if miss && *myCount > 0 && noWriteDepth == 0 {
-		if otherCount == nil || *otherCount == 0 {
-			// Backfill for this miss.
-			backfill = []byte(myToken[0:*myCount])
-			util.Debug("%d: token '%s' missed on %s, need to backfill '%s'", id, myToken, string(thisByte), backfill)
-		} else {
-			util.Debug("%d: token '%s' missed on %s, but it partially matches other token, not backfilling", id, myToken, string(thisByte))
-		}
+	return append([]Rule{{StartToken: s.StartToken, EndToken: s.EndToken, Token: s.Token}}, s.Rules...)
+}
+
+// cleanup runs the configured reader and writer cleanups
+func (s AllReplacer) cleanup(id ...int) {
+	log := s.logger(id...)
+	if s.ReaderCleanup != nil {
+		log.Debug("running reader cleanup")
+		c := *s.ReaderCleanup
+		c()
 	}
-	if miss {
-		*myCount = 0
+	if s.WriterCleanup != nil {
+		log.Debug("running writer cleanup")
+		c := *s.WriterCleanup
+		c()
 	}
-	return
 }
 
-func (s AllReplacer) writeS(str string, writer io.Writer, id ...int) (wroteBytes int) {
-	return s.write([]byte(str), writer, id...)
-}
-func (s AllReplacer) write(ibytes []byte, writer io.Writer, id ...int) (wroteBytes int) {
-	if len(ibytes) > 0 {
-		var werr error
-		wroteBytes, werr = writer.Write(ibytes)
-		if werr != nil {
-			util.Error("%d: couldn't write bytes: %s", id, werr)
-		} else {
-			util.Debug("%d: wrote %d bytes: '%s'", id, wroteBytes, string(ibytes))
-		}
+// logger returns where the messages of the AllReplacer go, with the worker id when one is given
+func (s AllReplacer) logger(id ...int) *util.Log {
+	log := util.NewLog(s.Logger)
+	if len(id) > 0 {
+		log = log.With("worker", id[0])
 	}
-	return
+	return log
+}
+
+// SpawnReader will spawn a new io.Reader for the AllReplacer to read from.
+func (s AllReplacer) SpawnReader() (reader io.Reader, err error) {
+	return s.ReaderSpawner()
+}
+
+// SpawnWriter will spawn a new io.Writer for the AllReplacer to write to.
+func (s AllReplacer) SpawnWriter() (writer io.Writer, err error) {
+	return s.WriterSpawner()
 }
 
-func (s AllReplacer) fastForward(reader io.Reader) (err error) {
-	var rerr error
+// fastForward moves the reader to StartAt, seeking when the reader supports it
+func (s AllReplacer) fastForward(log *util.Log, reader io.Reader) (err error) {
 	if s.StartAt > 0 {
-		fastForward := make([]byte, s.StartAt)
-		_, rerr = reader.Read(fastForward)
-		if rerr != nil {
-			if rerr == io.EOF {
-				util.Debug("Fast forwarded past end of file: %s", rerr)
+		if seeker, ok := reader.(io.Seeker); ok {
+			_, err = seeker.Seek(s.StartAt, io.SeekCurrent)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, reader, s.StartAt)
+		}
+		if err != nil {
+			if err == io.EOF {
+				log.Debug("Fast forwarded past end of file: %s", err)
+				err = nil
 			} else {
-				util.Error("couldn't fast forward: %s", rerr)
+				log.Error("couldn't fast forward: %s", err)
 			}
-			err = rerr
 		}
-		// Deallocate this because we don't care
-		fastForward = nil
 	}
 	return
 }
-
-func removeLastIndexes(slice []byte, rcount int) []byte {
-	if len(slice) > 0 && rcount > 0 {
-		top := len(slice) - rcount
-		tcup := make([]byte, top)
-		copy(tcup, slice[0:top])
-		slice = tcup
-	}
-	return slice
-}
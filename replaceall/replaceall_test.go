@@ -2,17 +2,12 @@ package replaceall
 
 import (
 	"bytes"
-	"github.com/stipo42/stringaling/internal/util"
 	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 )
 
-func TestMain(m *testing.M) {
-	util.DEBUG = true
-	os.Exit(m.Run())
-}
-
 func TestReplaceAll_Short(t *testing.T) {
 	inputString := "Hello billy <kw> SPAM  </kw> this"
 	expectedString := "Hello billy CRACKS this"
@@ -323,7 +318,7 @@ CRACKS`
 		t.Errorf("unexpected error: %s", err)
 		t.Fail()
 	} else {
-		var c2 bool
+		var c2 Result
 		c2,err = strgr2.Replace()
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
@@ -334,11 +329,11 @@ CRACKS`
 				t.Errorf("expected\n'%s'\nbut got\n'%s'", expectedString, outputString)
 				t.Fail()
 			}
-			if !c1 {
+			if !c1.Confident {
 				t.Errorf("first replacement wasn't confident and should have been")
 				t.Fail()
 			}
-			if !c2 {
+			if !c2.Confident {
 				t.Errorf("second replacement wasn't confident and should have been")
 				t.Fail()
 			}
@@ -346,6 +341,198 @@ CRACKS`
 	}
 }
 
+func TestReplaceAll_BufferSizes(t *testing.T) {
+	inputString := `<kwHELLO 
+<kwTHIS
+IS
+A
+LARGE/kw>
+BLOCK OF TEXT REPLACE /kw> EVERYTHING BETWEEN THE <kw
+AND /kw> <k /k <<kw /kw>>
+
+<kw bannaana> banaba
+help
+</kw> and <kw never closed`
+	expectedString := `CRACKS EVERYTHING BETWEEN THE CRACKS <k /k <CRACKS>
+
+CRACKS and <kw never closed`
+	for _, size := range []int{1, 2, 3, 5, 64, 0} {
+		sw := bytes.NewBufferString("")
+		strgr := createReplacer(inputString, sw)
+		strgr.BufferSize = size
+		result, err := strgr.Replace()
+		if err != nil {
+			t.Errorf("buffer size %d: unexpected error: %s", size, err)
+			continue
+		}
+		outputString := sw.String()
+		if outputString != expectedString {
+			t.Errorf("buffer size %d: expected\n'%s'\nbut got\n'%s'", size, expectedString, outputString)
+		}
+		if result.Confident {
+			t.Errorf("buffer size %d: replacement was confident with an unterminated start token", size)
+		}
+	}
+}
+
+func TestReplaceAll_OverlappingMiss(t *testing.T) {
+	inputString := "xcab cd caab cd"
+	expectedString := "xcCRACKS caCRACKS"
+	sw := bytes.NewBufferString("")
+
+	strgr := createReplacer(inputString, sw)
+	strgr.StartToken = "ab"
+	strgr.EndToken = "cd"
+	_, err := strgr.Replace()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		t.Fail()
+	} else {
+		outputString := sw.String()
+		if outputString != expectedString {
+			t.Errorf("expected\n'%s'\nbut got\n'%s'", expectedString, outputString)
+			t.Fail()
+		}
+	}
+}
+
+func TestReplaceAll_SameTokenUnterminated(t *testing.T) {
+	inputString := "Hello billy <kw> SPAM <kw> this <kw> is left"
+	expectedString := "Hello billy CRACKS this <kw> is left"
+	sw := bytes.NewBufferString("")
+
+	strgr := createReplacer(inputString, sw)
+	strgr.StartToken = "<kw>"
+	strgr.EndToken = "<kw>"
+	_, err := strgr.Replace()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		t.Fail()
+	} else {
+		outputString := sw.String()
+		if outputString != expectedString {
+			t.Errorf("expected\n'%s'\nbut got\n'%s'", expectedString, outputString)
+			t.Fail()
+		}
+	}
+}
+
+func TestReplaceAll_Spool(t *testing.T) {
+	inputString := "Hello <kw> SPAM SPAM SPAM </kw> billy <kw> more <kw> nested /kw> never closed /k"
+	expectedString := "Hello CRACKS billy <kw> more <kw> nested /kw> never closed /k"
+	spoolDir, err := ioutil.TempDir("", "stringaling_test_")
+	if err != nil {
+		t.Fatalf("could not create spool directory: %s", err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	for _, threshold := range []int64{1, 3, 8, 1024} {
+		sw := bytes.NewBufferString("")
+		strgr := createReplacer(inputString, sw)
+		strgr.StartToken = "<kw>"
+		strgr.EndToken = "</kw>"
+		strgr.BufferSize = 4
+		strgr.SpoolThreshold = threshold
+		strgr.SpoolDir = spoolDir
+		result, err := strgr.Replace()
+		if err != nil {
+			t.Errorf("threshold %d: unexpected error: %s", threshold, err)
+			continue
+		}
+		outputString := sw.String()
+		if outputString != expectedString {
+			t.Errorf("threshold %d: expected\n'%s'\nbut got\n'%s'", threshold, expectedString, outputString)
+		}
+		if result.Confident {
+			t.Errorf("threshold %d: replacement was confident with an unterminated start token", threshold)
+		}
+		left, _ := ioutil.ReadDir(spoolDir)
+		if len(left) > 0 {
+			t.Errorf("threshold %d: %d spool files were left behind", threshold, len(left))
+		}
+	}
+}
+
+func TestReplaceAll_Rules(t *testing.T) {
+	inputString := "a <phi> <ssn>1</ssn> <phi>x</phi> </phi> b <ssn>2 <phi> </ssn> c |dob| 3 |dob| d </phi> </ssn> <ss"
+	expectedString := "a [phi] b [ssn] c [dob] d </phi> </ssn> <ss"
+	sw := bytes.NewBufferString("")
+
+	strgr := createReplacer(inputString, sw)
+	strgr.StartToken = ""
+	strgr.EndToken = ""
+	strgr.Rules = []Rule{
+		{StartToken: "<phi>", EndToken: "</phi>", Token: "[phi]"},
+		{StartToken: "<ssn>", EndToken: "</ssn>", Token: "[ssn]"},
+		{StartToken: "|dob|", EndToken: "|dob|", Token: "[dob]"},
+	}
+	result, err := strgr.Replace()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		t.Fail()
+	} else {
+		outputString := sw.String()
+		if outputString != expectedString {
+			t.Errorf("expected\n'%s'\nbut got\n'%s'", expectedString, outputString)
+			t.Fail()
+		}
+		if result.Confident {
+			t.Errorf("replacement was confident with a partial start token at the end")
+			t.Fail()
+		}
+		expectedResult := Result{
+			Replacements: 3,
+			BytesRead:    int64(len(inputString)),
+			BytesWritten: int64(len(expectedString)),
+			BytesRemoved: int64(len(inputString) - len(expectedString) + 3*len("[phi]")),
+			MaxDepth:     2,
+			Passes:       1,
+			Threads:      1,
+		}
+		result.Duration = 0
+		if result != expectedResult {
+			t.Errorf("expected result\n%+v\nbut got\n%+v", expectedResult, result)
+		}
+	}
+}
+
+func TestReplaceAll_RulesAfterTokens(t *testing.T) {
+	inputString := "Hello <kw> SPAM /kw> billy <phi> SSN </phi> this"
+	expectedString := "Hello CRACKS billy PHI this"
+	sw := bytes.NewBufferString("")
+
+	strgr := createReplacer(inputString, sw)
+	strgr.Rules = []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "PHI"}}
+	_, err := strgr.Replace()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		t.Fail()
+	} else {
+		outputString := sw.String()
+		if outputString != expectedString {
+			t.Errorf("expected\n'%s'\nbut got\n'%s'", expectedString, outputString)
+			t.Fail()
+		}
+	}
+}
+
+func TestReplaceAll_RulesInvalid(t *testing.T) {
+	sw := bytes.NewBufferString("")
+	strgr := createReplacer("Hello <kw> billy", sw)
+	strgr.Rules = []Rule{{StartToken: "<kw", EndToken: "</kw>"}}
+	_, err := strgr.Replace()
+	if err == nil {
+		t.Errorf("expected an error for a start token used by two rules")
+		t.Fail()
+	}
+	strgr.Rules = []Rule{{StartToken: "<phi>"}}
+	_, err = strgr.Replace()
+	if err == nil {
+		t.Errorf("expected an error for an empty end token")
+		t.Fail()
+	}
+}
+
 func createReplacer(inputString string, output io.Writer) AllReplacer {
 
 	strgr := AllReplacer{
@@ -366,3 +553,39 @@ func createReplacer(inputString string, output io.Writer) AllReplacer {
 
 	return strgr
 }
+
+func BenchmarkReplace_Fixture(b *testing.B) {
+	input, err := benchmarkInput()
+	if err != nil {
+		b.Fatalf("could not build benchmark input: %s", err)
+	}
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		strgr := AllReplacer{
+			StartToken: "<phi>",
+			EndToken:   "</phi>",
+			Token:      "<redacted></redacted>",
+			GoUntil:    int64(len(input)),
+		}
+		strgr.ReaderSpawner = func() (io.Reader, error) {
+			return bytes.NewReader(input), nil
+		}
+		strgr.WriterSpawner = func() (io.Writer, error) {
+			return ioutil.Discard, nil
+		}
+		_, err = strgr.Replace()
+		if err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+// benchmarkInput repeats the TestReplaceAll input fixture to a size worth measuring
+func benchmarkInput() ([]byte, error) {
+	fixture, err := ioutil.ReadFile("testdata/TestReplaceAll-input.xml")
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Repeat(fixture, 2000), nil
+}
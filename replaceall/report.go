@@ -0,0 +1,130 @@
+package replaceall
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+// The kinds of Match
+const (
+	MatchRule         = "rule"         // A rule's region, from its start token through its end token
+	MatchNeedle       = "needle"       // An occurrence of a substitution's needle
+	MatchUnterminated = "unterminated" // A rule's start token that is never closed, up to the end of the input, left as is
+	MatchElement      = "element"      // An XML element, from its start tag through its end tag
+	MatchField        = "field"        // A JSON value, or a member or element it is dropped with
+)
+
+// Match is a part of the input that a run replaces, or that a rule leaves unterminated
+type Match struct {
+	Kind   string `json:"kind"`
+	Index  int    `json:"index"`          // The index of the rule, element or field, or of the substitution for a needle
+	Name   string `json:"name,omitempty"` // The name of the rule, the needle, or the name or path of the element or field
+	Offset int64  `json:"offset"`         // The offset of the first byte of the match in the input
+	Length int64  `json:"length"`
+}
+
+// Report summarizes what a run replaces
+type Report struct {
+	Regions      int64   `json:"regions"`      // The rule regions, XML elements or JSON fields replaced
+	RegionBytes  int64   `json:"regionBytes"`  // The input bytes in those regions, tokens included
+	Needles      int64   `json:"needles"`      // The needles substituted
+	NeedleBytes  int64   `json:"needleBytes"`  // The input bytes in those needles
+	PerRule      []int64 `json:"perRule"`      // The regions replaced by each rule, or each XML element or JSON field
+	PerNeedle    []int64 `json:"perNeedle"`    // The needles substituted for each substitution
+	Unterminated []Match `json:"unterminated"` // The replacements that were never closed, they are written as is
+}
+
+// add counts m in the report
+func (r *Report) add(m Match) {
+	switch m.Kind {
+	case MatchRule, MatchElement, MatchField:
+		r.Regions++
+		r.RegionBytes += m.Length
+		r.PerRule[m.Index]++
+	case MatchNeedle:
+		r.Needles++
+		r.NeedleBytes += m.Length
+		r.PerNeedle[m.Index]++
+	case MatchUnterminated:
+		r.Unterminated = append(r.Unterminated, m)
+	}
+}
+
+// DryRun reads the input file, or stdin when it is "-", and reports what ReplaceAllWith would replace
+// without writing any output. When matches is not nil every match is written to it as a line of JSON.
+// The input is matched exactly as a real run would match it, but always with a single thread.
+func DryRun(inputFileName string, opts Options, matches io.Writer) (report Report, err error) {
+	return DryRunContext(context.Background(), inputFileName, opts, matches)
+}
+
+// DryRunContext is DryRun stopping as soon as ctx is done, in which case ctx.Err() is returned
+func DryRunContext(ctx context.Context, inputFileName string, opts Options, matches io.Writer) (report Report, err error) {
+	strgr := AllReplacer{
+		Rules:            opts.Rules,
+		Substitutions:    opts.Substitutions,
+		Elements:         opts.Elements,
+		Fields:           opts.Fields,
+		NDJSON:           opts.NDJSON,
+		OnProgress:       opts.OnProgress,
+		ProgressInterval: opts.ProgressInterval,
+		Logger:           opts.Logger,
+		dryRun:           true,
+	}
+	log := util.NewLog(opts.Logger)
+	strgr.automata, err = compile(strgr.rules(), strgr.Substitutions, strgr.Elements, strgr.Fields)
+	if err != nil {
+		log.Error("invalid rules: %s", err)
+		return
+	}
+	var input io.Reader
+	var inputFile *os.File
+	input, inputFile, err = openStream(inputFileName, &opts)
+	if err != nil {
+		return
+	}
+	if inputFile != os.Stdin {
+		defer inputFile.Close()
+		if stats, serr := inputFile.Stat(); serr == nil && stats.Mode().IsRegular() {
+			strgr.InputSize = stats.Size()
+		}
+	}
+	strgr.InputCompression = opts.InputCompression
+	strgr.InputEncoding = opts.InputEncoding
+
+	report.PerRule = make([]int64, len(strgr.rules())+len(strgr.Elements)+len(strgr.Fields))
+	report.PerNeedle = make([]int64, len(strgr.Substitutions))
+	var bw *bufio.Writer
+	var encoder *json.Encoder
+	var eerr error
+	if matches != nil {
+		bw = bufio.NewWriter(matches)
+		encoder = json.NewEncoder(bw)
+	}
+	strgr.OnMatch = func(m Match) {
+		report.add(m)
+		if encoder != nil && eerr == nil {
+			eerr = encoder.Encode(m)
+		}
+	}
+	strgr.ReaderSpawner = func() (io.Reader, error) {
+		return input, nil
+	}
+	strgr.WriterSpawner = func() (io.Writer, error) {
+		return ioutil.Discard, nil
+	}
+	_, err = strgr.ReplaceContext(ctx)
+	if bw != nil && eerr == nil {
+		eerr = bw.Flush()
+	}
+	if err == nil && eerr != nil {
+		log.Error("couldn't write matches: %s", eerr)
+		err = eerr
+	}
+	return
+}
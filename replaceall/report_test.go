@@ -0,0 +1,80 @@
+package replaceall
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	inputString := "a <phi>x</phi> b <phi>y<phi>z</phi></phi> c </phi> CUST d <phi>never"
+	inputFileName := "testdata/results/dry-run-input.txt"
+
+	err := os.MkdirAll("testdata/results", 0755)
+	if err != nil {
+		t.Fatalf("could not create results directory: %s", err)
+	}
+	err = ioutil.WriteFile(inputFileName, []byte(inputString), 0644)
+	if err != nil {
+		t.Fatalf("could not write input file (%s): %s", inputFileName, err)
+	}
+	opts := Options{
+		Rules:         []Rule{{Name: "phi", StartToken: "<phi>", EndToken: "</phi>", Token: "X"}},
+		Substitutions: []Substitution{{Needle: "CUST", Replacement: "C"}},
+	}
+	var matches bytes.Buffer
+	report, err := DryRun(inputFileName, opts, &matches)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expectedMatches := []Match{
+		{Kind: MatchRule, Name: "phi", Offset: 2, Length: 12},
+		{Kind: MatchRule, Name: "phi", Offset: 17, Length: 24},
+		{Kind: MatchNeedle, Name: "CUST", Offset: 51, Length: 4},
+		{Kind: MatchUnterminated, Name: "phi", Offset: 58, Length: 10},
+	}
+	var actualMatches []Match
+	decoder := json.NewDecoder(&matches)
+	for decoder.More() {
+		var m Match
+		err = decoder.Decode(&m)
+		if err != nil {
+			t.Fatalf("could not decode match: %s", err)
+		}
+		actualMatches = append(actualMatches, m)
+	}
+	if !reflect.DeepEqual(actualMatches, expectedMatches) {
+		t.Errorf("expected matches\n%v\nbut got\n%v", expectedMatches, actualMatches)
+	}
+	expectedReport := Report{
+		Regions:      2,
+		RegionBytes:  36,
+		Needles:      1,
+		NeedleBytes:  4,
+		PerRule:      []int64{2},
+		PerNeedle:    []int64{1},
+		Unterminated: expectedMatches[3:],
+	}
+	if !reflect.DeepEqual(report, expectedReport) {
+		t.Errorf("expected report\n%+v\nbut got\n%+v", expectedReport, report)
+	}
+
+	// The report lines up with what a real run writes
+	outputFileName := "testdata/results/dry-run-output.txt"
+	_, err = ReplaceAllWith(inputFileName, outputFileName, opts)
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	output, err := quickRead(outputFileName)
+	if err != nil {
+		t.Fatalf("could not read output file (%s): %s", outputFileName, err)
+	}
+	expectedSize := int64(len(inputString)) - report.RegionBytes + report.Regions*1 - report.NeedleBytes + report.Needles*1
+	if int64(len(output)) != expectedSize {
+		t.Errorf("expected an output of %d bytes but got %d: %s", expectedSize, len(output), output)
+	}
+}
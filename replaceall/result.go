@@ -0,0 +1,90 @@
+package replaceall
+
+import "time"
+
+// Result is what a replacement did
+type Result struct {
+	Replacements  int64 `json:"replacements"`  // The regions replaced by rules, or the XML elements or JSON fields replaced
+	Substitutions int64 `json:"substitutions"` // The needles substituted
+	BytesRead     int64 `json:"bytesRead"`     // The input bytes read, after any decompression
+	BytesWritten  int64 `json:"bytesWritten"`  // The output bytes written, before any compression
+	BytesRemoved  int64 `json:"bytesRemoved"`  // The input bytes in the replaced regions and needles, tokens included
+	Unterminated  int64 `json:"unterminated"`  // The replacements never closed, their bytes were written as is
+	MaxDepth      int   `json:"maxDepth"`      // The deepest a rule's start tokens were nested
+	Passes        int   `json:"passes"`
+	Threads       int   `json:"threads"`
+	// Confident is false when the input ended inside a replacement or a token,
+	// which usually means the start and end tokens did not pair up.
+	Confident bool          `json:"confident"`
+	Duration  time.Duration `json:"durationNs"`
+}
+
+// tally is what a scan has counted up to a position
+type tally struct {
+	read          int64
+	written       int64
+	replacements  int64
+	substitutions int64
+	removed       int64
+	maxDepth      int
+	recentDepth   int // The deepest nesting since the previous tally handed to a syncWatcher
+}
+
+// nested records that a replacement is open at depth
+func (t *tally) nested(depth int) {
+	if depth > t.maxDepth {
+		t.maxDepth = depth
+	}
+	if depth > t.recentDepth {
+		t.recentDepth = depth
+	}
+}
+
+// since returns the counts added after earlier was taken, the depths are not subtracted
+func (t tally) since(earlier tally) tally {
+	t.read -= earlier.read
+	t.written -= earlier.written
+	t.replacements -= earlier.replacements
+	t.substitutions -= earlier.substitutions
+	t.removed -= earlier.removed
+	return t
+}
+
+// add adds the counts of o to t
+func (t *tally) add(o tally) {
+	t.read += o.read
+	t.written += o.written
+	t.replacements += o.replacements
+	t.substitutions += o.substitutions
+	t.removed += o.removed
+	t.nested(o.maxDepth)
+}
+
+// result fills in the counts of a Result
+func (t tally) result() Result {
+	return Result{
+		Replacements:  t.replacements,
+		Substitutions: t.substitutions,
+		BytesRead:     t.read,
+		BytesWritten:  t.written,
+		BytesRemoved:  t.removed,
+		MaxDepth:      t.maxDepth,
+	}
+}
+
+// add adds the counts of o to r, r is only Confident while o is too
+func (r *Result) add(o Result) {
+	r.Replacements += o.Replacements
+	r.Substitutions += o.Substitutions
+	r.BytesRead += o.BytesRead
+	r.BytesWritten += o.BytesWritten
+	r.BytesRemoved += o.BytesRemoved
+	r.Unterminated += o.Unterminated
+	if o.MaxDepth > r.MaxDepth {
+		r.MaxDepth = o.MaxDepth
+	}
+	if o.Passes > r.Passes {
+		r.Passes = o.Passes
+	}
+	r.Confident = r.Confident && o.Confident
+}
@@ -0,0 +1,145 @@
+package replaceall
+
+import "fmt"
+
+// Rule replaces everything from StartToken to EndToken, including both tokens, with Token.
+//
+// When several rules are applied in the same pass:
+//   - while no replacement is open, the first start token to be completed opens its rule's replacement,
+//     if several are completed by the same byte the longest wins
+//   - while a replacement is open only its own rule's tokens count, its start token nests and its end token closes,
+//     the tokens of every other rule are just part of what is being replaced
+//   - an end token found while no replacement is open is written back as is
+//
+// So replacements of different rules never overlap, the outermost one decides the replacement token.
+//
+// Fold and Normalize widen what the start and end tokens match, the input is still written as it was.
+// A token matches wherever its characters do, a combining mark right after it is not looked at.
+//
+// With Regex the start and end tokens are regular expressions, in the syntax of package regexp, that match at most
+// MaxLength bytes, so no more than that is ever held back for a token in progress. A token is found as soon as
+// a match of it ends, the longest match ending there wins, and anything longer than MaxLength is not a match.
+// Anchors and word boundaries cannot be told in a stream and are not supported, (?i) folds case.
+// The tokens are matched with an automaton built before the input is read, an expression that needs too many states,
+// such as a long bounded repeat of characters that can also start it, is an error.
+type Rule struct {
+	Name       string // An optional name for the rule, used in messages
+	StartToken string
+	EndToken   string
+	Token      string
+	Fold       CaseFold      // How the tokens match letters of another case, exactly when empty
+	Normalize  Normalization // The normalization form the tokens match under, none when empty
+	Regex      bool          // The start and end tokens are regular expressions
+	MaxLength  int           // The most bytes a regular expression token matches, required with Regex
+}
+
+// sameTokens reports whether the start and end tokens match the same text, the rule then toggles rather than nests
+func (rule Rule) sameTokens() bool {
+	if rule.Regex {
+		return rule.StartToken == rule.EndToken
+	}
+	return tokenKey(rule.StartToken, rule.Fold, rule.Normalize) == tokenKey(rule.EndToken, rule.Fold, rule.Normalize)
+}
+
+// patterns returns the patterns of the start and end tokens
+func (rule Rule) patterns() (start *pattern, end *pattern, err error) {
+	if !rule.Regex {
+		return compilePattern(rule.StartToken, rule.Fold, rule.Normalize), compilePattern(rule.EndToken, rule.Fold, rule.Normalize), nil
+	}
+	start, err = regexPattern(rule.StartToken, rule.MaxLength)
+	if err == nil {
+		end, err = regexPattern(rule.EndToken, rule.MaxLength)
+	}
+	return
+}
+
+// label returns how rule r is referred to in messages
+func (rule Rule) label(r int) string {
+	if rule.Name != "" {
+		return fmt.Sprintf("rule %d (%s)", r, rule.Name)
+	}
+	return fmt.Sprintf("rule %d", r)
+}
+
+// Substitution replaces every occurrence of Needle with Replacement.
+// When applied together with rules, a needle is only looked for while no replacement is open.
+type Substitution struct {
+	Needle      string
+	Replacement string
+}
+
+// validate checks what a run replaces, rules and substitutions, XML elements or JSON fields
+func validate(rules []Rule, subs []Substitution, elements []Element, fields []Field) error {
+	_, err := compile(rules, subs, elements, fields)
+	return err
+}
+
+// compile checks what a run replaces as validate does, returning the automata its rules and substitutions are
+// matched with, nil for XML elements or JSON fields
+func compile(rules []Rule, subs []Substitution, elements []Element, fields []Field) (*ruleAutomata, error) {
+	if len(fields) > 0 {
+		return nil, validateFields(fields, rules, subs, elements)
+	}
+	if len(elements) > 0 {
+		return nil, validateElements(elements, rules, subs)
+	}
+	return compileRules(rules, subs)
+}
+
+// validateRules checks that rules and substitutions can be applied together
+func validateRules(rules []Rule, subs []Substitution) error {
+	_, err := compileRules(rules, subs)
+	return err
+}
+
+// compileRules checks rules and substitutions as validateRules does, returning the automata they are matched with
+func compileRules(rules []Rule, subs []Substitution) (*ruleAutomata, error) {
+	if len(rules) == 0 && len(subs) == 0 {
+		return nil, fmt.Errorf("no rules given")
+	}
+	needles := make(map[string]int)
+	for n, sub := range subs {
+		if sub.Needle == "" {
+			return nil, fmt.Errorf("needle %d cannot be empty", n)
+		}
+		if o, ok := needles[sub.Needle]; ok {
+			return nil, fmt.Errorf("needle %d: '%s' is already used by needle %d", n, sub.Needle, o)
+		}
+		needles[sub.Needle] = n
+	}
+	starts := make(map[string]int)
+	canonical := make([]Rule, 0, len(rules))
+	for r, rule := range rules {
+		if rule.StartToken == "" {
+			return nil, fmt.Errorf("%s: start token cannot be empty", rule.label(r))
+		}
+		if rule.EndToken == "" {
+			return nil, fmt.Errorf("%s: end token cannot be empty", rule.label(r))
+		}
+		// The tokens are matched under the constants, however their names were spelled
+		var err error
+		rule.Fold, err = ParseCaseFold(string(rule.Fold))
+		if err == nil {
+			rule.Normalize, err = ParseNormalization(string(rule.Normalize))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", rule.label(r), err)
+		}
+		if rule.Regex {
+			if rule.Fold != FoldNone || rule.Normalize != NormalizeNone {
+				return nil, fmt.Errorf("%s: a regular expression cannot be folded or normalized, use (?i) to fold case", rule.label(r))
+			}
+		} else if rule.MaxLength != 0 {
+			return nil, fmt.Errorf("%s: a maximum match length is only for regular expressions", rule.label(r))
+		}
+		if o, ok := starts[rule.StartToken]; ok {
+			return nil, fmt.Errorf("%s: start token '%s' is already used by %s", rule.label(r), rule.StartToken, rules[o].label(o))
+		}
+		if n, ok := needles[rule.StartToken]; ok {
+			return nil, fmt.Errorf("%s: start token '%s' is also used by needle %d", rule.label(r), rule.StartToken, n)
+		}
+		starts[rule.StartToken] = r
+		canonical = append(canonical, rule)
+	}
+	return newRuleAutomata(canonical, subs)
+}
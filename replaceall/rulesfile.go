@@ -0,0 +1,163 @@
+package replaceall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// RulesVersion is the version of the rules file format this build reads
+const RulesVersion = 1
+
+// rulesFile is the layout of a rules file, for example in YAML
+//
+//	version: 1
+//	rules:
+//	  - name: ssn
+//	    start: '<ssn type="x">'
+//	    end: '</ssn>'
+//	    replace: '<ssn/>'
+//	  - start: '\t<dob>'
+//	    end: '</dob>\n'
+//	    escapes: true
+//	  - start: '<phi>'
+//	    end: '</phi>'
+//	    fold: unicode
+//	    normalize: nfkc
+//	  - start: '<phi[^>]*>'
+//	    end: '</phi\s*>'
+//	    regex: true
+//	    maxLength: 4096
+type rulesFile struct {
+	Version int         `json:"version" yaml:"version" toml:"version"`
+	Rules   []ruleEntry `json:"rules" yaml:"rules" toml:"rules"`
+}
+
+// ruleEntry is a single rule in a rules file
+type ruleEntry struct {
+	Name    string `json:"name" yaml:"name" toml:"name"`
+	Start   string `json:"start" yaml:"start" toml:"start"`
+	End     string `json:"end" yaml:"end" toml:"end"`
+	Replace string `json:"replace" yaml:"replace" toml:"replace"`
+	// When set, backslash escape sequences such as \n, \t, \x00 and \u00e9 in the tokens are interpreted
+	Escapes bool `json:"escapes" yaml:"escapes" toml:"escapes"`
+	// How the tokens match, as for the Fold and Normalize of a Rule: none, ascii or unicode and none, nfc or nfkc
+	Fold      string `json:"fold" yaml:"fold" toml:"fold"`
+	Normalize string `json:"normalize" yaml:"normalize" toml:"normalize"`
+	// When set, the start and end are regular expressions matching at most maxLength bytes,
+	// escapes then only apply to the replacement
+	Regex     bool `json:"regex" yaml:"regex" toml:"regex"`
+	MaxLength int  `json:"maxLength" yaml:"maxLength" toml:"maxLength"`
+}
+
+// LoadRules reads and validates the rules in a YAML (.yaml, .yml), JSON (.json) or TOML (.toml) rules file,
+// the format is chosen by the file extension.
+func LoadRules(fileName string) (rules []Rule, err error) {
+	var content []byte
+	content, err = ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	rules, err = ParseRules(content, filepath.Ext(fileName))
+	if err != nil {
+		err = fmt.Errorf("%s: %s", fileName, err)
+	}
+	return
+}
+
+// ParseRules parses and validates rules in the format given by a file extension such as ".yaml"
+func ParseRules(content []byte, ext string) (rules []Rule, err error) {
+	var rf rulesFile
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		dec.KnownFields(true)
+		err = dec.Decode(&rf)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&rf)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(content), &rf)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown field %s", md.Undecoded()[0])
+		}
+	default:
+		err = fmt.Errorf("unknown rules file format '%s', expected .yaml, .yml, .json or .toml", ext)
+	}
+	if err != nil {
+		return
+	}
+
+	if rf.Version == 0 {
+		err = fmt.Errorf("missing version, expected version %d", RulesVersion)
+		return
+	}
+	if rf.Version != RulesVersion {
+		err = fmt.Errorf("unsupported version %d, expected version %d", rf.Version, RulesVersion)
+		return
+	}
+	for r, entry := range rf.Rules {
+		rule := Rule{
+			Name:       entry.Name,
+			StartToken: entry.Start,
+			EndToken:   entry.End,
+			Token:      entry.Replace,
+			Regex:      entry.Regex,
+			MaxLength:  entry.MaxLength,
+		}
+		rule.Fold, err = ParseCaseFold(entry.Fold)
+		if err == nil {
+			rule.Normalize, err = ParseNormalization(entry.Normalize)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %s", rule.label(r), err)
+			return
+		}
+		if entry.Escapes {
+			if !entry.Regex {
+				rule.StartToken, err = unescape(entry.Start)
+				if err == nil {
+					rule.EndToken, err = unescape(entry.End)
+				}
+			}
+			if err == nil {
+				rule.Token, err = unescape(entry.Replace)
+			}
+			if err != nil {
+				err = fmt.Errorf("%s: invalid escape sequence: %s", rule.label(r), err)
+				return
+			}
+		}
+		rules = append(rules, rule)
+	}
+	err = validateRules(rules, nil)
+	return
+}
+
+// unescape interprets the backslash escape sequences in s the way a Go string literal would,
+// quotes do not need to be escaped.
+func unescape(s string) (string, error) {
+	var sb strings.Builder
+	for len(s) > 0 {
+		value, multibyte, tail, err := strconv.UnquoteChar(s, 0)
+		if err != nil {
+			return "", err
+		}
+		if multibyte {
+			sb.WriteRune(value)
+		} else {
+			sb.WriteByte(byte(value))
+		}
+		s = tail
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,47 @@
+package replaceall
+
+import (
+	"testing"
+)
+
+func TestLoadRules(t *testing.T) {
+	expected := []Rule{
+		{Name: "ssn", StartToken: `<ssn type="x">`, EndToken: "</ssn>", Token: "<ssn/>"},
+		{Name: "dob", StartToken: "\t<dob>", EndToken: "</dob>\n", Token: "\t<dob/>\n"},
+		{Name: "phi", StartToken: "<phi>", EndToken: "</phi>", Fold: FoldUnicode, Normalize: NFKC},
+		{Name: "id", StartToken: `<id[^>]*>`, EndToken: `</id\s*>`, Token: "<id/>\n", Regex: true, MaxLength: 256},
+	}
+	for _, fileName := range []string{"testdata/rules.yaml", "testdata/rules.json", "testdata/rules.toml"} {
+		rules, err := LoadRules(fileName)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", fileName, err)
+			continue
+		}
+		if len(rules) != len(expected) {
+			t.Errorf("%s: expected %d rules but got %d", fileName, len(expected), len(rules))
+			continue
+		}
+		for r := range expected {
+			if rules[r] != expected[r] {
+				t.Errorf("%s: expected rule %d to be %+v but got %+v", fileName, r, expected[r], rules[r])
+			}
+		}
+	}
+}
+
+func TestLoadRules_Invalid(t *testing.T) {
+	for _, fileName := range []string{
+		"testdata/rules-invalid.yaml",
+		"testdata/rules-unknown.json",
+		"testdata/rules-version.toml",
+		"testdata/TestReplaceAll-input.xml",
+		"testdata/missing.yaml",
+	} {
+		_, err := LoadRules(fileName)
+		if err == nil {
+			t.Errorf("%s: expected an error", fileName)
+		} else {
+			t.Logf("%s: %s", fileName, err)
+		}
+	}
+}
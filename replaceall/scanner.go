@@ -0,0 +1,374 @@
+package replaceall
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+// The patterns of a rule's inner automaton, a rule whose start and end tokens are the same only has the start pattern
+const (
+	startPattern = 0
+	endPattern   = 1
+)
+
+// scanner is the matching engine behind AllReplacer.
+// It consumes its input in blocks of any size, passing runs of bytes that cannot
+// be part of a token straight through, and only steps byte by byte while a token
+// may be in progress.
+type scanner struct {
+	rules    []Rule
+	subs     []Substitution
+	outer    *automaton   // Matches every token while no replacement is open, start tokens first, then needles, then end tokens
+	inner    []*automaton // Matches the tokens of a single rule while its replacement is open
+	auto     *automaton   // The automaton in use
+	spoolAt  int64        // Spool skipped bytes once more than this many are held in memory, zero never spools
+	spoolDir string
+	dryRun   bool
+	st       *matchState
+	state    int32 // The automaton state, always the state for the last st.partial bytes seen
+	out      io.Writer
+	pos      int64 // The bytes consumed so far
+	base     int64 // The offset of the first byte consumed, so matches are reported with input offsets
+	onMatch  func(m Match)
+	written  int64 // The bytes written so far
+	counts   tally // Everything else counted so far
+	watcher  syncWatcher
+	stopped  bool
+	log      *util.Log
+	// Spool files are kept until the next checkpoint no longer refers to them
+	keepSpills bool
+	retired    []string
+}
+
+// newScanner creates a scanner for the rules of s writing to out, resuming from st
+func newScanner(s AllReplacer, st *matchState, out io.Writer, watcher syncWatcher, id ...int) *scanner {
+	sc := &scanner{
+		rules:    s.rules(),
+		subs:     s.Substitutions,
+		spoolAt:  s.SpoolThreshold,
+		spoolDir: s.SpoolDir,
+		dryRun:   s.dryRun,
+		base:     s.StartAt - s.from.read,
+		pos:      s.from.read,
+		written:  s.from.written,
+		counts:   s.from,
+		onMatch:  s.OnMatch,
+		st:       st,
+		out:      out,
+		watcher:  watcher,
+		log:      s.logger(id...),
+	}
+	// The automata were built when the rules were validated
+	sc.outer, sc.inner = s.automata.outer, s.automata.inner
+	sc.auto = sc.outer
+	if st.depth > 0 {
+		sc.auto = sc.inner[st.rule]
+	}
+	if st.partial > 0 {
+		sc.state = sc.auto.walk(st.pending[len(st.pending)-st.partial:])
+	}
+	sc.keepSpills = s.checkpoints != nil
+	return sc
+}
+
+// ruleAutomata are the automata a scanner matches the rules and substitutions of a run with.
+// They are only read while scanning, so they are built once for a run and shared by all of its workers.
+type ruleAutomata struct {
+	outer *automaton
+	inner []*automaton
+}
+
+// newRuleAutomata builds the automata of rules and substitutions, tokens that are too complex to match are an error
+func newRuleAutomata(rules []Rule, subs []Substitution) (ra *ruleAutomata, err error) {
+	ra = &ruleAutomata{}
+	var starts, ends []*pattern
+	for r, rule := range rules {
+		var start, end *pattern
+		start, end, err = rule.patterns()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", rule.label(r), err)
+		}
+		starts = append(starts, start)
+		var inner *automaton
+		if rule.sameTokens() {
+			inner, err = newAutomaton(start)
+		} else {
+			ends = append(ends, end)
+			inner, err = newAutomaton(start, end)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: its tokens are %s", rule.label(r), err)
+		}
+		ra.inner = append(ra.inner, inner)
+	}
+	var needles []*pattern
+	for _, sub := range subs {
+		needles = append(needles, literalPattern(sub.Needle))
+	}
+	ra.outer, err = newAutomaton(append(append(starts, needles...), ends...)...)
+	if err != nil {
+		return nil, fmt.Errorf("the tokens of every rule together are %s", err)
+	}
+	return
+}
+
+// scan consumes p, it stops early once the watcher asks it to
+func (sc *scanner) scan(p []byte) (err error) {
+	st := sc.st
+	for len(p) > 0 && !sc.stopped {
+		if sc.state == 0 {
+			n := sc.auto.skip(p)
+			if n > 0 {
+				if st.depth == 0 {
+					if sc.watcher != nil {
+						// Never run past the position the watcher is waiting on
+						if lim := sc.watcher.next() - sc.pos; lim > 0 && lim < int64(n) {
+							n = int(lim)
+						}
+					}
+					err = sc.write(p[:n])
+					if err != nil {
+						return
+					}
+				} else {
+					st.region += int64(n)
+					err = sc.skip(p[:n])
+					if err != nil {
+						return
+					}
+				}
+				sc.pos += int64(n)
+				p = p[n:]
+				sc.check()
+				continue
+			}
+		}
+
+		c := p[0]
+		p = p[1:]
+		sc.pos++
+		if st.depth > 0 {
+			st.region++
+		}
+		sc.state = sc.auto.trans[sc.state][c]
+		st.pending = append(st.pending, c)
+		// A partial token is at most a byte longer than the last one, which the state alone cannot tell once
+		// a token can be made of byte strings of different lengths
+		partial := st.partial + 1
+		if m, tlen := sc.auto.longest(sc.state, st.pending[len(st.pending)-partial:]); m >= 0 {
+			err = sc.matched(m, tlen)
+		} else {
+			st.partial = sc.auto.depth[sc.state]
+			if st.partial > partial {
+				st.partial = partial
+			}
+			if st.partial > 2*sc.auto.limit {
+				// A token with loops is only held back as far as it can still be short enough to match
+				st.partial = sc.auto.limit
+				sc.state = sc.auto.walk(st.pending[len(st.pending)-st.partial:])
+			}
+			if st.depth > 0 {
+				err = sc.skip(nil)
+			} else if len(st.pending) > st.partial {
+				// Backfill whatever can no longer be part of a token
+				release := len(st.pending) - st.partial
+				sc.log.Debug("token missed, backfilling '%s'", string(st.pending[:release]))
+				err = sc.write(st.pending[:release])
+				st.pending = st.pending[:copy(st.pending, st.pending[release:])]
+			}
+		}
+		if err != nil {
+			return
+		}
+		sc.check()
+	}
+	return
+}
+
+// matched handles the token m having just been read, its tlen bytes are the last of st.pending
+func (sc *scanner) matched(m int, tlen int) (err error) {
+	st := sc.st
+	sc.state = 0
+	st.partial = 0
+	if st.depth == 0 {
+		if m < len(sc.rules) {
+			// Everything before the token is written, the token itself is held back in case this never finishes
+			err = sc.write(st.pending[:len(st.pending)-tlen])
+			st.pending = st.pending[:copy(st.pending, st.pending[len(st.pending)-tlen:])]
+			st.depth = 1
+			st.rule = m
+			st.openedAt = sc.base + sc.pos - int64(tlen)
+			st.region = int64(tlen)
+			sc.counts.nested(st.depth)
+			sc.auto = sc.inner[m]
+			sc.log.Debug("start token of rule %d found at %d", m, sc.pos-int64(tlen))
+		} else if n := m - len(sc.rules); n < len(sc.subs) {
+			// Everything before the needle is written, then its replacement
+			err = sc.write(st.pending[:len(st.pending)-tlen])
+			if err == nil {
+				err = sc.writeS(sc.subs[n].Replacement)
+			}
+			st.pending = st.pending[:0]
+			sc.log.Debug("needle %d found at %d", n, sc.pos-int64(tlen))
+			sc.counts.substitutions++
+			sc.counts.removed += int64(tlen)
+			sc.report(MatchNeedle, n, sc.base+sc.pos-int64(tlen), int64(tlen))
+		} else {
+			// Mismatched end to start, write it back
+			sc.log.Debug("end token found at %d without a start token, writing it back", sc.pos-int64(tlen))
+			err = sc.write(st.pending)
+			st.pending = st.pending[:0]
+		}
+	} else if m == startPattern && len(sc.auto.patterns) > 1 {
+		st.depth += 1
+		sc.counts.nested(st.depth)
+		sc.log.Debug("nested start token of rule %d found at %d, depth = %d", st.rule, sc.pos-int64(tlen), st.depth)
+	} else {
+		st.depth -= 1
+		if st.depth == 0 {
+			sc.log.Debug("rule %d replaced %d bytes", st.rule, st.region)
+			sc.counts.replacements++
+			sc.counts.removed += st.region
+			sc.report(MatchRule, st.rule, st.openedAt, st.region)
+			st.region = 0
+			st.pending = nil
+			sc.retire(st.spill)
+			st.spill = nil
+			sc.auto = sc.outer
+			err = sc.writeS(sc.rules[st.rule].Token)
+		}
+	}
+	return
+}
+
+// skip holds back p while a replacement is open,
+// once more than spoolAt bytes are held in memory all but the token in progress are spooled.
+func (sc *scanner) skip(p []byte) (err error) {
+	st := sc.st
+	st.pending = append(st.pending, p...)
+	if sc.dryRun {
+		// Only the token in progress is needed to go on matching
+		st.pending = st.pending[:copy(st.pending, st.pending[len(st.pending)-st.partial:])]
+		return
+	}
+	if sc.spoolAt <= 0 || int64(len(st.pending)) <= sc.spoolAt {
+		return
+	}
+	if st.spill == nil {
+		st.spill, err = newSpool(sc.spoolDir, sc.log)
+		if err != nil {
+			return
+		}
+	}
+	release := len(st.pending) - st.partial
+	err = st.spill.write(st.pending[:release])
+	st.pending = st.pending[:copy(st.pending, st.pending[release:])]
+	return
+}
+
+// retire discards a spool file that is no longer needed, unless a checkpoint may still refer to it
+func (sc *scanner) retire(sp *spool) {
+	if sp == nil {
+		return
+	}
+	if sc.keepSpills {
+		if sp.file != nil {
+			sc.retired = append(sc.retired, sp.file.Name())
+		}
+		sp.close()
+		return
+	}
+	sp.discard()
+}
+
+// dropRetired removes the spool files retired before the last checkpoint
+func (sc *scanner) dropRetired() {
+	for _, name := range sc.retired {
+		removeTempFile(sc.log, name)
+	}
+	sc.retired = nil
+}
+
+// check reports a clean position to the watcher once it is at or past the position the watcher wants
+func (sc *scanner) check() {
+	if sc.watcher != nil && sc.st.clean() && sc.pos >= sc.watcher.next() {
+		sc.stopped = sc.watcher.clean(sc.tally())
+		sc.counts.recentDepth = 0
+		if sc.stopped {
+			sc.log.Debug("Stopped by sync watcher at %d", sc.pos)
+		}
+	}
+}
+
+// tally returns everything counted so far
+func (sc *scanner) tally() tally {
+	t := sc.counts
+	t.read = sc.pos
+	t.written = sc.written
+	return t
+}
+
+// halted reports whether the watcher asked the scanner to stop
+func (sc *scanner) halted() bool {
+	return sc.stopped
+}
+
+// discard removes the spool file of the skipped bytes, if there is one
+func (sc *scanner) discard() {
+	sc.st.spill.discard()
+}
+
+// flush writes out anything still pending, used once the end of the input is reached,
+// the state is left as it was so the caller can still tell a replacement never finished.
+func (sc *scanner) flush() (err error) {
+	if sc.st.depth > 0 {
+		sc.report(MatchUnterminated, sc.st.rule, sc.st.openedAt, sc.st.region)
+	}
+	if sc.st.spill != nil {
+		sc.log.Debug("replaying %d spooled bytes", sc.st.spill.size)
+		var n int64
+		n, err = io.Copy(sc.out, sc.st.spill.reader())
+		sc.written += n
+		if err != nil {
+			sc.log.Error("couldn't replay spooled bytes: %s", err)
+			return
+		}
+	}
+	if len(sc.st.pending) > 0 {
+		sc.log.Debug("writing %d pending bytes", len(sc.st.pending))
+		err = sc.write(sc.st.pending)
+	}
+	return
+}
+
+// report passes a match to the match hook
+func (sc *scanner) report(kind string, index int, offset int64, length int64) {
+	if sc.onMatch == nil {
+		return
+	}
+	m := Match{Kind: kind, Index: index, Offset: offset, Length: length}
+	if kind == MatchNeedle {
+		m.Name = sc.subs[index].Needle
+	} else {
+		m.Name = sc.rules[index].Name
+	}
+	sc.onMatch(m)
+}
+
+func (sc *scanner) writeS(str string) (err error) {
+	return sc.write([]byte(str))
+}
+
+func (sc *scanner) write(p []byte) (err error) {
+	if len(p) > 0 {
+		var n int
+		n, err = sc.out.Write(p)
+		sc.written += int64(n)
+		if err != nil {
+			sc.log.Error("couldn't write bytes: %s", err)
+		}
+	}
+	return
+}
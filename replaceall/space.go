@@ -0,0 +1,46 @@
+package replaceall
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+// checkSpace fails when there is clearly not enough free disk space for a run before anything is written.
+// The partial output in runDir and the output next to outputFileName are each expected to take about
+// as much as the input, twice that when both are on the same device.
+// Where the free space cannot be found out, nothing is checked, nor is it for compressed or decoded input,
+// whose size on disk says little about the size of the partial output written from it.
+func checkSpace(log *util.Log, inputFileName string, runDir string, outputFileName string, opts Options) error {
+	if (opts.InputCompression != "" && opts.InputCompression != NoCompression) ||
+		(opts.InputEncoding != "" && opts.InputEncoding != UTF8) {
+		log.Warn("input %s is compressed or decoded, not checking there is enough free space for the run", inputFileName)
+		return nil
+	}
+	stats, err := os.Stat(inputFileName)
+	if err != nil {
+		return nil
+	}
+	size := stats.Size()
+	needed := make(map[uint64]int64)
+	free := make(map[uint64]int64)
+	dirs := make(map[uint64]string)
+	for _, dir := range []string{runDir, filepath.Dir(outputFileName)} {
+		available, device, ok := diskSpace(dir)
+		if !ok {
+			log.Debug("couldn't find out the free space in %s, not checking it", dir)
+			continue
+		}
+		needed[device] += size
+		free[device] = available
+		dirs[device] = dir
+	}
+	for device, n := range needed {
+		if free[device] < n {
+			return fmt.Errorf("not enough free space in %s, %d bytes are needed but only %d are free", dirs[device], n, free[device])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package replaceall
+
+// diskSpace cannot find out the free space on this platform
+func diskSpace(dir string) (free int64, device uint64, ok bool) {
+	return
+}
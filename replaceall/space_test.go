@@ -0,0 +1,35 @@
+package replaceall
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+func TestCheckSpace_Skipped(t *testing.T) {
+	inputFileName := "testdata/TestReplaceAll-input.xml"
+	for _, c := range []struct {
+		opts    Options
+		skipped bool
+	}{
+		{Options{}, false},
+		{Options{InputCompression: NoCompression, InputEncoding: UTF8}, false},
+		{Options{InputCompression: Gzip}, true},
+		{Options{InputEncoding: UTF16LE}, true},
+		{Options{InputEncoding: Windows1252}, true},
+	} {
+		logger := &recordingLogger{workers: make(map[interface{}]bool)}
+		err := checkSpace(util.NewLog(logger), inputFileName, "testdata", "testdata/results/space.xml", c.opts)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %s", c.opts, err)
+		}
+		skipped := false
+		for _, r := range logger.records {
+			skipped = skipped || strings.HasPrefix(r, "WARN")
+		}
+		if skipped != c.skipped {
+			t.Errorf("%+v: expected the check to be skipped to be %t but got %t", c.opts, c.skipped, skipped)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package replaceall
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskSpace returns the bytes free to unprivileged users on the filesystem dir is in, and the device it is on
+func diskSpace(dir string) (free int64, device uint64, ok bool) {
+	var fs syscall.Statfs_t
+	if syscall.Statfs(dir, &fs) != nil {
+		return
+	}
+	stats, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	st, isStat := stats.Sys().(*syscall.Stat_t)
+	if !isStat {
+		return
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), uint64(st.Dev), true
+}
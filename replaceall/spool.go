@@ -0,0 +1,114 @@
+package replaceall
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+// spool is a temp file holding skipped bytes that did not fit under the memory threshold,
+// they are replayed from it if the replacement they belong to never finishes.
+type spool struct {
+	file *os.File
+	size int64
+	log  *util.Log
+}
+
+// newSpool creates an empty spool file in dir, or in the default temp directory when dir is empty
+func newSpool(dir string, log *util.Log) (sp *spool, err error) {
+	var file *os.File
+	file, err = ioutil.TempFile(dir, "stringaling_spool_")
+	if err != nil {
+		log.Error("couldn't create spool file: %s", err)
+		return
+	}
+	log.Debug("spooling skipped bytes to %s", file.Name())
+	sp = &spool{file: file, log: log}
+	return
+}
+
+// openSpool reopens the spool file of a checkpoint, dropping anything written to it after the checkpoint
+func openSpool(fileName string, size int64, log *util.Log) (sp *spool, err error) {
+	var file *os.File
+	file, err = os.OpenFile(fileName, os.O_RDWR, 0600)
+	if err == nil {
+		err = file.Truncate(size)
+		if err == nil {
+			_, err = file.Seek(size, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		log.Error("couldn't reopen spool file (%s): %s", fileName, err)
+		return
+	}
+	sp = &spool{file: file, size: size, log: log}
+	return
+}
+
+// write appends p to the spool
+func (sp *spool) write(p []byte) (err error) {
+	var n int
+	n, err = sp.file.Write(p)
+	sp.size += int64(n)
+	if err != nil {
+		sp.log.Error("couldn't write to spool file (%s): %s", sp.file.Name(), err)
+	}
+	return
+}
+
+// reader returns a reader over everything spooled so far
+func (sp *spool) reader() io.Reader {
+	return io.NewSectionReader(sp.file, 0, sp.size)
+}
+
+// copy copies everything spooled so far to a new spool file in dir, leaving this one as it is
+func (sp *spool) copy(dir string) (dup *spool, err error) {
+	dup, err = newSpool(dir, sp.log)
+	if err != nil {
+		return
+	}
+	dup.size, err = io.Copy(dup.file, sp.reader())
+	if err != nil {
+		sp.log.Error("couldn't copy spool file (%s): %s", sp.file.Name(), err)
+		dup.discard()
+		dup = nil
+	}
+	return
+}
+
+// close closes the spool file but keeps it, so a checkpoint can still refer to it
+func (sp *spool) close() {
+	if sp == nil || sp.file == nil {
+		return
+	}
+	err := sp.file.Close()
+	if err != nil {
+		sp.log.Error("couldn't close spool file (%s): %s", sp.file.Name(), err)
+	}
+	sp.file = nil
+}
+
+// discard closes and removes the spool file, it is safe to call more than once
+func (sp *spool) discard() {
+	if sp == nil || sp.file == nil {
+		return
+	}
+	name := sp.file.Name()
+	err := sp.file.Close()
+	if err != nil {
+		sp.log.Error("couldn't close spool file (%s): %s", name, err)
+	}
+	err = os.Remove(name)
+	if err != nil {
+		sp.log.Error("couldn't remove spool file (%s): %s", name, err)
+	} else {
+		sp.log.Debug("removed spool file %s", name)
+	}
+	sp.file = nil
+	sp.size = 0
+}
@@ -0,0 +1,163 @@
+package replaceall
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// errClosed is returned by a reader or writer used after it was closed
+var errClosed = errors.New("replaceall: read or write after close")
+
+// NewReader returns a reader applying rules to everything read from r, as it is read.
+// Bytes that may still be replaced are held back until r has been read far enough to know,
+// so nothing is lost however the reads are sized.
+func NewReader(r io.Reader, rules ...Rule) io.Reader {
+	return NewReaderWith(r, Options{Rules: rules})
+}
+
+// NewReaderWith is NewReader configured by opts, only the rules, substitutions, elements, fields, NDJSON, SpoolThreshold and TempDir are used.
+// Invalid rules are returned as the error of the first Read.
+// The reader also implements io.Closer, closing it removes any spool file when r is not read to the end.
+func NewReaderWith(r io.Reader, opts Options) io.Reader {
+	rr := &replacingReader{r: r, chunk: make([]byte, DefaultBufferSize)}
+	rr.eng, rr.err = newStreamEngine(&rr.out, opts)
+	return rr
+}
+
+// NewWriter returns a writer applying rules to everything written to it before writing it on to w.
+// Bytes that may still be replaced are held back until enough was written to know, Close writes out
+// whatever is still held back, it does not close w.
+func NewWriter(w io.Writer, rules ...Rule) io.WriteCloser {
+	return NewWriterWith(w, Options{Rules: rules})
+}
+
+// NewWriterWith is NewWriter configured by opts, only the rules, substitutions, elements, fields, NDJSON, SpoolThreshold and TempDir are used.
+// Invalid rules are returned as the error of the first Write.
+func NewWriterWith(w io.Writer, opts Options) io.WriteCloser {
+	rw := &replacingWriter{bw: bufio.NewWriterSize(w, DefaultBufferSize)}
+	rw.eng, rw.err = newStreamEngine(rw.bw, opts)
+	return rw
+}
+
+// newStreamEngine creates the engine for opts writing to out, from the start of the input
+func newStreamEngine(out io.Writer, opts Options) (engine, error) {
+	if len(opts.Elements) > 0 || len(opts.Fields) > 0 {
+		err := validate(opts.Rules, opts.Substitutions, opts.Elements, opts.Fields)
+		if err != nil {
+			return nil, err
+		}
+		if len(opts.Fields) > 0 {
+			return newJSONRedactor(AllReplacer{Fields: opts.Fields, NDJSON: opts.NDJSON, Logger: opts.Logger}, out), nil
+		}
+		return newXMLRedactor(AllReplacer{Elements: opts.Elements, Logger: opts.Logger}, out), nil
+	}
+	sc, err := newStreamScanner(out, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// newStreamScanner creates a scanner for the rules of opts writing to out, from a clean state
+func newStreamScanner(out io.Writer, opts Options) (sc *scanner, err error) {
+	automata, err := compileRules(opts.Rules, opts.Substitutions)
+	if err != nil {
+		return
+	}
+	s := AllReplacer{
+		Rules:          opts.Rules,
+		Substitutions:  opts.Substitutions,
+		SpoolThreshold: opts.SpoolThreshold,
+		SpoolDir:       opts.TempDir,
+		Logger:         opts.Logger,
+		automata:       automata,
+	}
+	sc = newScanner(s, &matchState{}, out, nil)
+	return
+}
+
+type replacingReader struct {
+	r     io.Reader
+	eng   engine
+	out   bytes.Buffer // Replaced bytes not read yet
+	chunk []byte
+	err   error // Returned once out is drained, io.EOF once r was read to the end
+}
+
+func (rr *replacingReader) Read(p []byte) (n int, err error) {
+	for rr.out.Len() == 0 && rr.err == nil {
+		b, rerr := rr.r.Read(rr.chunk)
+		if b > 0 {
+			rr.err = rr.eng.scan(rr.chunk[:b])
+		}
+		if rr.err == nil && rerr == io.EOF {
+			rr.err = rr.eng.flush()
+			rr.eng.discard()
+			if rr.err == nil {
+				rr.err = io.EOF
+			}
+		} else if rr.err == nil {
+			rr.err = rerr
+		}
+	}
+	if rr.out.Len() > 0 {
+		return rr.out.Read(p)
+	}
+	return 0, rr.err
+}
+
+// Close removes any spool file, it does not close the underlying reader
+func (rr *replacingReader) Close() error {
+	if rr.eng != nil {
+		rr.eng.discard()
+	}
+	if rr.err == nil {
+		rr.err = errClosed
+	}
+	return nil
+}
+
+type replacingWriter struct {
+	bw     *bufio.Writer
+	eng    engine
+	err    error
+	closed bool
+}
+
+func (rw *replacingWriter) Write(p []byte) (n int, err error) {
+	if rw.closed {
+		return 0, errClosed
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	rw.err = rw.eng.scan(p)
+	if rw.err == nil {
+		rw.err = rw.bw.Flush()
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	return len(p), nil
+}
+
+// Close writes out whatever is still held back, a replacement that was never closed is written as it was
+func (rw *replacingWriter) Close() (err error) {
+	if rw.closed {
+		return rw.err
+	}
+	rw.closed = true
+	if rw.eng == nil {
+		return rw.err
+	}
+	if rw.err == nil {
+		rw.err = rw.eng.flush()
+	}
+	if rw.err == nil {
+		rw.err = rw.bw.Flush()
+	}
+	rw.eng.discard()
+	return rw.err
+}
@@ -0,0 +1,92 @@
+package replaceall
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNewReader(t *testing.T) {
+	input := "keep <phi>one <phi>nested</phi></phi> keep <ssn>123</ssn> <phi>never closed"
+	expected := "keep X keep Y <phi>never closed"
+	rules := []Rule{
+		{StartToken: "<phi>", EndToken: "</phi>", Token: "X"},
+		{StartToken: "<ssn>", EndToken: "</ssn>", Token: "Y"},
+	}
+	// One byte at a time, so every token is split across reads
+	actual, err := ioutil.ReadAll(NewReader(iotest.OneByteReader(strings.NewReader(input)), rules...))
+	if err != nil {
+		t.Fatalf("error reading: %s", err)
+	}
+	if string(actual) != expected {
+		t.Errorf("%q != %q", actual, expected)
+	}
+
+	_, err = ioutil.ReadAll(NewReader(strings.NewReader(input)))
+	if err == nil {
+		t.Errorf("a reader without rules should fail")
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	input := "a cat and a dog <x>hidden</x> a catalog"
+	expected := "a feline and a canine  a felinealog"
+
+	var out bytes.Buffer
+	w := NewWriterWith(&out, Options{
+		Rules:          []Rule{{StartToken: "<x>", EndToken: "</x>"}},
+		Substitutions:  []Substitution{{Needle: "cat", Replacement: "feline"}, {Needle: "dog", Replacement: "canine"}},
+		SpoolThreshold: 2,
+	})
+	for i := 0; i < len(input); i += 3 {
+		end := i + 3
+		if end > len(input) {
+			end = len(input)
+		}
+		_, err := w.Write([]byte(input[i:end]))
+		if err != nil {
+			t.Fatalf("error writing: %s", err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("error closing: %s", err)
+	}
+	if out.String() != expected {
+		t.Errorf("%q != %q", out.String(), expected)
+	}
+	if _, err = w.Write([]byte("more")); err == nil {
+		t.Errorf("writing after close should fail")
+	}
+}
+
+func TestNewWriter_Chain(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	w := NewWriter(gz, Rule{StartToken: "<phi>", EndToken: "</phi>", Token: "<redacted/>"})
+	_, err := io.Copy(w, strings.NewReader("<a><phi>secret</phi></a>"))
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	gr, err := gzip.NewReader(&compressed)
+	if err != nil {
+		t.Fatalf("error reading gzip: %s", err)
+	}
+	actual, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("error reading gzip: %s", err)
+	}
+	if string(actual) != "<a><redacted/></a>" {
+		t.Errorf("unexpected output %q", actual)
+	}
+}
@@ -0,0 +1,60 @@
+package replaceall
+
+import (
+	"context"
+	"io"
+
+	"github.com/stipo42/stringaling/logging"
+)
+
+// TokenReplacer replaces every occurrence of literal tokens in a stream,
+// holding back no more than the longest needle in memory.
+type TokenReplacer struct {
+	StartAt       int64 // The byte number to start at
+	GoUntil       int64 // The byte number to consume, when zero the reader is consumed until EOF
+	BufferSize    int   // The size of the blocks read and written at a time, defaults to DefaultBufferSize
+	Substitutions []Substitution
+	// The compressions and encodings the spawned reader and writer go through, as for AllReplacer
+	InputCompression  Compression
+	OutputCompression Compression
+	InputEncoding     Encoding
+	OutputEncoding    Encoding
+	// Where messages go, as for AllReplacer. Nothing is logged when nil.
+	Logger        logging.Logger
+	ReaderSpawner func() (io.Reader, error)
+	WriterSpawner func() (io.Writer, error)
+	ReaderCleanup *func()
+	WriterCleanup *func()
+}
+
+// Replace performs the substitutions for the configured TokenReplacer
+// optionally an id may be supplied for keeping track of threading when
+// output is verbose
+func (t TokenReplacer) Replace(id ...int) (result Result, err error) {
+	return t.allReplacer().Replace(id...)
+}
+
+// ReplaceContext is Replace stopping as soon as ctx is done, in which case ctx.Err() is returned
+func (t TokenReplacer) ReplaceContext(ctx context.Context, id ...int) (result Result, err error) {
+	return t.allReplacer().ReplaceContext(ctx, id...)
+}
+
+// allReplacer returns the AllReplacer that performs t's substitutions,
+// needles are matched by the same engine that matches start and end tokens.
+func (t TokenReplacer) allReplacer() AllReplacer {
+	return AllReplacer{
+		StartAt:           t.StartAt,
+		GoUntil:           t.GoUntil,
+		BufferSize:        t.BufferSize,
+		Substitutions:     t.Substitutions,
+		InputCompression:  t.InputCompression,
+		OutputCompression: t.OutputCompression,
+		InputEncoding:     t.InputEncoding,
+		OutputEncoding:    t.OutputEncoding,
+		Logger:            t.Logger,
+		ReaderSpawner:     t.ReaderSpawner,
+		WriterSpawner:     t.WriterSpawner,
+		ReaderCleanup:     t.ReaderCleanup,
+		WriterCleanup:     t.WriterCleanup,
+	}
+}
@@ -0,0 +1,86 @@
+package replaceall
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestTokenReplacer_Replace(t *testing.T) {
+	inputString := "host=old.example.com id=CUST-1 old.example.comold.example.co"
+	expectedString := "host=new.example.org id=XXXX new.example.orgold.example.co"
+	subs := []Substitution{
+		{Needle: "old.example.com", Replacement: "new.example.org"},
+		{Needle: "CUST-1", Replacement: "XXXX"},
+	}
+	for _, size := range []int{1, 2, 7, 64} {
+		sw := bytes.NewBufferString("")
+		tr := createTokenReplacer(inputString, sw, subs)
+		tr.BufferSize = size
+		_, err := tr.Replace()
+		if err != nil {
+			t.Errorf("buffer size %d: unexpected error: %s", size, err)
+		} else if sw.String() != expectedString {
+			t.Errorf("buffer size %d: expected\n'%s'\nbut got\n'%s'", size, expectedString, sw.String())
+		}
+	}
+}
+
+func TestTokenReplacer_Overlapping(t *testing.T) {
+	// The first needle to be completed wins, the longest one when several are completed by the same byte
+	inputString := "aab abc bc xabcx"
+	expectedString := "1b 1c 3 x1cx"
+	subs := []Substitution{
+		{Needle: "ab", Replacement: "1"},
+		{Needle: "abc", Replacement: "2"},
+		{Needle: "bc", Replacement: "3"},
+		{Needle: "aab", Replacement: "1b"},
+	}
+	sw := bytes.NewBufferString("")
+	_, err := createTokenReplacer(inputString, sw, subs).Replace()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if sw.String() != expectedString {
+		t.Errorf("expected\n'%s'\nbut got\n'%s'", expectedString, sw.String())
+	}
+}
+
+func TestTokenReplacer_Invalid(t *testing.T) {
+	for _, subs := range [][]Substitution{
+		nil,
+		{{Needle: "", Replacement: "x"}},
+		{{Needle: "a", Replacement: "x"}, {Needle: "a", Replacement: "y"}},
+	} {
+		sw := bytes.NewBufferString("")
+		_, err := createTokenReplacer("abc", sw, subs).Replace()
+		if err == nil {
+			t.Errorf("expected an error for %v", subs)
+		}
+	}
+}
+
+func TestTokenReplacer_Logger(t *testing.T) {
+	logger := &recordingLogger{workers: make(map[interface{}]bool)}
+	sw := bytes.NewBufferString("")
+	tr := createTokenReplacer("abc", sw, []Substitution{{Needle: "b", Replacement: "x"}})
+	tr.Logger = logger
+	_, err := tr.Replace(7)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(logger.records) == 0 || !logger.workers[7] {
+		t.Errorf("expected messages from worker 7 but got %v", logger.records)
+	}
+}
+
+func createTokenReplacer(inputString string, output io.Writer, subs []Substitution) TokenReplacer {
+	return TokenReplacer{
+		Substitutions: subs,
+		ReaderSpawner: func() (io.Reader, error) {
+			return bytes.NewBufferString(inputString), nil
+		},
+		WriterSpawner: func() (io.Writer, error) {
+			return output, nil
+		},
+	}
+}
@@ -0,0 +1,314 @@
+package replaceall
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stipo42/stringaling/internal/util"
+	"github.com/stipo42/stringaling/progress"
+)
+
+// treeSplitSize is about how many input bytes justify another thread for a single file of a tree
+var treeSplitSize int64 = 16 * 1024 * 1024
+
+// TreeOptions are the settings of a ReplaceTree run
+type TreeOptions struct {
+	// Applied to every file. Threads is the most threads used across all the files at once,
+	// small files get a thread each and large files several, and progress is reported for the whole tree.
+	// With NoClobber an output file that already exists is an error for that file.
+	Options
+	// Glob patterns the path of a file relative to the input, or its base name, has to match
+	// to be replaced, every file when empty. A directory matching an Exclude pattern is skipped.
+	Include []string
+	Exclude []string
+	InPlace bool // Replace every file in place, there is then no output directory
+	// Called with the result of every file as soon as it is done, from any goroutine but one call at a time
+	OnFile func(f FileResult)
+}
+
+// FileResult is what the replacement of a single file of a tree did
+type FileResult struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	Result Result `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TreeResult is what a ReplaceTree run did, file by file and in total
+type TreeResult struct {
+	Files  []FileResult `json:"files"` // In the order of their input paths, files never started are left out
+	Failed int          `json:"failed"`
+	// The counts of every file added up, Threads is the budget shared by the files and Duration the time taken by the run.
+	// It is Confident when every file was.
+	Total Result `json:"total"`
+}
+
+// treeFile is a file found in the input of a tree and where it is written to
+type treeFile struct {
+	input  string
+	output string
+	size   int64
+}
+
+// IsTreeInput reports whether the input is a directory or a glob pattern, rather than a single file
+func IsTreeInput(input string) bool {
+	if util.IsStdStream(input) {
+		return false
+	}
+	stats, err := os.Stat(input)
+	if err == nil {
+		return stats.IsDir()
+	}
+	return hasMeta(input)
+}
+
+// ReplaceTree replaces every file in a directory or matching a glob pattern, writing each to the same path
+// relative to the input under outputDir, or in place. Any number of files are replaced at once under the
+// opts.Threads budget, a file that fails does not stop the others.
+func ReplaceTree(input string, outputDir string, opts TreeOptions) (result TreeResult, err error) {
+	return ReplaceTreeContext(context.Background(), input, outputDir, opts)
+}
+
+// ReplaceTreeContext is ReplaceTree stopping as soon as ctx is done, no more files are started,
+// those in progress are left as they were and ctx.Err() is returned.
+func ReplaceTreeContext(ctx context.Context, input string, outputDir string, opts TreeOptions) (result TreeResult, err error) {
+	start := time.Now()
+	defer func() {
+		result.Total.Duration = time.Since(start)
+	}()
+	log := util.NewLog(opts.Logger)
+	// Every file is replaced with the same automata
+	opts.automata, err = compile(opts.Rules, opts.Substitutions, opts.Elements, opts.Fields)
+	if err != nil {
+		log.Error("invalid rules: %s", err)
+		return
+	}
+	if opts.Checkpoint != "" {
+		err = fmt.Errorf("a tree of files cannot be checkpointed")
+		log.Error("%s", err)
+		return
+	}
+	if !opts.InPlace && outputDir == "" {
+		err = fmt.Errorf("no output directory given")
+		log.Error("%s", err)
+		return
+	}
+	var files []treeFile
+	files, err = listTree(input, outputDir, opts)
+	if err != nil {
+		return
+	}
+	if len(files) == 0 {
+		err = fmt.Errorf("no files to replace in %s", input)
+		log.Error("%s", err)
+		return
+	}
+	budget := opts.Threads
+	if budget < 1 {
+		budget = 1
+	}
+	result.Total.Threads = budget
+	result.Total.Confident = true
+	log.Debug("replacing %d files from %s with %d threads", len(files), input, budget)
+
+	// The largest files are started first, so the small ones fill the gaps at the end
+	order := make([]int, len(files))
+	var total int64
+	for i := range order {
+		order[i] = i
+		total += files[i].size
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return files[order[a]].size > files[order[b]].size
+	})
+
+	// Each free thread is a slot, progress is counted on the first slot a file holds
+	slots := make(chan int, budget)
+	for i := 0; i < budget; i++ {
+		slots <- i
+	}
+	tracker := progress.NewTracker(budget, total, opts.ProgressInterval, opts.OnProgress)
+	results := make([]*FileResult, len(files))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, f := range order {
+		threads := int(files[f].size/treeSplitSize) + 1
+		if threads > budget {
+			threads = budget
+		}
+		held := make([]int, 0, threads)
+		for len(held) < threads && ctx.Err() == nil {
+			select {
+			case slot := <-slots:
+				held = append(held, slot)
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			for _, slot := range held {
+				slots <- slot
+			}
+			break
+		}
+		wg.Add(1)
+		go func(f int, held []int) {
+			defer wg.Done()
+			fr := replaceTreeFile(ctx, files[f], opts, len(held), func(n int64) { tracker.Add(held[0], n) })
+			mu.Lock()
+			results[f] = &fr
+			if opts.OnFile != nil {
+				opts.OnFile(fr)
+			}
+			mu.Unlock()
+			for _, slot := range held {
+				slots <- slot
+			}
+		}(f, held)
+	}
+	wg.Wait()
+	tracker.Finish()
+
+	for _, fr := range results {
+		if fr == nil {
+			continue
+		}
+		result.Files = append(result.Files, *fr)
+		if fr.Error != "" {
+			result.Failed++
+			continue
+		}
+		result.Total.add(fr.Result)
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if result.Failed > 0 {
+		err = fmt.Errorf("%d of %d files failed", result.Failed, len(files))
+	}
+	return
+}
+
+// replaceTreeFile replaces a single file of a tree with the given number of threads,
+// counting the input bytes it reads with count
+func replaceTreeFile(ctx context.Context, f treeFile, opts TreeOptions, threads int, count func(n int64)) (fr FileResult) {
+	fr.Input = f.input
+	fr.Output = f.output
+	fileOpts := opts.Options
+	fileOpts.Threads = threads
+	fileOpts.OnProgress = nil
+	if opts.OnProgress != nil {
+		var seen int64
+		fileOpts.OnProgress = func(p progress.Progress) {
+			count(p.Bytes - seen)
+			seen = p.Bytes
+		}
+	}
+	var err error
+	if opts.InPlace {
+		fr.Result, err = ReplaceInPlaceContext(ctx, f.input, fileOpts)
+	} else {
+		err = os.MkdirAll(filepath.Dir(f.output), 0777)
+		if err == nil {
+			fr.Result, err = ReplaceAllWithContext(ctx, f.input, f.output, fileOpts)
+		}
+	}
+	if err != nil {
+		fr.Error = err.Error()
+	}
+	return
+}
+
+// listTree finds the files to replace, in the order of their input paths.
+// A glob pattern is expanded and any directory it matches is walked, paths are relative to the part of the pattern
+// before its first wildcard.
+func listTree(input string, outputDir string, opts TreeOptions) (files []treeFile, err error) {
+	log := util.NewLog(opts.Logger)
+	root := input
+	matches := []string{input}
+	if stats, serr := os.Stat(input); serr != nil || !stats.IsDir() {
+		root = globRoot(input)
+		matches, err = filepath.Glob(input)
+		if err != nil {
+			log.Error("invalid pattern %s: %s", input, err)
+			return
+		}
+	}
+	// An output directory inside the input is never read back
+	skip := ""
+	if !opts.InPlace {
+		skip, _ = filepath.Abs(outputDir)
+	}
+	seen := make(map[string]bool)
+	for _, match := range matches {
+		err = filepath.Walk(match, func(path string, info os.FileInfo, werr error) error {
+			if werr != nil {
+				log.Error("cannot read %s: %s", path, werr)
+				return werr
+			}
+			rel, rerr := filepath.Rel(root, path)
+			if rerr != nil {
+				return rerr
+			}
+			if info.IsDir() {
+				if abs, _ := filepath.Abs(path); abs == skip || (rel != "." && matchesAny(opts.Exclude, rel)) {
+					log.Debug("skipping directory %s", path)
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() || seen[path] || matchesAny(opts.Exclude, rel) ||
+				(len(opts.Include) > 0 && !matchesAny(opts.Include, rel)) {
+				return nil
+			}
+			seen[path] = true
+			f := treeFile{input: path, output: path, size: info.Size()}
+			if !opts.InPlace {
+				f.output = filepath.Join(outputDir, rel)
+			}
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].input < files[b].input
+	})
+	return
+}
+
+// matchesAny reports whether a relative path, or its base name, matches any of the glob patterns
+func matchesAny(patterns []string, rel string) bool {
+	slashed := filepath.ToSlash(rel)
+	base := filepath.Base(rel)
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+		if ok, _ := filepath.Match(pattern, slashed); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// globRoot returns the directory part of a pattern before its first wildcard
+func globRoot(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for hasMeta(dir) {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// hasMeta reports whether a path has any of the wildcards of filepath.Match
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
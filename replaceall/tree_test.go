@@ -0,0 +1,142 @@
+package replaceall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	err := os.RemoveAll(root)
+	if err != nil {
+		t.Fatalf("could not clear %s: %s", root, err)
+	}
+	for name, content := range files {
+		fileName := filepath.Join(root, name)
+		err = os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fileName, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatalf("could not write %s: %s", fileName, err)
+		}
+	}
+}
+
+func TestReplaceTree(t *testing.T) {
+	root := "testdata/results/tree"
+	writeTree(t, root, map[string]string{
+		"in/top.xml":         "a <phi>1</phi> b",
+		"in/a/one.xml":       "<phi>1</phi><phi>2</phi>",
+		"in/a/b/two.xml":     "none here",
+		"in/a/notes.txt":     "<phi>kept</phi>",
+		"in/skip/three.xml":  "<phi>kept</phi>",
+		"in/a/skip/four.xml": "<phi>kept</phi>",
+	})
+	outputDir := filepath.Join(root, "out")
+	var reported int
+	result, err := ReplaceTree(filepath.Join(root, "in"), outputDir, TreeOptions{
+		Options: Options{
+			Rules:   []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "X"}},
+			Threads: 3,
+		},
+		Include: []string{"*.xml"},
+		Exclude: []string{"skip"},
+		OnFile: func(f FileResult) {
+			reported++
+		},
+	})
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	expected := map[string]string{
+		"top.xml":     "a X b",
+		"a/one.xml":   "XX",
+		"a/b/two.xml": "none here",
+	}
+	for name, content := range expected {
+		actual, rerr := quickRead(filepath.Join(outputDir, name))
+		if rerr != nil {
+			t.Errorf("could not read %s: %s", name, rerr)
+		} else if actual != content {
+			t.Errorf("%s: %s != %s", name, actual, content)
+		}
+	}
+	for _, name := range []string{"a/notes.txt", "skip/three.xml", "a/skip/four.xml"} {
+		if _, serr := os.Stat(filepath.Join(outputDir, name)); !os.IsNotExist(serr) {
+			t.Errorf("%s should not have been replaced", name)
+		}
+	}
+	if len(result.Files) != 3 || reported != 3 || result.Failed != 0 {
+		t.Errorf("unexpected files: %+v (%d reported)", result.Files, reported)
+	}
+	if result.Files[0].Input != filepath.Join(root, "in/a/b/two.xml") || result.Files[1].Result.Replacements != 2 {
+		t.Errorf("files out of order: %+v", result.Files)
+	}
+	if result.Total.Replacements != 3 || result.Total.BytesRead != 49 || result.Total.Threads != 3 || !result.Total.Confident {
+		t.Errorf("unexpected total: %+v", result.Total)
+	}
+
+	// The output directory is inside the input this time, it is not read back
+	_, err = ReplaceTree(filepath.Join(root, "in"), filepath.Join(root, "in/out"), TreeOptions{
+		Options: Options{Rules: []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "X"}}},
+		Include: []string{"*.xml"},
+	})
+	if err == nil {
+		_, err = ReplaceTree(filepath.Join(root, "in"), filepath.Join(root, "in/out"), TreeOptions{
+			Options: Options{Rules: []Rule{{StartToken: "<phi>", EndToken: "</phi>", Token: "X"}}},
+			Include: []string{"*.xml"},
+			Exclude: []string{"skip"},
+		})
+	}
+	if err != nil {
+		t.Errorf("error during execution with the output inside the input: %s", err)
+	}
+	if _, serr := os.Stat(filepath.Join(root, "in/out/out")); !os.IsNotExist(serr) {
+		t.Errorf("the output directory was read back")
+	}
+}
+
+func TestReplaceTree_Glob(t *testing.T) {
+	root := "testdata/results/tree-glob"
+	writeTree(t, root, map[string]string{
+		"in/x/one.xml":  "<k>1</k>",
+		"in/y/two.xml":  "<k>2</k>",
+		"in/y/keep.txt": "<k>3</k>",
+	})
+	outputDir := filepath.Join(root, "out")
+	err := os.MkdirAll(filepath.Join(outputDir, "y"), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(outputDir, "y/two.xml"), []byte("existing"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("could not write existing output: %s", err)
+	}
+	result, err := ReplaceTree(filepath.Join(root, "in/*/*.xml"), outputDir, TreeOptions{
+		Options: Options{Rules: []Rule{{StartToken: "<k>", EndToken: "</k>"}}, Threads: 2, NoClobber: true},
+	})
+	if err == nil || result.Failed != 1 || len(result.Files) != 2 || result.Files[1].Error == "" {
+		t.Fatalf("an existing output file should have failed: %s %+v", err, result)
+	}
+	actual, err := quickRead(filepath.Join(outputDir, "x/one.xml"))
+	if err != nil || actual != "" {
+		t.Errorf("x/one.xml was not replaced: %q %v", actual, err)
+	}
+	actual, err = quickRead(filepath.Join(outputDir, "y/two.xml"))
+	if err != nil || actual != "existing" {
+		t.Errorf("y/two.xml was overwritten: %q %v", actual, err)
+	}
+
+	result, err = ReplaceTree(filepath.Join(root, "in/y"), "", TreeOptions{
+		Options: Options{Rules: []Rule{{StartToken: "<k>", EndToken: "</k>", Token: "K"}}},
+		InPlace: true,
+	})
+	if err != nil || len(result.Files) != 2 {
+		t.Fatalf("error during in place execution: %s %+v", err, result)
+	}
+	actual, err = quickRead(filepath.Join(root, "in/y/keep.txt"))
+	if err != nil || actual != "K" {
+		t.Errorf("keep.txt was not replaced in place: %q %v", actual, err)
+	}
+}
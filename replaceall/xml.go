@@ -0,0 +1,453 @@
+package replaceall
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/stipo42/stringaling/internal/util"
+)
+
+// Element replaces an XML element, from its start tag through its end tag, with Token.
+//
+// While elements are replaced the input is read as an XML document instead of being matched token by token:
+// an element is found by its name whatever attributes its start tag has, and when it is self-closing,
+// but never inside a comment, a CDATA section, a processing instruction or a declaration.
+// Only the nesting of the tags is followed, the input is not checked to be well-formed.
+// Elements inside one that is replaced go with it, when several elements match the same one the first wins.
+type Element struct {
+	Name string // An optional name for the element, used in messages
+	// The name of the element, e.g. phi, or a path of names ending in it, e.g. test/phi/ssn for an ssn directly in
+	// a phi directly in a test. A path starting with / starts at the root element, * is any name.
+	// Names are matched as written, namespace prefix included.
+	Path string
+	// Written as is in place of the element, so it has to be well-formed XML content such as <phi/> or text
+	// with & and < escaped, which keeps a well-formed document well-formed. Empty removes the element.
+	Token string
+}
+
+// label returns how element e is referred to in messages
+func (el Element) label(e int) string {
+	if el.Name != "" {
+		return fmt.Sprintf("element %d (%s)", e, el.Name)
+	}
+	return fmt.Sprintf("element %d", e)
+}
+
+// steps returns the names of the element's path, and whether it starts at the root element
+func (el Element) steps() (names []string, rooted bool) {
+	rooted = strings.HasPrefix(el.Path, "/")
+	return strings.Split(strings.TrimPrefix(el.Path, "/"), "/"), rooted
+}
+
+// validateElements checks the elements can be replaced, rules and substitutions cannot be applied with them
+func validateElements(elements []Element, rules []Rule, subs []Substitution) error {
+	if len(rules) > 0 || len(subs) > 0 {
+		return errors.New("XML elements cannot be replaced in the same run as rules or needles")
+	}
+	paths := make(map[string]int)
+	for e, el := range elements {
+		names, _ := el.steps()
+		for _, name := range names {
+			if name == "" || strings.ContainsAny(name, " \t\r\n<>/&'\"=!?") {
+				return fmt.Errorf("%s: '%s' is not a path of element names", el.label(e), el.Path)
+			}
+		}
+		if o, ok := paths[el.Path]; ok {
+			return fmt.Errorf("%s: path '%s' is already used by %s", el.label(e), el.Path, elements[o].label(o))
+		}
+		paths[el.Path] = e
+		if err := wellFormed(el.Token); err != nil {
+			return fmt.Errorf("%s: replacement '%s' is not well-formed XML: %s", el.label(e), el.Token, err)
+		}
+	}
+	return nil
+}
+
+// wellFormed checks content can be written in place of an element without breaking the document
+func wellFormed(content string) error {
+	d := xml.NewDecoder(strings.NewReader(content))
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := t.(xml.Directive); ok {
+			return errors.New("declarations are not allowed")
+		}
+	}
+}
+
+// newElementPaths returns the matcher of the paths of elements
+func newElementPaths(elements []Element) *pathMatcher {
+	var steps [][]string
+	var rooted []bool
+	for _, el := range elements {
+		names, r := el.steps()
+		steps = append(steps, names)
+		rooted = append(rooted, r)
+	}
+	return newPathMatcher(steps, rooted)
+}
+
+// Where in the markup of a document the next byte is
+const (
+	xmlText      = iota // Character data
+	xmlOpen             // After a <
+	xmlName             // The name of a start tag
+	xmlTag              // The rest of a start or end tag, up to its >
+	xmlBang             // After <!
+	xmlBangDash         // After <!-
+	xmlCDATAOpen        // Part way through <![CDATA[
+	xmlComment          // Up to -->
+	xmlCDATA            // Up to ]]>
+	xmlPI               // A processing instruction, up to ?>
+	xmlDecl             // A declaration such as a doctype, up to the > outside quotes and brackets
+)
+
+const cdataOpen = "<![CDATA["
+
+// level is a run of open elements nested directly in one another that have the same state
+type level struct {
+	state int32
+	count int
+}
+
+// xmlRedactor is the engine of an AllReplacer replacing XML elements.
+// It follows the markup of the document a byte at a time where it has to, passing text straight through,
+// and only holds back the < and name of a start tag until it knows whether its element is replaced,
+// so its memory does not grow with the size of the document or of its elements.
+type xmlRedactor struct {
+	elements []Element
+	paths    *pathMatcher
+	out      io.Writer
+	state    int     // Where in the markup the next byte is
+	held     []byte  // The < and name of a start tag that may open an element to replace
+	decided  bool    // The state of the start tag being read is known, the rest of its name is not held
+	tag      int32   // The state of the start tag being read
+	tagAt    int64   // The offset of the < of the tag being read
+	closing  bool    // The tag being read is an end tag
+	slash    bool    // The last byte of the tag being read was a /, so a > closes it as an empty element
+	quote    byte    // The quote an attribute or literal being read is in, zero when none
+	run      int     // How many bytes of a terminator such as --> were last read, or of <![CDATA[
+	brackets int     // How deep a declaration is in [ ]
+	levels   []level // The open elements
+	open     int     // The open elements being replaced, nested in one another
+	element  int     // The element being replaced, while open is not zero
+	openedAt int64   // The offset the element being replaced starts at
+	pos      int64   // The bytes consumed so far
+	base     int64   // The offset of the first byte consumed, so matches are reported with input offsets
+	written  int64
+	counts   tally
+	onMatch  func(m Match)
+	log      *util.Log
+}
+
+// newXMLRedactor creates a redactor for the elements of s writing to out, from the start of a document
+func newXMLRedactor(s AllReplacer, out io.Writer, id ...int) *xmlRedactor {
+	return &xmlRedactor{
+		elements: s.Elements,
+		paths:    newElementPaths(s.Elements),
+		out:      out,
+		held:     make([]byte, 0, 64),
+		base:     s.StartAt,
+		onMatch:  s.OnMatch,
+		log:      s.logger(id...),
+	}
+}
+
+// scan consumes p, every byte that is not held back is written or, inside an element being replaced, dropped
+func (x *xmlRedactor) scan(p []byte) (err error) {
+	start := 0 // The first byte of p not written or dropped yet
+	for i := 0; i < len(p) && err == nil; {
+		c := p[i]
+		switch x.state {
+		case xmlText:
+			n := bytes.IndexByte(p[i:], '<')
+			if n < 0 {
+				i = len(p)
+				continue
+			}
+			i += n
+			err = x.pass(p[start:i])
+			x.held = append(x.held[:0], '<')
+			x.tagAt = x.base + x.pos + int64(i)
+			x.state = xmlOpen
+			i++
+			start = i
+			continue
+		case xmlOpen:
+			switch {
+			case c == '/':
+				x.state, x.closing, x.slash = xmlTag, true, false
+			case c == '!':
+				x.state = xmlBang
+			case c == '?':
+				x.state, x.run = xmlPI, 0
+			case nameStart(c):
+				x.state, x.decided = xmlName, false
+				x.held = append(x.held, c)
+				i++
+				start = i
+				continue
+			default:
+				// Not markup, the < is text
+				x.state = xmlText
+			}
+			err = x.pass(x.held)
+			x.held = x.held[:0]
+			if x.state == xmlText {
+				continue
+			}
+		case xmlName:
+			if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '/' || c == '>' {
+				if !x.decided {
+					err = x.decide(x.paths.name(x.held[1:]))
+				}
+				x.state, x.closing, x.slash, x.quote = xmlTag, false, false, 0
+				continue
+			}
+			if !x.decided {
+				x.held = append(x.held, c)
+				start = i + 1
+				if len(x.held)-1 > x.paths.longest {
+					// Too long to be any of the names in the paths
+					err = x.decide(-1)
+				}
+			}
+		case xmlTag:
+			switch {
+			case x.quote != 0:
+				if c == x.quote {
+					x.quote = 0
+				}
+			case c == '"' || c == '\'':
+				x.quote = c
+			case c == '>':
+				i++
+				err = x.pass(p[start:i])
+				start = i
+				if err == nil {
+					x.endTag(x.base + x.pos + int64(i))
+				}
+				x.state = xmlText
+				continue
+			}
+			x.slash = c == '/' && x.quote == 0
+		case xmlBang:
+			switch c {
+			case '-':
+				x.state = xmlBangDash
+			case '[':
+				x.state, x.run = xmlCDATAOpen, len("<![")
+			default:
+				x.state, x.quote, x.brackets = xmlDecl, 0, 0
+				continue
+			}
+		case xmlBangDash:
+			if c != '-' {
+				x.state, x.quote, x.brackets = xmlDecl, 0, 0
+				continue
+			}
+			x.state, x.run = xmlComment, 0
+		case xmlCDATAOpen:
+			if c != cdataOpen[x.run] {
+				x.state, x.quote, x.brackets = xmlDecl, 0, 1
+				continue
+			}
+			x.run++
+			if x.run == len(cdataOpen) {
+				x.state, x.run = xmlCDATA, 0
+			}
+		case xmlComment, xmlCDATA, xmlPI:
+			i = x.terminate(p, i)
+			continue
+		case xmlDecl:
+			switch {
+			case x.quote != 0:
+				if c == x.quote {
+					x.quote = 0
+				}
+			case c == '"' || c == '\'':
+				x.quote = c
+			case c == '[':
+				x.brackets++
+			case c == ']':
+				x.brackets--
+			case c == '>' && x.brackets <= 0:
+				x.state = xmlText
+			}
+		}
+		i++
+	}
+	if err == nil {
+		err = x.pass(p[start:])
+	}
+	x.pos += int64(len(p))
+	return
+}
+
+// terminate reads a comment, CDATA section or processing instruction from p[i:] up to its end,
+// returning the index after the last byte read
+func (x *xmlRedactor) terminate(p []byte, i int) int {
+	c, n := byte('-'), 2
+	switch x.state {
+	case xmlCDATA:
+		c = ']'
+	case xmlPI:
+		c, n = '?', 1
+	}
+	for i < len(p) {
+		end := bytes.IndexByte(p[i:], '>')
+		text := p[i:]
+		if end >= 0 {
+			text = p[i : i+end]
+		}
+		// How many of c come right before the >, or the end of p
+		k := len(text)
+		for k > 0 && text[k-1] == c {
+			k--
+		}
+		run := len(text) - k
+		if k == 0 {
+			run += x.run
+		}
+		if end < 0 {
+			x.run = run
+			return len(p)
+		}
+		i += end + 1
+		x.run = 0
+		if run >= n {
+			x.state = xmlText
+			return i
+		}
+	}
+	return i
+}
+
+// nameStart reports whether c can start the name of an element
+func nameStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || c >= 0x80
+}
+
+// decide works out the state of the start tag being read once its name is known, the held < and name
+// are then written, or dropped when the element is replaced
+func (x *xmlRedactor) decide(name int32) (err error) {
+	x.tag = x.paths.after(x.parent(), name)
+	x.decided = true
+	if e := x.paths.states[x.tag].match; e >= 0 {
+		x.open++
+		x.counts.nested(x.open)
+		if x.open == 1 {
+			x.element = e
+			x.openedAt = x.tagAt
+			err = x.write([]byte(x.elements[e].Token))
+		}
+	}
+	if err == nil {
+		err = x.pass(x.held)
+	}
+	x.held = x.held[:0]
+	return
+}
+
+// endTag follows the tag just read, end is the offset after its >
+func (x *xmlRedactor) endTag(end int64) {
+	replaced := false
+	switch {
+	case x.closing:
+		if n := len(x.levels); n > 0 {
+			replaced = x.paths.states[x.levels[n-1].state].match >= 0
+			if x.levels[n-1].count--; x.levels[n-1].count == 0 {
+				x.levels = x.levels[:n-1]
+			}
+		}
+	case x.slash:
+		replaced = x.paths.states[x.tag].match >= 0
+	default:
+		if n := len(x.levels); n > 0 && x.levels[n-1].state == x.tag {
+			x.levels[n-1].count++
+		} else {
+			x.levels = append(x.levels, level{state: x.tag, count: 1})
+		}
+		return
+	}
+	if !replaced || x.open == 0 {
+		return
+	}
+	x.open--
+	if x.open == 0 {
+		length := end - x.openedAt
+		x.counts.replacements++
+		x.counts.removed += length
+		if x.onMatch != nil {
+			el := x.elements[x.element]
+			name := el.Name
+			if name == "" {
+				name = el.Path
+			}
+			x.onMatch(Match{Kind: MatchElement, Index: x.element, Name: name, Offset: x.openedAt, Length: length})
+		}
+	}
+}
+
+// parent returns the state of the innermost open element, or of the document when none is open
+func (x *xmlRedactor) parent() int32 {
+	if n := len(x.levels); n > 0 {
+		return x.levels[n-1].state
+	}
+	return 0
+}
+
+// pass writes p, or drops it inside an element being replaced
+func (x *xmlRedactor) pass(p []byte) error {
+	if x.open > 0 {
+		return nil
+	}
+	return x.write(p)
+}
+
+func (x *xmlRedactor) write(p []byte) (err error) {
+	if len(p) > 0 {
+		var n int
+		n, err = x.out.Write(p)
+		x.written += int64(n)
+		if err != nil {
+			x.log.Error("couldn't write bytes: %s", err)
+		}
+	}
+	return
+}
+
+// flush writes out a start tag the input ended in, an element being replaced that never ends is an error
+// since what it held was dropped
+func (x *xmlRedactor) flush() error {
+	if x.open > 0 {
+		return fmt.Errorf("the input ended inside %s at offset %d", x.elements[x.element].label(x.element), x.openedAt)
+	}
+	err := x.pass(x.held)
+	x.held = x.held[:0]
+	return err
+}
+
+func (x *xmlRedactor) tally() tally {
+	t := x.counts
+	t.read = x.pos
+	t.written = x.written
+	return t
+}
+
+// halted is always false, a document is read to the end
+func (x *xmlRedactor) halted() bool {
+	return false
+}
+
+// discard does nothing, nothing is spooled
+func (x *xmlRedactor) discard() {}
@@ -0,0 +1,159 @@
+package replaceall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var xmlCases = []struct {
+	elements []Element
+	input    string
+	expected string
+}{
+	{[]Element{{Path: "phi", Token: "<phi/>"}}, `<a><phi id="1">x</phi><phi/><b>y</b></a>`, `<a><phi/><phi/><b>y</b></a>`},
+	// Comments, CDATA sections and processing instructions are not looked in
+	{[]Element{{Path: "phi"}}, `<a><!-- <phi>x</phi> --><![CDATA[<phi>y</phi>]]><?pi <phi>?><phi>z</phi></a>`, `<a><!-- <phi>x</phi> --><![CDATA[<phi>y</phi>]]><?pi <phi>?></a>`},
+	{[]Element{{Path: "phi"}}, `<?xml version="1.0"?><!DOCTYPE a [<!ENTITY e "<phi>">]><a><phi>1</phi></a>`, `<?xml version="1.0"?><!DOCTYPE a [<!ENTITY e "<phi>">]><a></a>`},
+	// Markup inside attribute values
+	{[]Element{{Path: "phi", Token: "X"}}, `<phi a="x>y" b='/>'>1</phi><phi c="</phi>"/>`, "XX"},
+	{[]Element{{Path: "test/phi/ssn", Token: "S"}}, "<test><phi><ssn>1</ssn><x><ssn>2</ssn></x></phi><ssn>3</ssn></test>", "<test><phi>S<x><ssn>2</ssn></x></phi><ssn>3</ssn></test>"},
+	{[]Element{{Path: "/a/b", Token: "B"}}, "<a><b>1</b><c><a><b>2</b></a></c></a>", "<a>B<c><a><b>2</b></a></c></a>"},
+	{[]Element{{Path: "a/*/c", Token: "C"}}, "<a><b><c>1</c></b><c>2</c><d><c/></d></a>", "<a><b>C</b><c>2</c><d>C</d></a>"},
+	// Nested elements go with the outermost, the first element matching wins
+	{[]Element{{Path: "phi", Token: "X"}, {Path: "a/phi", Token: "Y"}}, "<a><phi><phi>1</phi>2</phi>3</a>", "<a>X3</a>"},
+	{[]Element{{Path: "a/phi", Token: "Y"}, {Path: "phi", Token: "X"}}, "<a><phi>1</phi></a><phi>2</phi>", "<a>Y</a>X"},
+	// Names are matched whole, prefix included
+	{[]Element{{Path: "phi", Token: "X"}}, "<phix>1</phix><ph>2</ph><h:phi>3</h:phi><phi\n>4</phi >", "<phix>1</phix><ph>2</ph><h:phi>3</h:phi>X"},
+	{[]Element{{Path: "h:phi", Token: "X"}}, "<h:phi>3</h:phi><phi>4</phi>", "X<phi>4</phi>"},
+	{[]Element{{Path: "*", Token: "X"}}, "<?xml version=\"1.0\"?>\n<a><b/></a>\n", "<?xml version=\"1.0\"?>\nX\n"},
+	// A < that does not start markup is text
+	{[]Element{{Path: "phi"}}, "<a>1 < 2<phi>3</phi></a>", "<a>1 < 2</a>"},
+}
+
+func TestReplace_XML(t *testing.T) {
+	for c, xc := range xmlCases {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = strings.NewReader(xc.input)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			actual, err := ioutil.ReadAll(NewReaderWith(r, Options{Elements: xc.elements}))
+			if err != nil {
+				t.Errorf("case %d: unexpected error: %s", c, err)
+			} else if string(actual) != xc.expected {
+				t.Errorf("case %d: %q != %q", c, actual, xc.expected)
+			}
+		}
+	}
+}
+
+func TestReplace_XMLBounded(t *testing.T) {
+	// Neither a long name nor deep nesting in the same state grows what is held
+	elements := []Element{{Path: "a/phi", Token: "X"}}
+	var out bytes.Buffer
+	x := newXMLRedactor(AllReplacer{Elements: elements}, &out)
+	input := "<" + strings.Repeat("n", 10000) + ">" + strings.Repeat("<b>", 10000) + "<phi>1</phi>" +
+		strings.Repeat("</b>", 10000) + "</" + strings.Repeat("n", 10000) + "><a><phi>2</phi></a>"
+	var held, levels int
+	for i := 0; i < len(input); i++ {
+		if err := x.scan([]byte{input[i]}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(x.held) > held {
+			held = len(x.held)
+		}
+		if len(x.levels) > levels {
+			levels = len(x.levels)
+		}
+	}
+	if err := x.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if held > len("<phi")+1 || levels > 2 {
+		t.Errorf("held %d bytes of a name and %d levels", held, levels)
+	}
+	if !strings.HasSuffix(out.String(), "><a>X</a>") || x.counts.replacements != 1 {
+		t.Errorf("unexpected output ending %q after %d replacements", out.String()[out.Len()-20:], x.counts.replacements)
+	}
+}
+
+func TestReplaceAllWith_XML(t *testing.T) {
+	elements := []Element{
+		{Name: "ssn", Path: "patient/ssn", Token: "<ssn/>"},
+		{Path: "phi", Token: "<phi>[redacted]</phi>"},
+	}
+	record := `<patient id="%d"><ssn>123</ssn><name><phi a="1">John<phi>Smith</phi></phi><phi/></name><!-- <ssn>1</ssn> --></patient>` + "\n"
+	expected := `<patient id="%d"><ssn/><name><phi>[redacted]</phi><phi>[redacted]</phi></name><!-- <ssn>1</ssn> --></patient>` + "\n"
+	var input, output strings.Builder
+	input.WriteString("<?xml version=\"1.0\"?>\n<patients>\n")
+	output.WriteString("<?xml version=\"1.0\"?>\n<patients>\n")
+	for i := 0; i < 500; i++ {
+		input.WriteString(fmt.Sprintf(record, i))
+		output.WriteString(fmt.Sprintf(expected, i))
+	}
+	input.WriteString("</patients>\n")
+	output.WriteString("</patients>\n")
+	inputFileName := "testdata/results/xml-input.xml"
+	err := ioutil.WriteFile(inputFileName, []byte(input.String()), 0644)
+	if err != nil {
+		t.Fatalf("could not write input: %s", err)
+	}
+	outputFileName := "testdata/results/xml-output.xml"
+	result, err := ReplaceAllWith(inputFileName, outputFileName, Options{Elements: elements, Threads: 4})
+	if err != nil {
+		t.Fatalf("error during execution: %s", err)
+	}
+	actual, err := quickRead(outputFileName)
+	if err != nil {
+		t.Fatalf("could not read output: %s", err)
+	}
+	if actual != output.String() {
+		t.Errorf("unexpected output: %q", actual[:200])
+	}
+	if result.Replacements != 1500 || result.MaxDepth != 2 || result.Threads != 1 || !result.Confident {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	report, err := DryRun(inputFileName, Options{Elements: elements}, nil)
+	if err != nil {
+		t.Fatalf("unexpected dry run error: %s", err)
+	}
+	if report.Regions != 1500 || report.PerRule[0] != 500 || report.PerRule[1] != 1000 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestReplace_XMLUnterminated(t *testing.T) {
+	_, err := ioutil.ReadAll(NewReaderWith(strings.NewReader("<a><phi>1<b/>"), Options{Elements: []Element{{Path: "phi"}}}))
+	if err == nil {
+		t.Errorf("expected an error for input ending inside an element being replaced")
+	}
+}
+
+func TestValidateElements(t *testing.T) {
+	for _, elements := range [][]Element{
+		{{Path: ""}},
+		{{Path: "a//b"}},
+		{{Path: "a/"}},
+		{{Path: "a b"}},
+		{{Path: "phi"}, {Path: "phi"}},
+		{{Path: "phi", Token: "<phi>"}},
+		{{Path: "phi", Token: "a & b"}},
+		{{Path: "phi", Token: "<!DOCTYPE x>"}},
+	} {
+		if err := validate(nil, nil, elements, nil); err == nil {
+			t.Errorf("%+v should not be valid", elements)
+		}
+	}
+	if err := validate([]Rule{{StartToken: "a", EndToken: "b"}}, nil, []Element{{Path: "phi"}}, nil); err == nil {
+		t.Errorf("elements should not be replaced with rules")
+	}
+	if err := validate(nil, nil, []Element{{Path: "/a/*/h:phi", Token: "<x a='1'>&amp;</x>text"}}, nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
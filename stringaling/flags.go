@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/stipo42/stringaling/internal/util"
+	"github.com/stipo42/stringaling/replaceall"
+)
+
+// args are the flags given to a command, a flag a command does not take is left at its zero value
+type args struct {
+	verbose      bool
+	input        string
+	output       string
+	startTokens  stringList
+	endTokens    stringList
+	tokens       stringList
+	folds        stringList
+	normalize    stringList
+	regex        bool
+	maxMatch     int64
+	elements     stringList
+	fields       stringList
+	drops        stringList
+	ndjson       bool
+	needles      stringList
+	files        stringList
+	threads      int
+	memoryLimit  int64
+	rulesFile    string
+	compression  replaceall.Compression
+	inputEnc     replaceall.Encoding
+	outputEnc    replaceall.Encoding
+	inPlace      bool
+	backupSuffix string
+	force        bool
+	mode         os.FileMode
+	stats        string
+	tempDir      string
+	checkpoint   string
+	resume       bool
+	include      stringList
+	exclude      stringList
+	dryRun       bool
+	matches      string
+	progress     bool
+	deleteFiles  bool
+}
+
+// usageError is an error in the arguments of a command, rather than in running it
+type usageError struct {
+	err error
+}
+
+func (u usageError) Error() string {
+	return u.err.Error()
+}
+
+// usagef returns a usageError with a formatted message
+func usagef(format string, a ...interface{}) error {
+	return usageError{fmt.Errorf(format, a...)}
+}
+
+// flagSet is the flags of a command, every flag can have a short and a long name
+type flagSet struct {
+	*flag.FlagSet
+	a *args
+}
+
+// newFlagSet returns the flags every command takes, parse errors are returned rather than printed
+func newFlagSet(name string) *flagSet {
+	fs := &flagSet{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError), a: &args{threads: 1}}
+	fs.SetOutput(ioutil.Discard)
+	fs.bool(&fs.a.verbose, "v", "verbose")
+	return fs
+}
+
+// string adds a flag taking a string under each of the names
+func (fs *flagSet) string(p *string, names ...string) {
+	for _, name := range names {
+		fs.StringVar(p, name, "", "")
+	}
+}
+
+// bool adds a flag taking no value under each of the names
+func (fs *flagSet) bool(p *bool, names ...string) {
+	for _, name := range names {
+		fs.BoolVar(p, name, false, "")
+	}
+}
+
+// value adds a flag parsed by v under each of the names
+func (fs *flagSet) value(v flag.Value, names ...string) {
+	for _, name := range names {
+		fs.Var(v, name, "")
+	}
+}
+
+// outputFlags adds the flags of the commands that write output files
+func (fs *flagSet) outputFlags() {
+	fs.string(&fs.a.output, "o", "output")
+	fs.bool(&fs.a.force, "force")
+	fs.value((*modeValue)(&fs.a.mode), "mode")
+	fs.bool(&fs.a.progress, "progress")
+}
+
+// replaceFlags adds the flags shared by replace-all and replace
+func (fs *flagSet) replaceFlags() {
+	a := fs.a
+	fs.outputFlags()
+	fs.string(&a.input, "i", "input")
+	fs.value(&a.tokens, "w", "with")
+	fs.value((*threadsValue)(&a.threads), "t", "threads")
+	fs.value((*compressionValue)(&a.compression), "z", "compress")
+	fs.value((*encodingValue)(&a.inputEnc), "input-encoding")
+	fs.value((*encodingValue)(&a.outputEnc), "output-encoding")
+	fs.bool(&a.inPlace, "in-place")
+	fs.string(&a.backupSuffix, "backup-suffix")
+	fs.string(&a.stats, "stats")
+	fs.string(&a.tempDir, "temp-dir")
+	fs.string(&a.checkpoint, "checkpoint")
+	fs.bool(&a.resume, "resume")
+	fs.value(&a.include, "include")
+	fs.value(&a.exclude, "exclude")
+	fs.bool(&a.dryRun, "dry-run")
+	fs.string(&a.matches, "matches")
+}
+
+// parse parses the arguments of a command, any argument that is not a flag is an error.
+// flag.ErrHelp is returned when -h or --help is given.
+func (fs *flagSet) parse(arguments []string) (a *args, err error) {
+	err = fs.Parse(arguments)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		err = usageError{err}
+		return
+	}
+	if fs.NArg() > 0 {
+		err = usagef("unexpected argument %q, every value must follow its flag", fs.Arg(0))
+		return
+	}
+	a = fs.a
+	if a.matches != "" {
+		a.dryRun = true
+	}
+	return
+}
+
+// logFlags logs every flag that was given and its value
+func (fs *flagSet) logFlags() {
+	fs.Visit(func(f *flag.Flag) {
+		log.Debug("found -%s, set to %s", f.Name, f.Value)
+	})
+}
+
+// checkOutputArgs checks the input and output of replace-all and replace, and the flags that only go with others
+func checkOutputArgs(a *args) error {
+	switch {
+	case a.input == "":
+		return usagef("-i is required")
+	case a.inPlace && a.output != "":
+		return usagef("-o cannot be given with --in-place")
+	case !a.inPlace && a.backupSuffix != "":
+		return usagef("--backup-suffix needs --in-place")
+	case a.resume && a.checkpoint == "":
+		return usagef("--resume needs --checkpoint")
+	case a.dryRun && (a.inPlace || a.checkpoint != ""):
+		return usagef("a dry run cannot be given --in-place or --checkpoint")
+	case !a.dryRun && !a.inPlace && a.output == "":
+		return usagef("-o is required, unless --in-place or --dry-run is given")
+	case util.IsStdStream(a.output) && (util.IsStdStream(a.stats) || util.IsStdStream(a.matches)):
+		return usagef("--stats and --matches cannot write stdout when -o does")
+	}
+	return nil
+}
+
+// stringList is a flag that can be given several times, keeping every value in order
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// threadsValue is a number of threads, at least one
+type threadsValue int
+
+func (t *threadsValue) String() string {
+	if t == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*t))
+}
+
+func (t *threadsValue) Set(value string) error {
+	threads, err := strconv.Atoi(value)
+	if err != nil || threads < 1 {
+		return errors.New("expected a number of threads of at least 1")
+	}
+	*t = threadsValue(threads)
+	return nil
+}
+
+// sizeValue is a number of bytes with an optional k, m or g suffix
+type sizeValue int64
+
+func (s *sizeValue) String() string {
+	if s == nil {
+		return ""
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeValue) Set(value string) error {
+	size, err := util.ParseSize(value)
+	if err != nil {
+		return fmt.Errorf("expected a size such as 64m: %s", err)
+	}
+	*s = sizeValue(size)
+	return nil
+}
+
+// compressionValue is the name of a compression
+type compressionValue replaceall.Compression
+
+func (c *compressionValue) String() string {
+	if c == nil {
+		return ""
+	}
+	return string(*c)
+}
+
+func (c *compressionValue) Set(value string) error {
+	compression, err := replaceall.ParseCompression(value)
+	if err != nil {
+		return err
+	}
+	*c = compressionValue(compression)
+	return nil
+}
+
+// encodingValue is the name of an encoding
+type encodingValue replaceall.Encoding
+
+func (e *encodingValue) String() string {
+	if e == nil {
+		return ""
+	}
+	return string(*e)
+}
+
+func (e *encodingValue) Set(value string) error {
+	encoding, err := replaceall.ParseEncoding(value)
+	if err != nil {
+		return err
+	}
+	*e = encodingValue(encoding)
+	return nil
+}
+
+// modeValue is octal file permissions
+type modeValue os.FileMode
+
+func (m *modeValue) String() string {
+	if m == nil {
+		return ""
+	}
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *modeValue) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return errors.New("expected octal permissions such as 0640")
+	}
+	*m = modeValue(mode)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/stipo42/stringaling/replaceall"
+)
+
+func TestParse(t *testing.T) {
+	a, err := replaceAllFlags().parse([]string{
+		"-i", "-", "--output=out.xml", "-s", "<a>", "--end", "</a>", "--start=-x-", "-e", "-y-",
+		"-t", "4", "-m", "64k", "--compress", "gzip", "--mode", "0640", "--matches", "m.json", "-v", "--input-encoding", "UTF-16",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if a.input != "-" || a.output != "out.xml" || !a.verbose || a.threads != 4 || a.memoryLimit != 64*1024 ||
+		a.compression != replaceall.Gzip || a.mode != 0640 || !a.dryRun || a.inputEnc != replaceall.UTF16 || a.outputEnc != "" {
+		t.Errorf("unexpected args: %+v", a)
+	}
+	if !reflect.DeepEqual([]string(a.startTokens), []string{"<a>", "-x-"}) || !reflect.DeepEqual([]string(a.endTokens), []string{"</a>", "-y-"}) {
+		t.Errorf("unexpected tokens: %v %v", a.startTokens, a.endTokens)
+	}
+
+	a, err = replaceAllFlags().parse([]string{"-m", "8589934591g"})
+	if err != nil || a.memoryLimit != 8589934591<<30 {
+		t.Errorf("unexpected memory limit: %d %v", a.memoryLimit, err)
+	}
+
+	a, err = combineFlags().parse(nil)
+	if err != nil || a.threads != 1 {
+		t.Errorf("unexpected defaults: %+v %v", a, err)
+	}
+	_, err = combineFlags().parse([]string{"--help"})
+	if err != flag.ErrHelp {
+		t.Errorf("--help returned %v", err)
+	}
+
+	for _, arguments := range [][]string{
+		{"-s"},
+		{"-t", "abc"},
+		{"-t", "0"},
+		{"-m", "1q"},
+		{"-m", "8589934592g"},
+		{"-z", "lz4"},
+		{"--output-encoding", "ebcdic"},
+		{"--mode", "999"},
+		{"--unknown"},
+		{"-i", "in.xml", "extra"},
+		{"-n", "x"},
+	} {
+		_, err = replaceAllFlags().parse(arguments)
+		if _, ok := err.(usageError); !ok {
+			t.Errorf("%v: expected a usage error, got %v", arguments, err)
+		}
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	for _, c := range []struct {
+		check     func(a *args) error
+		flags     func() *flagSet
+		arguments []string
+		valid     bool
+	}{
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "-s", "a", "-e", "b"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "--in-place", "--rules", "r.yaml"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "--dry-run", "-s", "a", "-e", "b"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-o", "out", "-s", "a", "-e", "b"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-s", "a", "-e", "b"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "-s", "a", "-s", "b", "-e", "c"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--in-place", "-s", "a", "-e", "b"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--resume", "-s", "a", "-e", "b"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "-s", "a", "-e", "b", "-s", "c", "-e", "d", "--fold", "ascii", "--normalize", "NFKC"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "-s", "a", "-e", "b", "--fold", "upper"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "-s", "a", "-e", "b", "--normalize", "nfc", "--normalize", "nfkc"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--regex", "--max-match", "4k", "-s", "<a[^>]*>", "-e", "</a>"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--regex", "-s", "<a[^>]*>", "-e", "</a>"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--max-match", "64", "-s", "a", "-e", "b"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--element", "phi", "--element", "test/ssn", "-w", "<x/>"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--element", "phi", "-w", "a", "-w", "b", "-w", "c"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--element", "phi", "-s", "a", "-e", "b"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--ndjson", "--field", "ssn", "-w", `"***"`, "--drop", "/contact/phone"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--drop", "ssn", "-w", "0"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--field", "ssn", "--element", "phi"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--ndjson", "-s", "a", "-e", "b"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "-", "--stats", "stats.json", "-s", "a", "-e", "b"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "out", "--stats", "-", "-s", "a", "-e", "b"}, true},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "-", "--stats", "-", "-s", "a", "-e", "b"}, false},
+		{checkReplaceAllArgs, replaceAllFlags, []string{"-i", "in", "-o", "-", "--matches", "-", "-s", "a", "-e", "b"}, false},
+		{checkReplaceArgs, replaceFlags, []string{"-i", "in", "-o", "out", "-n", "a", "-n", "b", "-w", "c"}, true},
+		{checkReplaceArgs, replaceFlags, []string{"-i", "in", "-o", "-", "--stats", "-", "-n", "a"}, false},
+		{checkReplaceArgs, replaceFlags, []string{"-i", "in", "-o", "out", "-n", "a", "-n", "b", "-w", "c", "-w", "d", "-w", "e"}, false},
+		{checkReplaceArgs, replaceFlags, []string{"-i", "in", "-o", "out"}, false},
+		{checkCombineArgs, combineFlags, []string{"-f", "a", "--file=b", "-o", "out", "-d"}, true},
+		{checkCombineArgs, combineFlags, []string{"-f", "a", "-o", "out"}, false},
+		{checkCombineArgs, combineFlags, []string{"-f", "a", "-f", "b"}, false},
+	} {
+		a, err := c.flags().parse(c.arguments)
+		if err == nil {
+			err = c.check(a)
+		}
+		if c.valid && err != nil {
+			t.Errorf("%v: unexpected error: %s", c.arguments, err)
+		} else if !c.valid {
+			if _, ok := err.(usageError); !ok {
+				t.Errorf("%v: expected a usage error, got %v", c.arguments, err)
+			}
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{usagef("-i is required"), exitUsage},
+		{errors.New("no such file"), exitFailure},
+		{context.Canceled, exitFailure},
+	} {
+		if code := exitCode(c.err); code != c.code {
+			t.Errorf("%v: expected exit code %d but got %d", c.err, c.code, code)
+		}
+	}
+}
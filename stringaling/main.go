@@ -1,167 +1,721 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/stipo42/stringaling/combine"
 	"github.com/stipo42/stringaling/internal/util"
+	"github.com/stipo42/stringaling/logging"
+	"github.com/stipo42/stringaling/progress"
 	"github.com/stipo42/stringaling/replaceall"
 )
 
+// logger writes to stderr, at the debug level once --verbose is given
+var logger logging.Logger = logging.NewText(os.Stderr, logging.LevelInfo)
+
+// log is logger with printf style formats
+var log = util.NewLog(logger)
+
+// The exit codes, other than 0 for success
+const (
+	exitFailure     = 1   // The command failed
+	exitUsage       = 2   // The command or its arguments are wrong
+	exitInterrupted = 130 // The command was stopped by a signal
+)
+
+// command is a command of the cli, with its own flags and help
+type command struct {
+	names []string
+	flags func() *flagSet
+	check func(a *args) error // Checks the flags go together, before anything is read or written
+	run   func(ctx context.Context, a *args) error
+	help  func()
+}
+
+var commands = []command{
+	{
+		names: []string{"replace-all", "ra"},
+		flags: replaceAllFlags,
+		check: checkReplaceAllArgs,
+		run:   doReplaceAll,
+		help:  printReplaceAllHelp,
+	},
+	{
+		names: []string{"replace", "r"},
+		flags: replaceFlags,
+		check: checkReplaceArgs,
+		run:   doReplace,
+		help:  printReplaceHelp,
+	},
+	{
+		names: []string{"combine", "c"},
+		flags: combineFlags,
+		check: checkCombineArgs,
+		run:   doCombine,
+		help:  printCombineHelp,
+	},
+}
+
+// findCommand returns the command with the given name or alias, nil when there is none
+func findCommand(name string) *command {
+	for c := range commands {
+		for _, n := range commands[c].names {
+			if n == name {
+				return &commands[c]
+			}
+		}
+	}
+	return nil
+}
+
 func main() {
 	start := time.Now().UnixNano()
-	var cd int
-	var err error
-	if len(os.Args) > 1 {
-		util.DEBUG = getDebugFlag()
-		cmd := os.Args[1]
-		if cmd == "replace-all" || cmd == "ra" {
-			err = doReplaceAll()
-		} else if cmd == "combine" || cmd == "c" {
-			err = doCombine()
-		} else if cmd == "help" {
-			printHelp()
-		} else {
-			err = errors.New("unrecognized command")
-		}
-		if err != nil {
-			util.Error("error executing %s: %s", cmd, err)
-			os.Exit(2)
+	if len(os.Args) < 2 {
+		log.Error("Please supply a command. ")
+		printHelp()
+		os.Exit(exitUsage)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		os.Exit(doHelp(os.Args[2:]))
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		log.Error("unrecognized command %s", name)
+		fmt.Fprintf(os.Stderr, "Run '%s help' for the available commands.\n", os.Args[0])
+		os.Exit(exitUsage)
+	}
+	fs := cmd.flags()
+	a, err := fs.parse(os.Args[2:])
+	if err == flag.ErrHelp {
+		cmd.help()
+		os.Exit(0)
+	}
+	if err == nil {
+		if a.verbose {
+			logger = logging.NewText(os.Stderr, logging.LevelDebug)
+			log = util.NewLog(logger)
 		}
-	} else {
-		util.Error("Please supply a command. ")
+		fs.logFlags()
+		err = cmd.check(a)
+	}
+	if err != nil {
+		log.Error("%s: %s", name, err)
+		fmt.Fprintf(os.Stderr, "Run '%s %s --help' for usage.\n", os.Args[0], name)
+		os.Exit(exitCode(err))
+	}
+
+	ctx, stop := notifyContext()
+	err = cmd.run(ctx, a)
+	interrupted := ctx.Err() != nil
+	stop()
+	if err != nil && interrupted {
+		log.Error("%s was interrupted", name)
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		log.Error("error executing %s: %s", name, err)
+		os.Exit(exitCode(err))
+	}
+	log.Info("stringaling took %s to complete", util.HumanReadable(time.Now().UnixNano()-start))
+}
+
+// exitCode returns the exit code of a command that failed with err, telling a usage error from a failure
+func exitCode(err error) int {
+	if _, ok := err.(usageError); ok {
+		return exitUsage
+	}
+	return exitFailure
+}
+
+// doHelp prints the help of the command named in args, or the general help, returning the exit code
+func doHelp(args []string) int {
+	if len(args) == 0 {
+		printHelp()
+		return 0
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		log.Error("unrecognized command %s", args[0])
 		printHelp()
-		os.Exit(1)
+		return exitUsage
+	}
+	cmd.help()
+	return 0
+}
+
+// notifyContext returns a context that is cancelled on SIGINT or SIGTERM so the running command can remove
+// its temp files, a second signal exits straight away.
+func notifyContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Error("received %s, cleaning up, send it again to exit now", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		sig := <-signals
+		log.Error("received %s, exiting", sig)
+		os.Exit(exitInterrupted)
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// replaceAllFlags returns the flags of the replace-all command
+func replaceAllFlags() *flagSet {
+	fs := newFlagSet("replace-all")
+	fs.replaceFlags()
+	fs.value(&fs.a.startTokens, "s", "start")
+	fs.value(&fs.a.endTokens, "e", "end")
+	fs.string(&fs.a.rulesFile, "r", "rules")
+	fs.value((*sizeValue)(&fs.a.memoryLimit), "m", "memory")
+	fs.value(&fs.a.folds, "fold")
+	fs.value(&fs.a.normalize, "normalize")
+	fs.bool(&fs.a.regex, "regex")
+	fs.value((*sizeValue)(&fs.a.maxMatch), "max-match")
+	fs.value(&fs.a.elements, "element")
+	fs.value(&fs.a.fields, "field")
+	fs.value(&fs.a.drops, "drop")
+	fs.bool(&fs.a.ndjson, "ndjson")
+	return fs
+}
+
+func checkReplaceAllArgs(a *args) (err error) {
+	err = checkOutputArgs(a)
+	jsonFields := len(a.fields) > 0 || len(a.drops) > 0
+	if err == nil && len(a.startTokens) == 0 && a.rulesFile == "" && len(a.elements) == 0 && !jsonFields {
+		err = usagef("-s and -e, --rules, --element, or --field or --drop are required")
+	}
+	if err == nil && a.ndjson && !jsonFields {
+		err = usagef("--ndjson is only used with --field or --drop")
 	}
-	util.Info("stringaling took %s to complete", util.HumanReadable(time.Now().UnixNano()-start))
-	os.Exit(cd)
+	if err == nil && jsonFields {
+		_, err = buildFields(a)
+	} else if err == nil && len(a.elements) > 0 {
+		_, err = buildElements(a)
+	} else if err == nil {
+		_, err = buildRules(a)
+	}
+	return
 }
 
-func doReplaceAll() (err error) {
-	startToken, endToken, inputFileName, outputFileName, token, threads := getReplaceAllArgs()
-	if validateReplaceAllArgs(startToken, endToken, inputFileName, outputFileName) {
-		err = replaceall.ReplaceAll(inputFileName, outputFileName, startToken, endToken, token, threads)
+func doReplaceAll(ctx context.Context, a *args) (err error) {
+	opts := replaceOptions(a)
+	if len(a.fields) > 0 || len(a.drops) > 0 {
+		opts.Fields, err = buildFields(a)
+		opts.NDJSON = a.ndjson
+	} else if len(a.elements) > 0 {
+		opts.Elements, err = buildElements(a)
 	} else {
-		printReplaceAllHelp()
+		opts.Rules, err = buildRules(a)
+	}
+	if err == nil && a.rulesFile != "" {
+		var fileRules []replaceall.Rule
+		fileRules, err = replaceall.LoadRules(a.rulesFile)
+		opts.Rules = append(opts.Rules, fileRules...)
 	}
+	if err != nil {
+		return
+	}
+	opts.SpoolThreshold = a.memoryLimit
+	if a.dryRun {
+		return doDryRun(ctx, a, opts)
+	}
+	return replace(ctx, a, opts)
+}
+
+// replaceOptions returns the options shared by replace-all and replace
+func replaceOptions(a *args) (opts replaceall.Options) {
+	opts = replaceall.Options{
+		Threads:           a.threads,
+		OutputCompression: a.compression,
+		InputEncoding:     a.inputEnc,
+		OutputEncoding:    a.outputEnc,
+		TempDir:           a.tempDir,
+		Mode:              a.mode,
+		NoClobber:         !a.force,
+		Logger:            logger,
+	}
+	opts.OnProgress, opts.ProgressInterval = getProgressArg(a)
 	return
 }
 
-// getReplaceAllArgs gets the arguments from the os.Args slice relevant to the replaceall command
-func getReplaceAllArgs() (startToken string, endToken string, inputFile string, outputFile string, replaceWith string, threads int) {
-	args := os.Args[2:]
-	skip := false
-	for a, arg := range args {
-		if skip {
-			skip = false
-			continue
+// buildRules pairs up the nth start token with the nth end token, replacement token, case folding and normalization,
+// a single replacement token, case folding or normalization is used for every rule.
+// With --regex every pair of tokens is a pair of regular expressions matching at most --max-match bytes.
+func buildRules(a *args) (rules []replaceall.Rule, err error) {
+	startTokens, endTokens := a.startTokens, a.endTokens
+	if len(startTokens) != len(endTokens) {
+		err = usagef("got %d start tokens but %d end tokens, -s and -e must be given the same number of times", len(startTokens), len(endTokens))
+		return
+	}
+	if a.regex && a.maxMatch <= 0 {
+		err = usagef("--regex needs --max-match, the most bytes a token can match")
+		return
+	}
+	if !a.regex && a.maxMatch > 0 {
+		err = usagef("--max-match is only used with --regex")
+		return
+	}
+	for _, f := range []struct {
+		what   string
+		name   string
+		values []string
+	}{{"replacement tokens", "-w", a.tokens}, {"case foldings", "--fold", a.folds}, {"normalizations", "--normalize", a.normalize}} {
+		if len(f.values) > 1 && len(f.values) != len(startTokens) {
+			err = usagef("got %d %s for %d start tokens, %s must be given once or once per -s", len(f.values), f.what, len(startTokens), f.name)
+			return
 		}
-		isFlag := strings.Index(arg, "-") == 0
-		if isFlag {
-			if arg == "-s" {
-				skip = true
-				startToken = args[a+1]
-			} else if arg == "-e" {
-				skip = true
-				endToken = args[a+1]
-			} else if arg == "-i" {
-				skip = true
-				inputFile = args[a+1]
-			} else if arg == "-o" {
-				skip = true
-				outputFile = args[a+1]
-			} else if arg == "-w" {
-				skip = true
-				replaceWith = args[a+1]
-			} else if arg == "-t" {
-				skip = true
-				var err error
-				threads, err = strconv.Atoi(args[a+1])
-				if err != nil || threads <= 0 {
-					threads = 1
-				}
-			}
-			util.Debug("found %s, set to %s", arg, args[a+1])
+	}
+	for i := range startTokens {
+		rule := replaceall.Rule{StartToken: startTokens[i], EndToken: endTokens[i], Regex: a.regex, MaxLength: int(a.maxMatch)}
+		rule.Token = nthValue(a.tokens, i)
+		rule.Fold, err = replaceall.ParseCaseFold(nthValue(a.folds, i))
+		if err == nil {
+			rule.Normalize, err = replaceall.ParseNormalization(nthValue(a.normalize, i))
 		}
+		if err != nil {
+			err = usageError{err}
+			return
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+// buildElements pairs up the nth --element with the nth replacement token, a single replacement token is used for
+// every element. Elements are replaced instead of tokens, so none of the flags of the token pairs can be given.
+func buildElements(a *args) (elements []replaceall.Element, err error) {
+	if len(a.startTokens) > 0 || len(a.endTokens) > 0 || a.rulesFile != "" || len(a.folds) > 0 || len(a.normalize) > 0 || a.regex {
+		err = usagef("--element cannot be used with -s, -e, --rules, --fold, --normalize or --regex")
+		return
+	}
+	if len(a.tokens) > 1 && len(a.tokens) != len(a.elements) {
+		err = usagef("got %d replacement tokens for %d elements, -w must be given once or once per --element", len(a.tokens), len(a.elements))
+		return
+	}
+	for i, path := range a.elements {
+		elements = append(elements, replaceall.Element{Path: path, Token: nthValue(a.tokens, i)})
 	}
-	if threads == 0 {
-		threads = 1
+	return
+}
+
+// buildFields pairs up the nth --field with the nth replacement token, a single replacement token is used for
+// every field, then adds a field dropping each --drop. Fields are replaced instead of tokens or elements.
+func buildFields(a *args) (fields []replaceall.Field, err error) {
+	if len(a.startTokens) > 0 || len(a.endTokens) > 0 || a.rulesFile != "" || len(a.folds) > 0 || len(a.normalize) > 0 || a.regex ||
+		len(a.elements) > 0 {
+		err = usagef("--field and --drop cannot be used with -s, -e, --rules, --fold, --normalize, --regex or --element")
+		return
+	}
+	if len(a.tokens) > 1 && len(a.tokens) != len(a.fields) {
+		err = usagef("got %d replacement tokens for %d fields, -w must be given once or once per --field", len(a.tokens), len(a.fields))
+		return
+	}
+	if len(a.tokens) > 0 && len(a.fields) == 0 {
+		err = usagef("-w is not used with --drop, a dropped field has no replacement")
+		return
+	}
+	for i, path := range a.fields {
+		fields = append(fields, replaceall.Field{Path: path, Token: nthValue(a.tokens, i)})
+	}
+	for _, path := range a.drops {
+		fields = append(fields, replaceall.Field{Path: path, Drop: true})
 	}
 	return
 }
 
-func validateReplaceAllArgs(startToken string, endToken string, inputFile string, outputFile string) bool {
-	util.Debug("-s %s -e %s -i %s -o %s", startToken, endToken, inputFile, outputFile)
-	return inputFile != "" && outputFile != "" && startToken != "" && endToken != ""
+// nthValue returns the value of a flag for the nth rule, a flag given once is used for every rule
+func nthValue(values []string, n int) string {
+	switch {
+	case len(values) == 1:
+		return values[0]
+	case len(values) > 1:
+		return values[n]
+	}
+	return ""
 }
 
-func doCombine() (err error) {
-	files, outputFileName, deleteFiles := getCombineArgs()
-	if validateCombineArgs(files, outputFileName) {
-		err = combine.Combine(files, outputFileName, deleteFiles)
+// replace runs a replacement, in place when --in-place is given, and reports what it did
+func replace(ctx context.Context, a *args, opts replaceall.Options) (err error) {
+	if replaceall.IsTreeInput(a.input) {
+		return replaceTree(ctx, a, opts)
+	}
+	err = checkOverwrite(a, a.stats)
+	if err != nil {
+		return
+	}
+	opts.Checkpoint, opts.Resume = a.checkpoint, a.resume
+	var result replaceall.Result
+	if a.inPlace {
+		opts.BackupSuffix = a.backupSuffix
+		result, err = replaceall.ReplaceInPlaceContext(ctx, a.input, opts)
 	} else {
-		printCombineHelp()
+		result, err = replaceall.ReplaceAllWithContext(ctx, a.input, a.output, opts)
+	}
+	if err == nil {
+		err = reportResult(a, result)
 	}
 	return
 }
 
-func getCombineArgs() (files []string, outputFile string, deleteFiles bool) {
-	args := os.Args[2:]
-	skip := false
-	for a, arg := range args {
-		if skip {
-			skip = false
-			continue
-		}
-		isFlag := strings.Index(arg, "-") == 0
-		if isFlag {
-			if arg == "-f" {
-				skip = true
-				files = append(files, args[a+1])
-			} else if arg == "-d" {
-				deleteFiles = true
-			} else if arg == "-o" {
-				skip = true
-				outputFile = args[a+1]
+// replaceTree runs a replacement over every file in a directory or matching a glob pattern,
+// reporting what it did to each file as it is done and then in total
+func replaceTree(ctx context.Context, a *args, opts replaceall.Options) (err error) {
+	if a.checkpoint != "" {
+		return errors.New("--checkpoint takes a single input file")
+	}
+	err = checkOverwrite(a, a.stats)
+	if err != nil {
+		return
+	}
+	treeOpts := replaceall.TreeOptions{
+		Options: opts,
+		Include: a.include,
+		Exclude: a.exclude,
+		InPlace: a.inPlace,
+		OnFile: func(f replaceall.FileResult) {
+			if f.Error != "" {
+				log.Error("%s: %s", f.Input, f.Error)
+				return
 			}
+			log.Info("%s: replaced %d regions and %d needles, read %d bytes and wrote %d bytes to %s",
+				f.Input, f.Result.Replacements, f.Result.Substitutions, f.Result.BytesRead, f.Result.BytesWritten, f.Output)
+		},
+	}
+	treeOpts.BackupSuffix = a.backupSuffix
+	result, err := replaceall.ReplaceTreeContext(ctx, a.input, a.output, treeOpts)
+	if len(result.Files) > 0 {
+		log.Info("replaced %d files, %d failed", len(result.Files)-result.Failed, result.Failed)
+		logResult(result.Total)
+		werr := writeStats(a, result)
+		if err == nil {
+			err = werr
+		}
+	}
+	return
+}
+
+// replaceFlags returns the flags of the replace command
+func replaceFlags() *flagSet {
+	fs := newFlagSet("replace")
+	fs.replaceFlags()
+	fs.value(&fs.a.needles, "n", "needle")
+	return fs
+}
+
+func checkReplaceArgs(a *args) (err error) {
+	err = checkOutputArgs(a)
+	if err == nil && len(a.needles) == 0 {
+		err = usagef("-n is required")
+	}
+	if err == nil {
+		_, err = buildSubstitutions(a.needles, a.tokens)
+	}
+	return
+}
+
+func doReplace(ctx context.Context, a *args) (err error) {
+	substitutions, err := buildSubstitutions(a.needles, a.tokens)
+	if err != nil {
+		return
+	}
+	opts := replaceOptions(a)
+	opts.Substitutions = substitutions
+	if a.dryRun {
+		return doDryRun(ctx, a, opts)
+	}
+	return replace(ctx, a, opts)
+}
+
+// buildSubstitutions pairs up the nth needle with the nth replacement token,
+// a single replacement token is used for every needle.
+func buildSubstitutions(needles []string, tokens []string) (substitutions []replaceall.Substitution, err error) {
+	if len(tokens) > 1 && len(tokens) != len(needles) {
+		err = usagef("got %d replacement tokens for %d needles, -w must be given once or once per -n", len(tokens), len(needles))
+		return
+	}
+	for i := range needles {
+		sub := replaceall.Substitution{Needle: needles[i]}
+		if len(tokens) == 1 {
+			sub.Replacement = tokens[0]
+		} else if len(tokens) > 1 {
+			sub.Replacement = tokens[i]
+		}
+		substitutions = append(substitutions, sub)
+	}
+	return
+}
+
+// combineFlags returns the flags of the combine command
+func combineFlags() *flagSet {
+	fs := newFlagSet("combine")
+	fs.outputFlags()
+	fs.value(&fs.a.files, "f", "file")
+	fs.bool(&fs.a.deleteFiles, "d", "delete")
+	return fs
+}
+
+func checkCombineArgs(a *args) error {
+	switch {
+	case len(a.files) < 2:
+		return usagef("-f must be given at least twice")
+	case a.output == "":
+		return usagef("-o is required")
+	}
+	return nil
+}
+
+func doCombine(ctx context.Context, a *args) (err error) {
+	opts := combine.Options{DeleteFiles: a.deleteFiles, Mode: a.mode, NoClobber: !a.force, Logger: logger}
+	opts.OnProgress, opts.ProgressInterval = getProgressArg(a)
+	return combine.CombineWithContext(ctx, a.files, a.output, opts)
+}
+
+// doDryRun reports what a replacement would do instead of doing it.
+// The summary is printed to stdout, unless the matches are written there.
+func doDryRun(ctx context.Context, a *args, opts replaceall.Options) (err error) {
+	if replaceall.IsTreeInput(a.input) {
+		return usagef("a dry run takes a single input file")
+	}
+	err = checkOverwrite(a, a.matches)
+	if err != nil {
+		return
+	}
+	summary := os.Stdout
+	var matches io.Writer
+	var matchesFile *util.OutputFile
+	if util.IsStdStream(a.matches) {
+		matches = os.Stdout
+		summary = os.Stderr
+	} else if a.matches != "" {
+		matchesFile, err = util.CreateOutput(a.matches, a.mode)
+		if err != nil {
+			log.Error("cannot open matches file (%s): %s", a.matches, err)
+			return
+		}
+		matchesFile.NoClobber = !a.force
+		matches = matchesFile
+	}
+	var report replaceall.Report
+	report, err = replaceall.DryRunContext(ctx, a.input, opts, matches)
+	if matchesFile != nil {
+		if err == nil {
+			err = matchesFile.Commit()
+		} else {
+			matchesFile.Abort()
+		}
+	}
+	if err != nil {
+		return
+	}
+	printReport(summary, report, opts)
+	return
+}
+
+// printReport prints the summary of a dry run
+func printReport(w io.Writer, report replaceall.Report, opts replaceall.Options) {
+	fmt.Fprintln(w, "Dry run, nothing was written.")
+	if len(opts.Rules) > 0 {
+		fmt.Fprintf(w, "Regions replaced     : %d (%d bytes)\n", report.Regions, report.RegionBytes)
+		for r, rule := range opts.Rules {
+			fmt.Fprintf(w, "    %s ... %s : %d\n", rule.StartToken, rule.EndToken, report.PerRule[r])
+		}
+	}
+	if len(opts.Elements) > 0 {
+		fmt.Fprintf(w, "Elements replaced    : %d (%d bytes)\n", report.Regions, report.RegionBytes)
+		for e, element := range opts.Elements {
+			fmt.Fprintf(w, "    %s : %d\n", element.Path, report.PerRule[e])
+		}
+	}
+	if len(opts.Fields) > 0 {
+		fmt.Fprintf(w, "Fields replaced      : %d (%d bytes)\n", report.Regions, report.RegionBytes)
+		for f, field := range opts.Fields {
+			fmt.Fprintf(w, "    %s : %d\n", field.Path, report.PerRule[f])
+		}
+	}
+	if len(opts.Substitutions) > 0 {
+		fmt.Fprintf(w, "Needles substituted  : %d (%d bytes)\n", report.Needles, report.NeedleBytes)
+		for n, sub := range opts.Substitutions {
+			fmt.Fprintf(w, "    %s : %d\n", sub.Needle, report.PerNeedle[n])
+		}
+	}
+	if len(opts.Rules) > 0 {
+		fmt.Fprintf(w, "Unterminated regions : %d\n", len(report.Unterminated))
+		for _, m := range report.Unterminated {
+			rule := opts.Rules[m.Index]
+			fmt.Fprintf(w, "    %s at byte %d, the last %d bytes are left as is\n", rule.StartToken, m.Offset, m.Length)
+		}
+	}
+}
+
+// reportResult logs what a replacement did, also writing it as JSON to the file given with --stats
+func reportResult(a *args, result replaceall.Result) (err error) {
+	logResult(result)
+	return writeStats(a, result)
+}
+
+// logResult logs what a replacement did
+func logResult(result replaceall.Result) {
+	log.Info("replaced %d regions and %d needles, removing %d bytes", result.Replacements, result.Substitutions, result.BytesRemoved)
+	log.Info("read %d bytes and wrote %d bytes", result.BytesRead, result.BytesWritten)
+	if result.MaxDepth > 1 {
+		log.Info("replacements were nested up to %d deep", result.MaxDepth)
+	}
+	if result.Unterminated > 0 {
+		log.Info("%d replacement was never closed, it was written as is", result.Unterminated)
+	}
+	log.Info("%d pass on %d threads took %s", result.Passes, result.Threads, util.HumanReadable(result.Duration.Nanoseconds()))
+}
+
+// writeStats writes the result of a replacement as JSON to the file given with --stats, if any
+func writeStats(a *args, result interface{}) (err error) {
+	if a.stats == "" {
+		return
+	}
+	var statsFile io.Writer = os.Stdout
+	var output *util.OutputFile
+	if !util.IsStdStream(a.stats) {
+		output, err = util.CreateOutput(a.stats, a.mode)
+		if err != nil {
+			log.Error("cannot open stats file (%s): %s", a.stats, err)
+			return
 		}
+		output.NoClobber = !a.force
+		statsFile = output
+	}
+	encoder := json.NewEncoder(statsFile)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(result)
+	if output != nil {
+		if err == nil {
+			err = output.Commit()
+		} else {
+			output.Abort()
+		}
+	}
+	if err != nil {
+		log.Error("couldn't write stats to %s: %s", a.stats, err)
 	}
 	return
 }
 
-func validateCombineArgs(files []string, outputFile string) bool {
-	return len(files) > 1 && outputFile != ""
+// checkOverwrite fails if any of the files already exists, unless --force is given. It is only checked before the run
+// so it does not go to waste, the files are also committed without replacing one that appeared since.
+func checkOverwrite(a *args, fileNames ...string) error {
+	if a.force {
+		return nil
+	}
+	for _, fileName := range fileNames {
+		if fileName == "" || util.IsStdStream(fileName) {
+			continue
+		}
+		if _, err := os.Stat(fileName); err == nil {
+			return fmt.Errorf("%s already exists, give --force to overwrite it", fileName)
+		}
+	}
+	return nil
 }
 
-// getDebugFlag returns true if the verbose flag was supplied
-func getDebugFlag() bool {
-	for _, arg := range os.Args {
-		if arg == "-v" {
-			return true
+// getProgressArg returns the callback showing progress on stderr when --progress is given, and how often to call it.
+// On a terminal a single line is redrawn in place, otherwise every report is written as a line of JSON.
+func getProgressArg(a *args) (onProgress func(p progress.Progress), interval time.Duration) {
+	if !a.progress {
+		return
+	}
+	stats, err := os.Stderr.Stat()
+	if err != nil || stats.Mode()&os.ModeCharDevice == 0 {
+		encoder := json.NewEncoder(os.Stderr)
+		return func(p progress.Progress) {
+			_ = encoder.Encode(p)
+		}, progress.DefaultInterval
+	}
+	width := 0
+	return func(p progress.Progress) {
+		line := progressLine(p)
+		// Pad with spaces to clear whatever is left of a longer previous line
+		fmt.Fprintf(os.Stderr, "\r%-*s", width, line)
+		width = len(line)
+		if p.Done {
+			fmt.Fprintln(os.Stderr)
 		}
+	}, 250 * time.Millisecond
+}
+
+// progressLine formats progress for a terminal, e.g. " 42.1%  1.13 GiB of 2.69 GiB  85.3 MiB/s  ETA 18s  4 threads"
+func progressLine(p progress.Progress) string {
+	var sb strings.Builder
+	if percent := p.Percent(); percent >= 0 {
+		sb.WriteString(fmt.Sprintf("%5.1f%%  %s of %s", percent, humanBytes(float64(p.Bytes)), humanBytes(float64(p.Total))))
+	} else {
+		sb.WriteString(humanBytes(float64(p.Bytes)))
 	}
-	return false
+	sb.WriteString(fmt.Sprintf("  %s/s", humanBytes(p.Rate)))
+	if p.Done {
+		sb.WriteString(fmt.Sprintf("  in %s", p.Elapsed.Round(time.Second)))
+	} else if p.ETA > 0 {
+		sb.WriteString(fmt.Sprintf("  ETA %s", p.ETA.Round(time.Second)))
+	}
+	if len(p.Workers) > 1 {
+		sb.WriteString(fmt.Sprintf("  %d threads", len(p.Workers)))
+	}
+	return sb.String()
 }
+
+// humanBytes formats a byte count with a binary unit
+func humanBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	u := 0
+	for b >= 1024 && u < len(units)-1 {
+		b /= 1024
+		u++
+	}
+	if u == 0 {
+		return fmt.Sprintf("%.0f %s", b, units[u])
+	}
+	return fmt.Sprintf("%.2f %s", b, units[u])
+}
+
 func printHelp() {
 	fmt.Println("")
 	fmt.Println("This utility is a streaming string replacement tool.")
 	fmt.Println("Massive amounts of memory are not needed for extremely large files.")
+	fmt.Println("Log output is written to stderr, so - can be used for stdin and stdout in a pipeline.")
 	fmt.Println("")
 	fmt.Println(fmt.Sprintf("Usage : %s COMMAND [-v] ...", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s COMMAND --help", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s help [COMMAND]", os.Args[0]))
 	fmt.Println("")
 	fmt.Println("Options:")
-	fmt.Println("        COMMAND : A command to perform by stringaling")
-	fmt.Println("        -v      : Verbose output")
+	fmt.Println("        COMMAND       : A command to perform by stringaling")
+	fmt.Println("        -v, --verbose : Verbose output")
+	fmt.Println("        -h, --help    : Shows the help of the command")
+	fmt.Println("")
+	fmt.Println("Every flag can also be given as --flag=value. A flag that is not known, a value that is not valid or a missing")
+	fmt.Println("required flag is an error, exiting with status 2. A command that fails exits with 1, and an interrupted command with 130.")
 	fmt.Println("")
 	fmt.Println("Available Commands:")
 	fmt.Println("        replace-all, ra  - This will replace all characters between two tokens, including those tokens. ")
+	fmt.Println("        replace, r       - This will replace every occurrence of a token with another token. ")
 	fmt.Println("        combine, c       - This will combine a set of files into a single file, in the order provided. ")
-	fmt.Println("        help             - This will show this help screen")
+	fmt.Println("        help [COMMAND]   - This will show this help screen, or the help of a command")
 	fmt.Println("")
 
 }
@@ -169,23 +723,193 @@ func printHelp() {
 func printReplaceAllHelp() {
 	fmt.Println("")
 	fmt.Println("replaceall,rall - This will replace all characters between two tokens, including those tokens.")
-	fmt.Println("                  this streams the input one byte at a time, which is why there are strict limitations. ")
+	fmt.Println("                  this streams the input in blocks, which is why there are strict limitations. ")
 	fmt.Println("")
-	fmt.Println("This command does NOT support REGEX and requires strict tokens to be given for marking the beginning and end of replacement.")
+	fmt.Println("The tokens marking the beginning and end of replacement are strict, unless --regex makes them regular expressions.")
 	fmt.Println("This command supports the beginning and end tokens being the same token.")
+	fmt.Println("Several token pairs can be replaced in the same pass by repeating -s, -e and -w, the nth -s goes with the nth -e and -w.")
+	fmt.Println("While a replacement is open, only the tokens of its own pair are looked for.")
 	fmt.Println("")
-	fmt.Println(fmt.Sprintf("Usage : %s replace-all|ra -i INPUTFILE -o OUTPUTFILE -s STARTTOKEN -e ENDTOKEN [-w TOKEN]", os.Args[0]))
+	fmt.Println(fmt.Sprintf("Usage : %s replace-all|ra -i INPUTFILE -o OUTPUTFILE -s STARTTOKEN -e ENDTOKEN [-w TOKEN] [-s STARTTOKEN -e ENDTOKEN [-w TOKEN]]... [-t THREADS] [-m MEMORY] [-z FORMAT]", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace-all|ra -i INPUTFILE -o OUTPUTFILE --regex --max-match LENGTH -s STARTREGEX -e ENDREGEX [-w TOKEN]...", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace-all|ra -i INPUTFILE -o OUTPUTFILE --element PATH [-w TOKEN] [--element PATH [-w TOKEN]]...", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace-all|ra -i INPUTFILE -o OUTPUTFILE [--ndjson] --field PATH [-w JSON] [--field PATH [-w JSON]]... [--drop PATH]...", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace-all|ra -i INPUTFILE -o OUTPUTFILE --rules RULESFILE [-t THREADS] [-m MEMORY] [-z FORMAT]", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace-all|ra -i INPUTFILE --in-place [--backup-suffix SUFFIX] ...", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace-all|ra ... --checkpoint CHECKPOINTFILE [--resume]", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace-all|ra -i INPUTFILE --dry-run|--matches MATCHESFILE [-s STARTTOKEN -e ENDTOKEN [-w TOKEN]]... [--rules RULESFILE]", os.Args[0]))
 	fmt.Println("")
 	fmt.Println("Options:")
-	fmt.Println("        -i INPUTFILE  : The file to stringaling process ")
-	fmt.Println("        -o OUTPUTFILE : The file to write the result of the stringaling process to.")
-	fmt.Println("        -s STARTTOKEN : The token to mark the beginning of replacement. ")
-	fmt.Println("        -e ENDTOKEN   : The token to mark the end of replacement. ")
-	fmt.Println("        -w TOKEN      : The token to replace the marked characters with, if not supplied, defaults to emptystring. ")
-	fmt.Println("        -t THREADS    : (Experimental) The number of threads to split work against. The higher this count, ")
-	fmt.Println("                        the less accurate replacement is, as it is unknown if the start of a thread should be written. ")
-	fmt.Println("                        However, the more threads there are, the faster the program will complete. ")
+	fmt.Println("        -i, --input INPUTFILE")
+	fmt.Println("                      : The file to stringaling process, - reads stdin. ")
+	fmt.Println("                        Input that cannot be seeked, like stdin or a pipe, is streamed with a single thread. ")
+	fmt.Println("                        A directory or a quoted glob pattern, e.g. 'dumps/*.xml', replaces every file in it, ")
+	fmt.Println("                        several at once within the -t threads, see --include and --exclude. ")
+	fmt.Println("        -o, --output OUTPUTFILE")
+	fmt.Println("                      : The file to write the result of the stringaling process to, - writes stdout.")
+	fmt.Println("                        When -i is a directory or a glob pattern, the directory to write each file to, ")
+	fmt.Println("                        at the same path relative to the input. ")
+	fmt.Println("        --include PATTERN")
+	fmt.Println("                      : Only replaces the files whose path relative to -i, or name, matches PATTERN, e.g. '*.xml'. ")
+	fmt.Println("                        Can be given several times. ")
+	fmt.Println("        --exclude PATTERN")
+	fmt.Println("                      : Skips the files and directories whose path relative to -i, or name, matches PATTERN. ")
+	fmt.Println("                        Can be given several times. ")
+	fmt.Println("        --in-place    : Replaces the input file with the result instead of writing an output file. ")
+	fmt.Println("                        The input file is only replaced once the result is complete and synced to disk, ")
+	fmt.Println("                        keeping its permissions and ownership. ")
+	fmt.Println("        --backup-suffix SUFFIX")
+	fmt.Println("                      : With --in-place, keeps the original input file with SUFFIX added to its name. ")
+	fmt.Println("        --force       : Overwrites output files that already exist. ")
+	fmt.Println("        --mode MODE   : The octal permissions of the output files, e.g. 0640. If not supplied, 0666 less the umask. ")
+	fmt.Println("        --temp-dir DIR")
+	fmt.Println("                      : The directory to write the partial output of each thread to, if not supplied, the system's. ")
+	fmt.Println("                        Each run uses a directory of its own in it, removed once the run is over. ")
+	fmt.Println("        --checkpoint CHECKPOINTFILE")
+	fmt.Println("                      : Saves how far each thread has got to CHECKPOINTFILE every 30 seconds, so an interrupted run ")
+	fmt.Println("                        can be resumed. The temp files are kept in CHECKPOINTFILE.parts until the run succeeds. ")
+	fmt.Println("        --resume      : With --checkpoint, picks up from the checkpoint of an interrupted run, giving the same ")
+	fmt.Println("                        output as a run that was never interrupted. Starts from the beginning when there is none. ")
+	fmt.Println("        -s, --start STARTTOKEN")
+	fmt.Println("                      : The token to mark the beginning of replacement. ")
+	fmt.Println("        -e, --end ENDTOKEN")
+	fmt.Println("                      : The token to mark the end of replacement. ")
+	fmt.Println("        -w, --with TOKEN")
+	fmt.Println("                      : The token to replace the marked characters with, if not supplied, defaults to emptystring. ")
+	fmt.Println("                        When given once, it is used for every pair of tokens. ")
+	fmt.Println("        --fold MODE   : How the tokens match letters of another case: none, the default, ascii for A to Z, ")
+	fmt.Println("                        or unicode for every letter of the Unicode simple case folding, e.g. k also matches K. ")
+	fmt.Println("                        When given once, it is used for every pair of tokens. ")
+	fmt.Println("        --normalize FORM")
+	fmt.Println("                      : Matches the tokens however they are written in the Unicode normalization form FORM, ")
+	fmt.Println("                        nfc for canonically equivalent text, e.g. an accent as a combining mark, or nfkc for ")
+	fmt.Println("                        compatible text too, e.g. full width letters. The input is written as it was. ")
+	fmt.Println("                        When given once, it is used for every pair of tokens. ")
+	fmt.Println("        --regex       : The tokens given with -s and -e are regular expressions in Go's syntax, e.g. '<phi[^>]*>'. ")
+	fmt.Println("                        The longest match wins. Anchors and word boundaries are not supported, (?i) folds case. ")
+	fmt.Println("        --max-match LENGTH")
+	fmt.Println("                      : With --regex, the most bytes a token can match, accepts k, m and g suffixes. Longer text ")
+	fmt.Println("                        is not matched, so no more than about twice this is held back while looking for a token. ")
+	fmt.Println("        --element PATH")
+	fmt.Println("                      : Replaces XML elements instead of token pairs, reading the input as an XML document. ")
+	fmt.Println("                        PATH is an element name, e.g. phi, or a path of names, e.g. test/phi/ssn, from the root ")
+	fmt.Println("                        element when it starts with /, * is any name. The element is found whatever its attributes, ")
+	fmt.Println("                        and when self-closing, but not in comments or CDATA. -w must be well-formed XML, e.g. '<phi/>'. ")
+	fmt.Println("                        Can be given several times, paired with -w like -s. The input is read with a single thread. ")
+	fmt.Println("        --field PATH  : Replaces JSON values instead of token pairs, reading the input as JSON. PATH is a key, e.g. ssn, ")
+	fmt.Println("                        or a path of keys and array indexes, e.g. patient/ssn, from the top of the value when it starts ")
+	fmt.Println("                        with / like a JSON pointer, * is any key or index. The key is found however it is escaped, ")
+	fmt.Println("                        but never inside a string. -w must be a JSON value, e.g. '\"***\"', if not supplied null. ")
+	fmt.Println("                        Can be given several times, paired with -w like -s. Invalid JSON input is an error. ")
+	fmt.Println("        --drop PATH   : Like --field, but removes the value, with its key in an object, keeping the JSON valid. ")
+	fmt.Println("                        Can be given several times. ")
+	fmt.Println("        --ndjson      : With --field or --drop, the input has a JSON value on every line, the lines are split across ")
+	fmt.Println("                        threads. Otherwise JSON input is read with a single thread. ")
+	fmt.Println("        -r, --rules RULESFILE")
+	fmt.Println("                      : A YAML (.yaml, .yml), JSON (.json) or TOML (.toml) file of token pairs to replace, ")
+	fmt.Println("                        applied after any given with -s and -e. The file is checked before anything is read or written. ")
+	fmt.Println("        -t, --threads THREADS")
+	fmt.Println("                      : The number of threads to split work against. The output is the same as a single threaded run, ")
+	fmt.Println("                        a thread that starts inside an unfinished replacement picks up where the previous one left off. ")
 	fmt.Println("                        For peak performance, set this to the total number of cores available. ")
+	fmt.Println("        -m, --memory MEMORY")
+	fmt.Println("                      : The most skipped bytes each thread keeps in memory while a replacement is open, ")
+	fmt.Println("                        past this they are cached in a temp file. Accepts k, m and g suffixes, e.g. 64m. ")
+	fmt.Println("                        If not supplied, skipped bytes are always kept in memory. ")
+	fmt.Println("        --input-encoding ENCODING")
+	fmt.Println("                      : The encoding of the input, utf-8, utf-16, utf-16le, utf-16be or windows-1252, if not supplied utf-8. ")
+	fmt.Println("                        The input is decoded before the tokens, given in utf-8, are matched. utf-16 takes the byte order ")
+	fmt.Println("                        from the byte order mark, little endian without one. ")
+	fmt.Println("        --output-encoding ENCODING")
+	fmt.Println("                      : The encoding of the output, if not supplied the same as the input. A byte order mark in the input ")
+	fmt.Println("                        is kept, unless the output encoding has none. A character the output encoding lacks is an error. ")
+	fmt.Println("        -z, --compress FORMAT")
+	fmt.Println("                      : Compresses the output with gzip, zstd or bzip2, if not supplied the output is not compressed, ")
+	fmt.Println("                        unless it replaces the input in place, then it is compressed like the input. ")
+	fmt.Println("        --stats STATSFILE")
+	fmt.Println("                      : Writes what the replacement did to STATSFILE as JSON, - writes stdout, unless -o does. ")
+	fmt.Println("        --progress    : Shows the progress on stderr, as a line redrawn in place on a terminal, otherwise as a line of JSON every second. ")
+	fmt.Println("        --dry-run     : Reports how many regions would be replaced and any left unterminated, without writing anything. ")
+	fmt.Println("                        -o is not needed. The input is read with a single thread. ")
+	fmt.Println("        --matches MATCHESFILE")
+	fmt.Println("                      : Does a dry run, also writing every match to MATCHESFILE as a line of JSON, - writes stdout, ")
+	fmt.Println("                        unless -o does. ")
+	fmt.Println("")
+	fmt.Println("Compressed input (gzip, zstd or bzip2) is detected from its magic bytes or extension and decompressed as it is read.")
+	fmt.Println("The members of a gzip file and the frames of a zstd file are split across threads, other compressed input uses a single thread.")
+	fmt.Println("")
+}
+
+func printReplaceHelp() {
+	fmt.Println("")
+	fmt.Println("replace,r - This will replace every occurrence of a token with another token.")
+	fmt.Println("            this streams the input in blocks, holding back no more than the longest token. ")
+	fmt.Println("")
+	fmt.Println("This command does NOT support REGEX and requires strict tokens to be given.")
+	fmt.Println("Several tokens can be replaced in the same pass by repeating -n and -w, the nth -n goes with the nth -w.")
+	fmt.Println("")
+	fmt.Println(fmt.Sprintf("Usage : %s replace|r -i INPUTFILE -o OUTPUTFILE -n NEEDLE [-w TOKEN] [-n NEEDLE [-w TOKEN]]... [-t THREADS] [-z FORMAT]", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace|r -i INPUTFILE --in-place [--backup-suffix SUFFIX] -n NEEDLE [-w TOKEN] [-n NEEDLE [-w TOKEN]]...", os.Args[0]))
+	fmt.Println(fmt.Sprintf("        %s replace|r -i INPUTFILE --dry-run|--matches MATCHESFILE -n NEEDLE [-n NEEDLE]...", os.Args[0]))
+	fmt.Println("")
+	fmt.Println("Options:")
+	fmt.Println("        -i, --input INPUTFILE")
+	fmt.Println("                      : The file to stringaling process, - reads stdin. ")
+	fmt.Println("                        Input that cannot be seeked, like stdin or a pipe, is streamed with a single thread. ")
+	fmt.Println("                        A directory or a quoted glob pattern, e.g. 'dumps/*.xml', replaces every file in it, ")
+	fmt.Println("                        several at once within the -t threads, see --include and --exclude. ")
+	fmt.Println("        -o, --output OUTPUTFILE")
+	fmt.Println("                      : The file to write the result of the stringaling process to, - writes stdout.")
+	fmt.Println("                        When -i is a directory or a glob pattern, the directory to write each file to, ")
+	fmt.Println("                        at the same path relative to the input. ")
+	fmt.Println("        --include PATTERN")
+	fmt.Println("                      : Only replaces the files whose path relative to -i, or name, matches PATTERN, e.g. '*.xml'. ")
+	fmt.Println("                        Can be given several times. ")
+	fmt.Println("        --exclude PATTERN")
+	fmt.Println("                      : Skips the files and directories whose path relative to -i, or name, matches PATTERN. ")
+	fmt.Println("                        Can be given several times. ")
+	fmt.Println("        --in-place    : Replaces the input file with the result instead of writing an output file. ")
+	fmt.Println("                        The input file is only replaced once the result is complete and synced to disk, ")
+	fmt.Println("                        keeping its permissions and ownership. ")
+	fmt.Println("        --backup-suffix SUFFIX")
+	fmt.Println("                      : With --in-place, keeps the original input file with SUFFIX added to its name. ")
+	fmt.Println("        --force       : Overwrites output files that already exist. ")
+	fmt.Println("        --mode MODE   : The octal permissions of the output files, e.g. 0640. If not supplied, 0666 less the umask. ")
+	fmt.Println("        --temp-dir DIR")
+	fmt.Println("                      : The directory to write the partial output of each thread to, if not supplied, the system's. ")
+	fmt.Println("                        Each run uses a directory of its own in it, removed once the run is over. ")
+	fmt.Println("        --checkpoint CHECKPOINTFILE")
+	fmt.Println("                      : Saves how far each thread has got to CHECKPOINTFILE every 30 seconds, so an interrupted run ")
+	fmt.Println("                        can be resumed. The temp files are kept in CHECKPOINTFILE.parts until the run succeeds. ")
+	fmt.Println("        --resume      : With --checkpoint, picks up from the checkpoint of an interrupted run, giving the same ")
+	fmt.Println("                        output as a run that was never interrupted. Starts from the beginning when there is none. ")
+	fmt.Println("        -n, --needle NEEDLE")
+	fmt.Println("                      : The token to replace, this option can be supplied multiple times. ")
+	fmt.Println("        -w, --with TOKEN")
+	fmt.Println("                      : The token to replace the needle with, if not supplied, defaults to emptystring. ")
+	fmt.Println("                        When given once, it is used for every needle. ")
+	fmt.Println("        -t, --threads THREADS")
+	fmt.Println("                      : The number of threads to split work against. ")
+	fmt.Println("                        For peak performance, set this to the total number of cores available. ")
+	fmt.Println("        --input-encoding ENCODING")
+	fmt.Println("                      : The encoding of the input, utf-8, utf-16, utf-16le, utf-16be or windows-1252, if not supplied utf-8. ")
+	fmt.Println("                        The input is decoded before the tokens, given in utf-8, are matched. utf-16 takes the byte order ")
+	fmt.Println("                        from the byte order mark, little endian without one. ")
+	fmt.Println("        --output-encoding ENCODING")
+	fmt.Println("                      : The encoding of the output, if not supplied the same as the input. A byte order mark in the input ")
+	fmt.Println("                        is kept, unless the output encoding has none. A character the output encoding lacks is an error. ")
+	fmt.Println("        -z, --compress FORMAT")
+	fmt.Println("                      : Compresses the output with gzip, zstd or bzip2, if not supplied the output is not compressed, ")
+	fmt.Println("                        unless it replaces the input in place, then it is compressed like the input. ")
+	fmt.Println("        --stats STATSFILE")
+	fmt.Println("                      : Writes what the replacement did to STATSFILE as JSON, - writes stdout, unless -o does. ")
+	fmt.Println("        --progress    : Shows the progress on stderr, as a line redrawn in place on a terminal, otherwise as a line of JSON every second. ")
+	fmt.Println("        --dry-run     : Reports how many needles would be substituted, without writing anything. -o is not needed. ")
+	fmt.Println("        --matches MATCHESFILE")
+	fmt.Println("                      : Does a dry run, also writing every match to MATCHESFILE as a line of JSON, - writes stdout, ")
+	fmt.Println("                        unless -o does. ")
+	fmt.Println("")
+	fmt.Println("Compressed input is detected and decompressed as for replace-all. ")
 	fmt.Println("")
 }
 
@@ -198,8 +922,14 @@ func printCombineHelp() {
 	fmt.Println(fmt.Sprintf("Usage : %s combine|c [-d] -f FILENAME [-f FILENAME]... -o OUTPUTFILE", os.Args[0]))
 	fmt.Println("")
 	fmt.Println("Options:")
-	fmt.Println("        -d            : Deletes the source files when supplied.")
-	fmt.Println("        -f FILENAME   : Adds a file to the combination pool.")
-	fmt.Println("        -o OUTPUTFILE : Sets the name of the file to write the combination to.")
+	fmt.Println("        -d, --delete")
+	fmt.Println("                      : Deletes the source files when supplied.")
+	fmt.Println("        -f, --file FILENAME")
+	fmt.Println("                      : Adds a file to the combination pool, - reads stdin.")
+	fmt.Println("        -o, --output OUTPUTFILE")
+	fmt.Println("                      : Sets the name of the file to write the combination to, - writes stdout.")
+	fmt.Println("        --force       : Overwrites output files that already exist. ")
+	fmt.Println("        --mode MODE   : The octal permissions of the output files, e.g. 0640. If not supplied, 0666 less the umask. ")
+	fmt.Println("        --progress    : Shows the progress on stderr, as a line redrawn in place on a terminal, otherwise as a line of JSON every second. ")
 	fmt.Println("")
 }